@@ -0,0 +1,260 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/diamondburned/ffsync/ffmpeg"
+)
+
+// The exit codes of every command.
+const (
+	exitOK       = 0
+	exitError    = 1 // the command failed
+	exitUsage    = 2 // invalid flags, arguments or settings
+	exitProblems = 3 // the command ran, but found bad outputs or failed jobs
+)
+
+// command is a subcommand of the CLI.
+type command struct {
+	name  string
+	args  string // the arguments after the flags, such as "[src dst]"
+	short string
+	main  func(cmd command, args []string)
+}
+
+// commands are the subcommands in the order they're listed in the help.
+var commands = []command{
+	{"watch", "[src dst]", "synchronize the destination and keep watching the source (default)", watchMain},
+	{"sync", "[src dst]", "synchronize the destination once and wait for every job", syncMain},
+	{"plan", "[src dst]", "print what sync and prune would do without doing it", planMain},
+	{"verify", "[src dst]", "check every output against the source", verifyMain},
+	{"prune", "[src dst]", "remove the outputs whose sources are gone", pruneMain},
+	{"status", "[dst]", "print the dead-letter list and the recent jobs", statusMain},
+	{"retry", "[dst [src...]]", "take files off the dead-letter list so they're tried again", retryMain},
+	{"history", "[dst]", "report on the past jobs", historyMain},
+	{"probe", "file...", "print what ffprobe knows about the files", probeMain},
+}
+
+// aliases are the old names of commands.
+var aliases = map[string]string{
+	"deadletters": "status",
+	"requeue":     "retry",
+}
+
+func lookupCommand(name string) (command, bool) {
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func main() {
+	var args = os.Args[1:]
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+			helpMain(args[1:])
+			return
+		}
+
+		if cmd, ok := lookupCommand(args[0]); ok {
+			cmd.main(cmd, args[1:])
+			return
+		}
+
+		// watch never takes a single argument.
+		if len(args) == 1 && !strings.HasPrefix(args[0], "-") {
+			fmt.Fprintf(os.Stderr, "Unknown command %q; run \"%s help\" for the commands.\n", args[0], filepath.Base(os.Args[0]))
+			os.Exit(exitUsage)
+		}
+	}
+
+	// Without a command, the arguments are the ones of watch, which is what
+	// ffsync used to only do.
+	cmd, _ := lookupCommand("watch")
+	cmd.main(cmd, args)
+}
+
+// helpMain implements the help command.
+func helpMain(args []string) {
+	var w = os.Stdout
+	var name = filepath.Base(os.Args[0])
+
+	if len(args) == 0 {
+		fmt.Fprintf(w, "Usage: %s <command> [flags] [args]\n\nCommands:\n", name)
+		for _, cmd := range commands {
+			fmt.Fprintf(w, "  %-8s  %s\n", cmd.name, cmd.short)
+		}
+		fmt.Fprintf(w, "\nRun \"%s help <command>\" for the flags of a command, and \"%s help settings\"\n", name, name)
+		fmt.Fprintln(w, "for the flags that every command reading the settings takes.")
+		fmt.Fprintln(w, "\nExit codes: 0 on success, 1 on errors, 2 on invalid usage or settings, and 3")
+		fmt.Fprintln(w, "if the command found bad outputs or failed jobs.")
+		return
+	}
+
+	if args[0] == "settings" {
+		fs := flag.NewFlagSet("settings", flag.ContinueOnError)
+		settingFlags(fs, &overrides{})
+		fmt.Fprintln(w, "Every setting can be given as a flag, which overrides the config file and the")
+		fmt.Fprintln(w, "environment like -set does:")
+		printFlags(w, fs, true)
+		return
+	}
+
+	cmd, ok := lookupCommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q.\n", args[0])
+		os.Exit(exitUsage)
+	}
+
+	cmd.main(cmd, []string{"-h"})
+}
+
+// flags returns the flag set of the command, which prints the command's usage.
+func (cmd command) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		var w = fs.Output()
+		fmt.Fprintf(w, "Usage: %s %s [flags] %s\n\n", filepath.Base(os.Args[0]), cmd.name, cmd.args)
+		fmt.Fprintf(w, "%s%s.\n", strings.ToUpper(cmd.short[:1]), cmd.short[1:])
+
+		var hasSettings bool
+		fs.VisitAll(func(f *flag.Flag) { hasSettings = hasSettings || isSettingFlag(f.Name) })
+
+		fmt.Fprintln(w, "\nFlags:")
+		printFlags(w, fs, false)
+
+		if hasSettings {
+			fmt.Fprintf(w, "\nEvery setting can be given as a flag as well, such as -bitrate 128k; run\n")
+			fmt.Fprintf(w, "\"%s help settings\" to list them.\n", filepath.Base(os.Args[0]))
+		}
+	}
+	return fs
+}
+
+// printFlags prints either the setting flags or the other flags of fs, like
+// PrintDefaults does.
+func printFlags(w io.Writer, fs *flag.FlagSet, settings bool) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if isSettingFlag(f.Name) != settings {
+			return
+		}
+
+		name, usage := flag.UnquoteUsage(f)
+		fmt.Fprintf(w, "  -%s", f.Name)
+		if name != "" {
+			fmt.Fprintf(w, " %s", name)
+		}
+		fmt.Fprintf(w, "\n    \t%s", strings.ReplaceAll(usage, "\n", "\n    \t"))
+
+		switch f.DefValue {
+		case "", "false", "0":
+		default:
+			fmt.Fprintf(w, " (default %s)", f.DefValue)
+		}
+		fmt.Fprintln(w)
+	})
+}
+
+// settingFlag is the flag of a setting, which adds to the -set overrides, so
+// that the flags are applied in order.
+type settingFlag struct {
+	key  string
+	sets *overrides
+}
+
+func (f settingFlag) String() string     { return "" }
+func (f settingFlag) Set(v string) error { return f.sets.Set(f.key + "=" + v) }
+
+// settingFlagName returns the flag of a config key, for example
+// "influx-address" for "influx.address".
+func settingFlagName(key string) string {
+	return strings.NewReplacer("_", "-", ".", "-").Replace(key)
+}
+
+var settingFlagNames = func() map[string]bool {
+	var names = map[string]bool{}
+	for name := range configFields(&config{}) {
+		names[settingFlagName(configKey(name))] = true
+	}
+	return names
+}()
+
+func isSettingFlag(name string) bool {
+	return settingFlagNames[name]
+}
+
+// settingFlags adds a flag for every setting into fs.
+func settingFlags(fs *flag.FlagSet, sets *overrides) {
+	var names []string
+	for name := range configFields(&config{}) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key := configKey(name)
+		fs.Var(settingFlag{key, sets}, settingFlagName(key), "sets "+name)
+	}
+}
+
+// configFlags adds the -config and -set flags and the flag of every setting.
+func configFlags(fs *flag.FlagSet) (path *string, sets *overrides) {
+	sets = &overrides{}
+	path = fs.String("config", os.Getenv("FFSYNC_CONFIG"), "read the settings from this TOML file")
+	fs.Var(sets, "set", "override a setting of the config as key=value; can be repeated")
+	settingFlags(fs, sets)
+	return path, sets
+}
+
+// commandSettings loads the settings after the flags are parsed. The paths are
+// taken from the arguments if they're given, which are src and dst if withSrc
+// is true, or only dst. The program exits with the usage if they're wrong.
+func commandSettings(fs *flag.FlagSet, path string, sets []string, withSrc bool) settings {
+	var set = loadSettings(path, sets)
+
+	var want = 1
+	if withSrc {
+		want = 2
+	}
+
+	switch fs.NArg() {
+	case 0:
+	case want:
+		set.Dst = fs.Arg(want - 1)
+		if withSrc {
+			set.Src = fs.Arg(0)
+		}
+	default:
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if set.Dst == "" || (withSrc && set.Src == "") {
+		fmt.Fprintln(os.Stderr, "No source or destination given as arguments or in the config.")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	return set
+}
+
+// requireFFmpeg exits if ffmpeg can't be found.
+func requireFFmpeg() {
+	if err := ffmpeg.Check(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitError)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Netflix/go-env"
+	"github.com/diamondburned/ffsync/internal/api"
+	"github.com/diamondburned/ffsync/internal/telemetry/influx"
+	"github.com/diamondburned/ffsync/internal/telemetry/prometheus"
+	"github.com/diamondburned/ffsync/internal/telemetry/trace"
+	"github.com/pkg/errors"
+)
+
+// config is every setting as it's written in the environment. Each one can
+// also be set in the config file, where FFSYNC_COPY_FORMATS is "copy_formats"
+// and FFSYNC_INFLUX_ADDRESS is "address" in the [influx] table, or by a -set
+// flag using the same key. The config file may also name encoder profiles in
+// [profile.<name>] tables, which use_profile picks from. There is only one
+// source and destination; each destination needs its own process.
+type config struct {
+	Influx     influx.Config
+	Prometheus prometheus.Config
+	Trace      trace.Config
+	API        api.Config
+
+	Source        string `env:"FFSYNC_SOURCE"`
+	Destination   string `env:"FFSYNC_DESTINATION"`
+	Formats       string `env:"FFSYNC_FORMATS"`
+	CopyFormats   string `env:"FFSYNC_COPY_FORMATS"`
+	CopyWorkers   string `env:"FFSYNC_COPY_WORKERS"`
+	FFmpegWorkers string `env:"FFSYNC_FFMPEG_WORKERS"`
+	Frequency     string `env:"FFSYNC_FREQUENCY"`
+	StatusFreq    string `env:"FFSYNC_STATUS_FREQUENCY"`
+	StallTime     string `env:"FFSYNC_STALL_TIMEOUT"`
+	MinSpeed      string `env:"FFSYNC_MIN_SPEED"`
+	Verify        string `env:"FFSYNC_VERIFY"`
+	VerifyTol     string `env:"FFSYNC_VERIFY_TOLERANCE"`
+	Durable       string `env:"FFSYNC_DURABLE"`
+	CopyMode      string `env:"FFSYNC_COPY_STRATEGY"`
+	Symlinks      string `env:"FFSYNC_SYMLINKS"`
+	Preserve      string `env:"FFSYNC_PRESERVE"`
+	Xattrs        string `env:"FFSYNC_PRESERVE_XATTRS"`
+	TrashKeep     string `env:"FFSYNC_TRASH_RETENTION"`
+	StableWait    string `env:"FFSYNC_STABLE_WAIT"`
+	LogLevel      string `env:"FFSYNC_LOG_LEVEL"`  // "info,sync=debug"
+	LogFormat     string `env:"FFSYNC_LOG_FORMAT"` // "text" or "json"
+	Bitrate       string `env:"FFSYNC_BITRATE"`
+	VBRMode       string `env:"FFSYNC_VBR"`
+	CoverSize     string `env:"FFSYNC_COVER_SIZE"`
+	CoverQ        string `env:"FFSYNC_COVER_Q"`
+	Reencode      string `env:"FFSYNC_REENCODE"` // "never" or "all"
+	UseProfile    string `env:"FFSYNC_USE_PROFILE"`
+}
+
+// profileKeys are the settings that a [profile.<name>] table may set.
+var profileKeys = map[string]bool{
+	"FFSYNC_BITRATE":    true,
+	"FFSYNC_VBR":        true,
+	"FFSYNC_COVER_SIZE": true,
+	"FFSYNC_COVER_Q":    true,
+}
+
+// configTables are the tables of the config file. Every other key is at the
+// top level.
+var configTables = []string{"influx", "prometheus", "otlp", "api"}
+
+// envName returns the environment variable of a config key.
+func envName(key string) string {
+	return "FFSYNC_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// configKey returns the config key of an environment variable.
+func configKey(name string) string {
+	key := strings.ToLower(strings.TrimPrefix(name, "FFSYNC_"))
+	for _, table := range configTables {
+		if strings.HasPrefix(key, table+"_") {
+			return table + "." + key[len(table)+1:]
+		}
+	}
+	return key
+}
+
+// configFields returns the type of every field of v, which is a pointer to a
+// struct, keyed by environment variable.
+func configFields(v interface{}) map[string]reflect.Type {
+	var fields = map[string]reflect.Type{}
+
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			if name := f.Tag.Get("env"); name != "" {
+				fields[name] = f.Type
+			}
+		}
+	}
+	walk(reflect.TypeOf(v).Elem())
+
+	return fields
+}
+
+// configLayers merges the settings from the config file, the environment and
+// the flags, in increasing order of precedence, and remembers where each one
+// came from.
+type configLayers struct {
+	fields   map[string]reflect.Type
+	values   env.EnvSet                   // keyed by environment variable
+	sources  map[string]string            // keyed by environment variable
+	profiles map[string]map[string]string // profile settings keyed by name
+	file     string                       // the source of settings in the file
+}
+
+func newConfigLayers() *configLayers {
+	return &configLayers{
+		fields:   configFields(&config{}),
+		values:   env.EnvSet{},
+		sources:  map[string]string{},
+		profiles: map[string]map[string]string{},
+	}
+}
+
+// describe describes a setting for error messages, for example
+// "copy_workers (set by -set)".
+func (l *configLayers) describe(name string) string {
+	source, ok := l.sources[name]
+	if !ok {
+		return configKey(name)
+	}
+	return fmt.Sprintf("%s (set %s)", configKey(name), source)
+}
+
+func (l *configLayers) set(name, value, source string) error {
+	t, ok := l.fields[name]
+	if !ok {
+		return errors.New("unknown key")
+	}
+	if t.Kind() == reflect.Int {
+		if _, err := strconv.Atoi(value); err != nil {
+			return errors.Errorf("%q is not an integer", value)
+		}
+	}
+
+	l.values[name] = value
+	l.sources[name] = source
+	return nil
+}
+
+// readFile adds the settings in the TOML file at path.
+func (l *configLayers) readFile(path string) []error {
+	var tree map[string]interface{}
+	if _, err := toml.DecodeFile(path, &tree); err != nil {
+		return []error{errors.Wrapf(err, "failed to read %s", path)}
+	}
+
+	var errs []error
+	var source = "in " + path
+
+	l.file = source
+
+	var walk func(prefix string, tree map[string]interface{})
+	walk = func(prefix string, tree map[string]interface{}) {
+		for k, v := range tree {
+			key := prefix + k
+
+			if v, ok := v.(map[string]interface{}); ok {
+				if key == "profile" {
+					errs = append(errs, l.readProfiles(path, v)...)
+				} else {
+					walk(key+".", v)
+				}
+				continue
+			}
+			// Such as [[destination]], since each process only syncs to one.
+			if _, ok := v.([]map[string]interface{}); ok {
+				errs = append(errs, errors.Errorf("%s: %s: expected a single value, not tables", path, key))
+				continue
+			}
+
+			value := tomlValue(v)
+
+			name := envName(key)
+			if configKey(name) != key {
+				errs = append(errs, errors.Errorf("%s: %s: unknown key", path, key))
+				continue
+			}
+			if err := l.set(name, value, source); err != nil {
+				errs = append(errs, errors.Wrapf(err, "%s: %s", path, key))
+			}
+		}
+	}
+	walk("", tree)
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errs
+}
+
+// readProfiles adds the [profile.<name>] tables of the file at path.
+func (l *configLayers) readProfiles(path string, tables map[string]interface{}) []error {
+	var errs []error
+
+	for name, table := range tables {
+		table, ok := table.(map[string]interface{})
+		if !ok {
+			errs = append(errs, errors.Errorf("%s: profile.%s: expected a table", path, name))
+			continue
+		}
+
+		var profile = map[string]string{}
+		for key, v := range table {
+			if !profileKeys[envName(key)] {
+				errs = append(errs, errors.Errorf("%s: profile.%s.%s: unknown key", path, name, key))
+				continue
+			}
+			profile[envName(key)] = tomlValue(v)
+		}
+
+		l.profiles[name] = profile
+	}
+
+	return errs
+}
+
+// applyProfile sets the settings of the profile picked by use_profile. They
+// override the other settings in the file, but not the environment or flags.
+func (l *configLayers) applyProfile() []error {
+	const key = "FFSYNC_USE_PROFILE"
+
+	name := l.values[key]
+	if name == "" {
+		return nil
+	}
+
+	profile, ok := l.profiles[name]
+	if !ok {
+		return []error{errors.Errorf("invalid %s: unknown profile %q", l.describe(key), name)}
+	}
+
+	for setting, value := range profile {
+		if source, ok := l.sources[setting]; ok && source != l.file {
+			continue
+		}
+		l.values[setting] = value
+		l.sources[setting] = fmt.Sprintf("%s [profile.%s]", l.file, name)
+	}
+
+	return nil
+}
+
+// tomlValue returns a value of the config file as it would be written in the
+// environment, where arrays are separated by commas.
+func tomlValue(v interface{}) string {
+	items, ok := v.([]interface{})
+	if !ok {
+		return fmt.Sprint(v)
+	}
+
+	strs := make([]string, len(items))
+	for i, item := range items {
+		strs[i] = fmt.Sprint(item)
+	}
+	return strings.Join(strs, ",")
+}
+
+// readEnv adds the settings in the environment. Unknown variables are ignored.
+func (l *configLayers) readEnv(environ []string) []error {
+	var errs []error
+
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "FFSYNC_") {
+			continue
+		}
+		if _, ok := l.fields[parts[0]]; !ok {
+			continue
+		}
+		if err := l.set(parts[0], parts[1], "by "+parts[0]); err != nil {
+			errs = append(errs, errors.Wrap(err, parts[0]))
+		}
+	}
+
+	return errs
+}
+
+// readOverrides adds the key=value settings given by the -set flags.
+func (l *configLayers) readOverrides(overrides []string) []error {
+	var errs []error
+
+	for _, kv := range overrides {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			errs = append(errs, errors.Errorf("-set %s: expected key=value", kv))
+			continue
+		}
+		if err := l.set(envName(parts[0]), parts[1], "by -set"); err != nil {
+			errs = append(errs, errors.Wrapf(err, "-set %s", parts[0]))
+		}
+	}
+
+	return errs
+}
+
+// readConfig reads the config from the file at path if it's not empty, the
+// environment and the -set flag overrides.
+func readConfig(path string, overrides []string) (config, *configLayers, []error) {
+	var l = newConfigLayers()
+	var errs []error
+
+	if path != "" {
+		errs = append(errs, l.readFile(path)...)
+	}
+	errs = append(errs, l.readEnv(os.Environ())...)
+	errs = append(errs, l.readOverrides(overrides)...)
+	errs = append(errs, l.applyProfile()...)
+
+	// Unmarshal removes the values it used from the set.
+	var values = make(env.EnvSet, len(l.values))
+	for k, v := range l.values {
+		values[k] = v
+	}
+
+	var cfg config
+	if err := env.Unmarshal(values, &cfg); err != nil {
+		errs = append(errs, errors.Wrap(err, "failed to load config"))
+	}
+
+	return cfg, l, errs
+}
+
+// overrides is a repeatable flag of key=value settings.
+type overrides []string
+
+func (o *overrides) String() string      { return strings.Join(*o, " ") }
+func (o *overrides) Set(kv string) error { *o = append(*o, kv); return nil }
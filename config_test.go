@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+source = "/music"
+destination = "/music.opus"
+formats = [".flac", ".mp3"]
+copy_workers = 4
+frequency = "30s"
+durable = true
+bitrate = "128k"
+cover_q = 2
+
+[influx]
+address = "http://localhost:8086"
+buffer = 10
+`
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "ffsync-config-")
+	if err != nil {
+		t.Fatal("Failed to create tmpdir:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "ffsync.toml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal("Failed to write config:", err)
+	}
+	return path
+}
+
+func setenv(t *testing.T, name, value string) {
+	os.Setenv(name, value)
+	t.Cleanup(func() { os.Unsetenv(name) })
+}
+
+func TestSettings(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	setenv(t, "FFSYNC_FREQUENCY", "10s")
+
+	set, errs := parseSettings(path, []string{"copy_workers=8", "influx.database=music"})
+	if len(errs) > 0 {
+		t.Fatal("Unexpected errors:", errs)
+	}
+
+	if set.Src != "/music" || set.Dst != "/music.opus" {
+		t.Errorf("Unexpected src and dst: %q, %q", set.Src, set.Dst)
+	}
+	if strings.Join(set.Sync.FileFormats, ",") != ".flac,.mp3" {
+		t.Errorf("Unexpected formats: %q", set.Sync.FileFormats)
+	}
+	if set.Frequency != 10*time.Second {
+		t.Errorf("Expected the environment to override the file, got %v", set.Frequency)
+	}
+	if set.CopyWorkers != 8 {
+		t.Errorf("Expected -set to override the file, got %d", set.CopyWorkers)
+	}
+	if set.Profile.Opus.Bitrate != "128k" || set.Profile.Cover.Quality != "2" || set.Profile.Cover.Size != "" {
+		t.Errorf("Unexpected profile: %+v", set.Profile)
+	}
+	if !set.Copier.Durable {
+		t.Error("Expected durable copies")
+	}
+	if set.Influx.Address != "http://localhost:8086" || set.Influx.BufferSize != 10 || set.Influx.Database != "music" {
+		t.Errorf("Unexpected InfluxDB config: %+v", set.Influx)
+	}
+}
+
+func TestSettingsErrors(t *testing.T) {
+	path := writeConfig(t, `
+frequncy = "1m"
+copy_workers = 0
+preserve = ["atime", "ctime"]
+cover_q = 40
+reencode = "sometimes"
+
+[influx]
+buffer = "lots"
+
+[bogus]
+key = 1
+
+[profile.small]
+bitrate = "48k"
+workers = 2
+
+[[destination]]
+path = "/mnt/a"
+`)
+	setenv(t, "FFSYNC_STALL_TIMEOUT", "forever")
+
+	_, errs := parseSettings(path, []string{"symlinks=sometimes", "nokey"})
+
+	var expected = []string{
+		path + `: bogus.key: unknown key`,
+		path + `: destination: expected a single value, not tables`,
+		path + `: profile.small.workers: unknown key`,
+		path + `: frequncy: unknown key`,
+		path + `: influx.buffer: "lots" is not an integer`,
+		`-set nokey: expected key=value`,
+		`invalid copy_workers (set in ` + path + `): must be at least 1`,
+		`invalid stall_timeout (set by FFSYNC_STALL_TIMEOUT): `,
+		`invalid symlinks (set by -set): `,
+		`invalid preserve (set in ` + path + `): unknown attribute "ctime"`,
+		`invalid cover_q (set in ` + path + `): 40 is not within 2 and 31`,
+		`invalid reencode (set in ` + path + `): unknown policy "sometimes"`,
+	}
+
+	var got = make([]string, len(errs))
+	for i, err := range errs {
+		got[i] = err.Error()
+	}
+
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d errors, got:\n%s", len(expected), strings.Join(got, "\n"))
+	}
+
+	for _, e := range expected {
+		var found bool
+		for _, g := range got {
+			if strings.HasPrefix(g, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Missing error %q in:\n%s", e, strings.Join(got, "\n"))
+		}
+	}
+}
+
+func TestSettingsProfiles(t *testing.T) {
+	path := writeConfig(t, `
+bitrate = "128k"
+cover_q = 2
+use_profile = "portable"
+
+[profile.portable]
+bitrate = "64k"
+cover_size = 300
+
+[profile.archive]
+bitrate = "256k"
+`)
+
+	set, errs := parseSettings(path, nil)
+	if len(errs) > 0 {
+		t.Fatal("Unexpected errors:", errs)
+	}
+	if p := set.Profile; p.Opus.Bitrate != "64k" || p.Cover.Size != "300" || p.Cover.Quality != "2" {
+		t.Errorf("Unexpected portable profile: %+v", p)
+	}
+
+	// The environment overrides the profile, which is picked by a flag.
+	setenv(t, "FFSYNC_BITRATE", "96k")
+
+	set, errs = parseSettings(path, []string{"use_profile=archive"})
+	if len(errs) > 0 {
+		t.Fatal("Unexpected errors:", errs)
+	}
+	if p := set.Profile; p.Opus.Bitrate != "96k" || p.Cover.Size != "" {
+		t.Errorf("Unexpected archive profile: %+v", p)
+	}
+
+	_, errs = parseSettings(path, []string{"use_profile=phone"})
+	if len(errs) != 1 || errs[0].Error() != `invalid use_profile (set by -set): unknown profile "phone"` {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+}
+
+func TestSettingFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	_, sets := configFlags(fs)
+
+	err := fs.Parse([]string{"-set", "copy_workers=2", "-copy-workers", "3", "-influx-address", "http://influx"})
+	if err != nil {
+		t.Fatal("Failed to parse the flags:", err)
+	}
+
+	set, errs := parseSettings("", *sets)
+	if len(errs) > 0 {
+		t.Fatal("Unexpected errors:", errs)
+	}
+
+	if set.CopyWorkers != 3 {
+		t.Errorf("Expected the last flag to win, got %d", set.CopyWorkers)
+	}
+	if set.Influx.Address != "http://influx" {
+		t.Errorf("Unexpected InfluxDB address %q", set.Influx.Address)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/diamondburned/ffsync/internal/api"
+	"github.com/diamondburned/ffsync/internal/history"
+	"github.com/diamondburned/ffsync/sync"
+	"github.com/pkg/errors"
+)
+
+// failureWindow is how far back the API looks for failed jobs.
+const failureWindow = 7 * 24 * time.Hour
+
+// controller controls the running watch through the API.
+type controller struct {
+	a   *Application
+	src string // absolute
+}
+
+var _ api.Controller = (*controller)(nil)
+
+func (c *controller) Status() (api.Status, error) {
+	records, err := c.a.History.Query(history.Filter{Since: time.Now().Add(-24 * time.Hour)})
+	if err != nil {
+		return api.Status{}, errors.Wrap(err, "Failed to query the history")
+	}
+
+	var pools = map[string]api.Pool{}
+	for name, p := range map[string]*pool{"copy": c.a.CopyPool, "ffmpeg": c.a.FFmpegPool} {
+		pools[name] = api.Pool{Size: p.Size(), Running: p.Running(), Waiting: p.Waiting()}
+	}
+
+	var st = api.Status{
+		Source:      c.src,
+		Destination: c.a.Dest,
+		Profile:     c.a.profile().String(),
+		Paused:      c.a.FFmpegPool.Paused(),
+		Outputs:     c.a.Outputs.Len(),
+		Retrying:    int(atomic.LoadInt64(&c.a.retrying)),
+		DeadLetters: len(c.a.DeadLetters.Entries()),
+		Pools:       pools,
+		Recent:      history.Summarize(records),
+	}
+	for _, p := range pools {
+		st.Queued += p.Waiting
+		st.Running += p.Running
+	}
+
+	return st, nil
+}
+
+func (c *controller) Jobs() []api.Job {
+	var snapshot = c.a.Jobs.Snapshot()
+	var jobs = make([]api.Job, len(snapshot))
+
+	for i, job := range snapshot {
+		jobs[i] = api.Job{
+			ID:         job.ID,
+			Action:     job.Action,
+			Src:        job.Src,
+			Dst:        job.Dst,
+			Running:    job.Running(),
+			Queued:     job.Queued,
+			Started:    job.Started,
+			Percentage: job.Progress.Percentage,
+			Speed:      job.Progress.Speed,
+			WroteBytes: job.Progress.TotalSize,
+		}
+	}
+
+	return jobs
+}
+
+func (c *controller) Failures(limit int) (api.Failures, error) {
+	records, err := c.a.History.Query(history.Filter{
+		Since:  time.Now().Add(-failureWindow),
+		Failed: true,
+	})
+	if err != nil {
+		return api.Failures{}, errors.Wrap(err, "Failed to query the history")
+	}
+
+	var recent = make([]history.Record, 0, limit)
+	for i := len(records) - 1; i >= 0 && len(recent) < limit; i-- {
+		recent = append(recent, records[i])
+	}
+
+	return api.Failures{
+		DeadLetters: c.a.DeadLetters.Entries(),
+		Recent:      recent,
+	}, nil
+}
+
+func (c *controller) Rescan() error {
+	return c.resync(c.src)
+}
+
+func (c *controller) Pause() {
+	c.a.CopyPool.pause(true)
+	c.a.FFmpegPool.pause(true)
+	c.a.Log.Component("api").Info("Paused")
+}
+
+func (c *controller) Resume() {
+	c.a.CopyPool.pause(false)
+	c.a.FFmpegPool.pause(false)
+	c.a.Log.Component("api").Info("Resumed")
+}
+
+// Requeue takes the files under the path off the dead-letter list, then
+// synchronizes the ones whose output doesn't exist.
+func (c *controller) Requeue(path string) error {
+	path, err := c.sourcePath(path)
+	if err != nil {
+		return err
+	}
+
+	var srcs []string
+	for _, e := range c.a.DeadLetters.Entries() {
+		if under(e.Src, path) {
+			srcs = append(srcs, e.Src)
+		}
+	}
+
+	if len(srcs) > 0 {
+		if _, err := c.a.DeadLetters.Remove(srcs...); err != nil {
+			return errors.Wrap(err, "Failed to remove from the dead-letter list")
+		}
+	}
+
+	return c.resync(path)
+}
+
+func (c *controller) Cancel(id uint64) error {
+	if !c.a.Jobs.Cancel(id) {
+		return api.ErrNotFound
+	}
+	return nil
+}
+
+// Reencode converts the files under the path again with the current profile
+// in the background.
+func (c *controller) Reencode(path string) error {
+	path, err := c.sourcePath(path)
+	if err != nil {
+		return err
+	}
+
+	s := c.a.Syncer
+	if s == nil {
+		return errors.New("not watching")
+	}
+
+	c.a.Log.Component("api").Info("Re-encoding", "src", path, "profile", c.a.profile().String())
+
+	go c.a.reencode(context.Background(), func(fn func(sync.Mapping) error) error {
+		return s.WalkFrom(path, fn)
+	})
+
+	return nil
+}
+
+func (c *controller) Reload() error {
+	return c.a.Reload()
+}
+
+// resync synchronizes the files under the source path in the background.
+func (c *controller) resync(path string) error {
+	s := c.a.Syncer
+	if s == nil {
+		return errors.New("not watching")
+	}
+
+	var log = c.a.Log.Component("api")
+	log.Info("Rescanning", "src", path)
+
+	go func() {
+		if err := s.Resync(path); err != nil {
+			log.Error("Failed to rescan", "src", path, "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// sourcePath cleans the path, which must exist inside the source tree.
+func (c *controller) sourcePath(path string) (string, error) {
+	path = filepath.Clean(path)
+
+	if !filepath.IsAbs(path) || !under(path, c.src) {
+		return "", api.BadRequest{Err: errors.Errorf("%q is not in the source %q", path, c.src)}
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return "", api.BadRequest{Err: err}
+	}
+
+	return path, nil
+}
+
+// under returns true if path is dir or inside it.
+func under(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
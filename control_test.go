@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diamondburned/ffsync/internal/api"
+)
+
+func TestSourcePath(t *testing.T) {
+	src, err := ioutil.TempDir("", "ffsync-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	if err := os.Mkdir(filepath.Join(src, "album"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	var c = &controller{src: src}
+
+	var tests = []struct {
+		path string
+		ok   bool
+	}{
+		{src, true},
+		{src + "/album/", true},
+		{src + "/album/../album", true},
+		{src + "/missing", false},
+		{src + "/../", false},
+		{src + "-other", false},
+		{"album", false},
+	}
+
+	for _, test := range tests {
+		_, err := c.sourcePath(test.path)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%q: expected ok %v, got error %v", test.path, test.ok, err)
+		}
+		if _, bad := err.(api.BadRequest); err != nil && !bad {
+			t.Errorf("%q: expected a bad request, got %T", test.path, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/diamondburned/ffsync/ffmpeg"
+	"github.com/diamondburned/ffsync/internal/history"
+	"github.com/diamondburned/ffsync/internal/osutil"
+	"github.com/diamondburned/ffsync/internal/retry"
+	"github.com/diamondburned/ffsync/internal/telemetry"
+)
+
+const (
+	copyJob    = "copy"
+	convertJob = "convert"
+)
+
+// queue queues the job of the given action.
+func (a *Application) queue(action, src, dst string) {
+	switch action {
+	case copyJob:
+		a.QueueCopy(context.Background(), src, dst)
+	case convertJob:
+		a.QueueConvert(context.Background(), src, dst)
+	default:
+		a.Log.Component("retry").Error("Unknown action", "action", action, "src", src)
+	}
+}
+
+// fail either schedules the failed job to be retried later or puts it into the
+// dead-letter list, unless the command is a one-shot one.
+func (a *Application) fail(action, src, dst string, err error) {
+	var ev = telemetry.NewEvent(telemetry.JobFailed, action, src, dst)
+	ev.Reason = failReason(err)
+	ev.Error = err.Error()
+	a.Telemeter.WriteEvent(ev)
+
+	atomic.AddInt64(&a.failures, 1)
+
+	// Only keep the relevant lines of ffmpeg's stderr.
+	var msg = err.Error()
+	var ffErr *ffmpeg.Error
+	if errors.As(err, &ffErr) {
+		msg = strings.Join(ffErr.Lines(), "\n")
+	}
+
+	a.record(history.Record{Action: action, Src: src, Dst: dst, Kind: ev.Reason, Error: msg})
+
+	var tags = telemetry.Tags{"action": action}
+	var log = a.Log.Component("retry").With("action", action, "src", src, "dst", dst, "kind", ev.Reason, "error", err)
+
+	delay, attempts, ok := a.Retrier.Failed(dst, err)
+	if ok {
+		log.Info("Retrying", "delay", delay, "attempt", attempts)
+		a.Telemeter.AddCount("retries", 1, tags)
+
+		atomic.AddInt64(&a.retrying, 1)
+		time.AfterFunc(delay, func() {
+			atomic.AddInt64(&a.retrying, -1)
+			a.queue(action, src, dst)
+		})
+		return
+	}
+
+	if a.oneShot {
+		log.Error("Failed", "attempts", attempts)
+		return
+	}
+
+	log.Error("Giving up", "attempts", attempts)
+	a.Telemeter.AddCount("dead_lettered", 1, tags)
+
+	var entry = retry.Entry{
+		Src:      src,
+		Dst:      dst,
+		Action:   action,
+		Kind:     ev.Reason,
+		Error:    msg,
+		Attempts: attempts,
+		Time:     time.Now(),
+	}
+
+	if err := a.DeadLetters.Add(entry); err != nil {
+		log.Error("Failed to add to the dead-letter list", "error", err)
+	}
+}
+
+// failReason returns a short reason for the error to group failures by.
+func failReason(err error) string {
+	var ffErr *ffmpeg.Error
+	switch {
+	case errors.As(err, &ffErr):
+		return ffErr.Kind().String()
+	case errors.Is(err, ffmpeg.ErrVerify):
+		return "verification failed"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timed out"
+	case errors.Is(err, os.ErrPermission):
+		return "permission denied"
+	default:
+		return "other"
+	}
+}
+
+// deadLettered returns true if the source is in the dead-letter list and hasn't
+// been modified since it was put there.
+func (a *Application) deadLettered(src string) bool {
+	e, ok := a.DeadLetters.Get(src)
+	if !ok {
+		return false
+	}
+
+	if s, err := os.Stat(src); err == nil && s.ModTime().After(e.Time) {
+		// The file was changed, so it might be fixed now.
+		if _, err := a.DeadLetters.Remove(src); err != nil {
+			a.Log.Component("retry").Error("Failed to remove from the dead-letter list", "src", src, "error", err)
+		}
+		return false
+	}
+
+	return true
+}
+
+// watchDeadLetters periodically reloads the dead-letter list and requeues the
+// entries that were removed from it externally.
+func (a *Application) watchDeadLetters(freq time.Duration) {
+	var ticker = time.NewTicker(freq)
+	defer ticker.Stop()
+
+	var log = a.Log.Component("retry")
+
+	for range ticker.C {
+		removed, err := a.DeadLetters.Reload()
+		if err != nil {
+			log.Error("Failed to reload the dead-letter list", "error", err)
+			continue
+		}
+
+		for _, e := range removed {
+			log.Info("Requeueing", "action", e.Action, "src", e.Src, "dst", e.Dst)
+			a.queue(e.Action, e.Src, e.Dst)
+		}
+	}
+}
+
+// retryMain implements the retry command. The running watch command requeues
+// the files once it notices they're off the list.
+func retryMain(cmd command, args []string) {
+	fs := cmd.flags()
+	all := fs.Bool("all", false, "retry every file on the dead-letter list")
+	configPath, sets := configFlags(fs)
+	fs.Parse(args)
+
+	set := loadSettings(*configPath, *sets)
+
+	var srcs []string
+	if fs.NArg() > 0 {
+		set.Dst, srcs = fs.Arg(0), fs.Args()[1:]
+	}
+
+	if set.Dst == "" || (len(srcs) > 0) == *all {
+		fmt.Fprintln(os.Stderr, "Either give the destination and the sources to retry, or -all.")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	d, err := retry.OpenDeadLetters(retry.DeadLettersPath(osutil.StateDir(set.Dst)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to open the dead-letter list:", err)
+		os.Exit(exitError)
+	}
+
+	removed, err := d.Remove(srcs...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to remove from the dead-letter list:", err)
+		os.Exit(exitError)
+	}
+
+	var retried = map[string]bool{}
+	for _, e := range removed {
+		retried[e.Src] = true
+		fmt.Println("Retrying", e.Src)
+	}
+
+	var code = exitOK
+	for _, src := range srcs {
+		if !retried[src] {
+			fmt.Fprintln(os.Stderr, "Not on the dead-letter list:", src)
+			code = exitError
+		}
+	}
+
+	os.Exit(code)
+}
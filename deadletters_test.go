@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diamondburned/ffsync/internal/history"
+	"github.com/diamondburned/ffsync/internal/logger"
+	"github.com/diamondburned/ffsync/internal/retry"
+	"github.com/diamondburned/ffsync/internal/telemetry/fallback"
+)
+
+func TestFailOneShot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffsync-deadletters-")
+	if err != nil {
+		t.Fatal("Failed to create tmpdir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	deadLetters, err := retry.OpenDeadLetters(filepath.Join(dir, "dead-letters.json"))
+	if err != nil {
+		t.Fatal("Failed to open the dead-letter list:", err)
+	}
+
+	l := logger.New(ioutil.Discard, logger.Config{})
+	a := &Application{
+		Log:         l,
+		Telemeter:   fallback.New(l),
+		History:     history.Open(filepath.Join(dir, "history.db")),
+		Retrier:     retry.NewRetrier(retry.Policy{MaxAttempts: 1}),
+		DeadLetters: deadLetters,
+	}
+
+	a.oneShot = true
+	a.fail(copyJob, "/src/a.jpg", "/dst/a.jpg", errors.New("no space left on device"))
+
+	if _, ok := a.DeadLetters.Get("/src/a.jpg"); ok {
+		t.Fatal("One-shot failure was dead-lettered")
+	}
+	if a.failures != 1 {
+		t.Fatalf("Expected 1 failure, got %d", a.failures)
+	}
+
+	a.oneShot = false
+	a.fail(copyJob, "/src/a.jpg", "/dst/a.jpg", errors.New("no space left on device"))
+
+	e, ok := a.DeadLetters.Get("/src/a.jpg")
+	if !ok {
+		t.Fatal("Failure was not dead-lettered")
+	}
+	if e.Kind != "other" {
+		t.Fatalf("Expected kind other, got %q", e.Kind)
+	}
+}
@@ -28,6 +28,12 @@ in {
 			description = "Environment variables for ffsync";
 		};
 
+		configFile = mkOption {
+			type = types.nullOr types.path;
+			default = null;
+			description = "TOML config file for ffsync, which vars override";
+		};
+
 		influx = mkOption {
 			type = types.submodule {
 				options = {
@@ -83,13 +89,17 @@ in {
 				FFSYNC_INFLUX_DATABASE = cfg.influx.database;
 				FFSYNC_INFLUX_USERNAME = cfg.influx.username;
 				FFSYNC_INFLUX_PASSWORD = cfg.influx.password;
+			} // optionalAttrs (cfg.configFile != null) {
+				FFSYNC_CONFIG = "${cfg.configFile}";
 			} // cfg.vars;
 			path = with pkgs; [ ffmpeg ];
 			serviceConfig = {
-				ExecStart = ''${cfg.package}/bin/ffsync \
+				ExecStart = ''${cfg.package}/bin/ffsync watch \
 					${lib.escapeShellArg cfg.src} \
 					${lib.escapeShellArg cfg.dst}
 				'';
+				ExecReload = "${pkgs.coreutils}/bin/kill -HUP $MAINPID";
+				RuntimeDirectory = "ffsync"; # for FFSYNC_API_ADDRESS=/run/ffsync/api.sock
 				UMask = "022"; # rwxr-xr-x
 				Type  = "simple";
 				User  = "ffsync";
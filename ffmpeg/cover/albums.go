@@ -0,0 +1,75 @@
+package cover
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// Albums keeps track of which album directories already have their cover
+// extracted, so that only one track per album extracts it, even when multiple
+// tracks of the same album are converted concurrently. The zero value is ready
+// to use.
+type Albums struct {
+	mutex sync.Mutex
+	dirs  map[string]albumState
+}
+
+type albumState uint8
+
+const (
+	albumClaimed albumState = iota + 1
+	albumDone
+)
+
+// Claim claims the album directory of the given music file destination for
+// cover extraction. It returns the path to cover.jpg and true if the caller
+// should extract the cover, in which case the caller must call Release once
+// it's done. False is returned if the cover already exists or if another
+// caller is already extracting it.
+func (a *Albums) Claim(dst string) (string, bool) {
+	dir := filepath.Dir(dst)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.dirs == nil {
+		a.dirs = map[string]albumState{}
+	}
+
+	path, exists := ExistsAlbum(dst)
+
+	switch a.dirs[dir] {
+	case albumClaimed:
+		return path, false
+	case albumDone:
+		// The cover might have been removed since, so only trust the state if
+		// it's still there.
+		if exists {
+			return path, false
+		}
+	}
+
+	if exists {
+		a.dirs[dir] = albumDone
+		return path, false
+	}
+
+	a.dirs[dir] = albumClaimed
+	return path, true
+}
+
+// Release releases the claim on the album directory of the given destination.
+// If extracted is true, then the cover was written. Otherwise, such as when the
+// conversion failed, the next track of the album may try again.
+func (a *Albums) Release(dst string, extracted bool) {
+	dir := filepath.Dir(dst)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if extracted {
+		a.dirs[dir] = albumDone
+	} else {
+		delete(a.dirs, dir)
+	}
+}
@@ -0,0 +1,45 @@
+package cover
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAlbums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffsync-cover-")
+	if err != nil {
+		t.Fatal("Failed to create tmpdir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var a Albums
+
+	var first = filepath.Join(dir, "1.opus")
+	var second = filepath.Join(dir, "2.opus")
+
+	path, ok := a.Claim(first)
+	if !ok {
+		t.Fatal("Expected the first track to claim the album")
+	}
+	if _, ok := a.Claim(second); ok {
+		t.Fatal("Expected the album to be claimed already")
+	}
+
+	// The first track has no album art, which says nothing about the others.
+	a.Release(first, false)
+
+	if _, ok := a.Claim(second); !ok {
+		t.Fatal("Expected the second track to try after a track without a cover")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("jpeg"), 0644); err != nil {
+		t.Fatal("Failed to write the cover:", err)
+	}
+	a.Release(second, true)
+
+	if _, ok := a.Claim(first); ok {
+		t.Fatal("Expected the extracted cover to be kept")
+	}
+}
@@ -1,9 +1,7 @@
 package cover
 
 import (
-	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -11,11 +9,28 @@ import (
 	"github.com/diamondburned/ffsync/ffmpeg"
 )
 
-var (
-	CoverArtSz = "500"
-	CoverArtQ  = "5"
+// The default album art settings.
+const (
+	DefaultSize    = "500"
+	DefaultQuality = "5"
 )
 
+// Profile is the album art settings. Empty fields are the defaults.
+type Profile struct {
+	Size    string // the maximum height in pixels
+	Quality string // the JPEG quality scale, from 2 (best) to 31 (worst)
+}
+
+func (p Profile) orDefault() Profile {
+	if p.Size == "" {
+		p.Size = DefaultSize
+	}
+	if p.Quality == "" {
+		p.Quality = DefaultQuality
+	}
+	return p
+}
+
 // ExistsAlbum returns true if the given output path contains a cover.jpg.
 func ExistsAlbum(dst string) (string, bool) {
 	// Force override the output.
@@ -32,15 +47,26 @@ func ExistsAlbum(dst string) (string, bool) {
 // ExtractAlbum takes the art from the src file and extracts its album art into
 // cover.jpg. The given dst is the destination to the music file, which this
 // function will automatically derive the path to cover.jpg.
-func ExtractAlbum(ctx context.Context, src, dst string) (*ffmpeg.Result, error) {
-	vf := fmt.Sprintf("scale=-1:'min(%s,ih)'", CoverArtSz)
-
-	return ffmpeg.ExecuteCtx(ctx, src, forceCoverFile(dst),
-		// Album art options
-		"-c:v", "mjpeg",
-		"-vsync", "2",
-		"-sws_flags", "lanczos", "-huffman", "optimal", "-q:v", CoverArtQ, "-vf", vf,
-	)
+func ExtractAlbum(ctx context.Context, p Profile, src, dst string) (*ffmpeg.Result, error) {
+	return ffmpeg.ExecuteOutputsCtx(ctx, src, Output(p, dst))
+}
+
+// Output returns the ffmpeg output that extracts the album art into cover.jpg.
+// It is meant to be passed alongside other outputs into ExecuteOutputsCtx, so
+// that the source file is only decoded once.
+func Output(p Profile, dst string) ffmpeg.Output {
+	p = p.orDefault()
+	vf := fmt.Sprintf("scale=-1:'min(%s,ih)'", p.Size)
+
+	return ffmpeg.Output{
+		Path: forceCoverFile(dst),
+		Args: []string{
+			// Album art options
+			"-an", "-c:v", "mjpeg",
+			"-vsync", "2", "-frames:v", "1",
+			"-sws_flags", "lanczos", "-huffman", "optimal", "-q:v", p.Quality, "-vf", vf,
+		},
+	}
 }
 
 func forceCoverFile(dst string) string {
@@ -50,14 +76,8 @@ func forceCoverFile(dst string) string {
 	return dst
 }
 
-var noStreamErr = []byte("does not contain any stream")
-
 // ErrIsNoStream returns true if the error is FFmpeg saying there isn't a video
 // stream. This is useful because not all songs have album arts.
 func ErrIsNoStream(err error) bool {
-	var ffErr *ffmpeg.Error
-	if errors.As(err, &ffErr) {
-		return bytes.Contains(ffErr.StderrBytes(), noStreamErr)
-	}
-	return false
+	return ffmpeg.ErrKind(err) == ffmpeg.NoStreamError
 }
@@ -6,15 +6,107 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
+	"strings"
+	"syscall"
 )
 
+// ErrorKind is the category of an ffmpeg failure.
+type ErrorKind uint8
+
+const (
+	UnknownError ErrorKind = iota
+	// NoStreamError is when an output has no stream to write, such as when
+	// extracting the album art of a file that doesn't have one.
+	NoStreamError
+	// CorruptInputError is when the input has invalid data.
+	CorruptInputError
+	// UnsupportedCodecError is when the input can't be decoded.
+	UnsupportedCodecError
+	// EncoderNotFoundError is when ffmpeg was built without the encoder.
+	EncoderNotFoundError
+	PermissionError
+	DiskFullError
+	IOError
+	// SignalError is when ffmpeg was killed by a signal.
+	SignalError
+	// StalledError is when ffmpeg was killed by the watchdog for not making
+	// progress. See ErrStalled.
+	StalledError
+	// TimedOutError is when ffmpeg was killed by the watchdog for running past
+	// its deadline. See ErrTimedOut.
+	TimedOutError
+)
+
+var errorKindNames = [...]string{
+	UnknownError:          "unknown",
+	NoStreamError:         "no stream",
+	CorruptInputError:     "corrupt input",
+	UnsupportedCodecError: "unsupported codec",
+	EncoderNotFoundError:  "encoder not found",
+	PermissionError:       "permission denied",
+	DiskFullError:         "disk full",
+	IOError:               "I/O error",
+	SignalError:           "killed by signal",
+	StalledError:          "stalled",
+	TimedOutError:         "timed out",
+}
+
+func (k ErrorKind) String() string {
+	if int(k) < len(errorKindNames) {
+		return errorKindNames[k]
+	}
+	return fmt.Sprintf("ErrorKind(%d)", k)
+}
+
+// errorPatterns maps bits of ffmpeg's stderr to the kind of error. They're
+// checked in order, so the causes come before the symptoms: a full disk might
+// also cause a muxing error, for example.
+var errorPatterns = []struct {
+	kind     ErrorKind
+	patterns []string
+}{
+	{DiskFullError, []string{"No space left on device"}},
+	{PermissionError, []string{"Permission denied", "Operation not permitted"}},
+	{IOError, []string{"Input/output error"}},
+	{EncoderNotFoundError, []string{
+		"Unknown encoder",
+		"Automatic encoder selection failed",
+	}},
+	{UnsupportedCodecError, []string{
+		"Unknown decoder",
+		"Decoder (codec",
+		"Could not find codec parameters",
+		"not currently supported in container",
+		"Unsupported codec",
+	}},
+	{NoStreamError, []string{
+		"does not contain any stream",
+		"matches no streams",
+	}},
+	{CorruptInputError, []string{
+		"Invalid data found when processing input",
+		"Error while decoding",
+		"moov atom not found",
+		"Header missing",
+		"invalid frame size",
+	}},
+}
+
+// maxContextLines is the number of the last stderr lines given as context if
+// the error is unknown.
+const maxContextLines = 3
+
 type Error struct {
 	wrapped error
 	stderr  bytes.Buffer
 }
 
 func (err *Error) Error() string {
-	return fmtError("ffmpeg failed", err.wrapped, err.stderr)
+	var prefix = "ffmpeg failed"
+	if kind := err.Kind(); kind != UnknownError {
+		prefix += " (" + kind.String() + ")"
+	}
+	return fmtError(prefix, err.wrapped, err.stderr)
 }
 
 func (err *Error) Unwrap() error {
@@ -34,10 +126,80 @@ func (err *Error) StderrBytes() []byte {
 	return err.stderr.Bytes()
 }
 
+// Kind returns the category of the error, derived from the wrapped error and
+// ffmpeg's stderr.
+func (err *Error) Kind() ErrorKind {
+	kind, _ := err.classify()
+	return kind
+}
+
+// Lines returns the lines of stderr relevant to the error. If the error is
+// unknown, the last few lines are returned.
+func (err *Error) Lines() []string {
+	_, lines := err.classify()
+	return lines
+}
+
+func (err *Error) classify() (ErrorKind, []string) {
+	var lines = stderrLines(err.stderr.String())
+
+	switch {
+	case errors.Is(err.wrapped, ErrStalled):
+		return StalledError, lines
+	case errors.Is(err.wrapped, ErrTimedOut):
+		return TimedOutError, lines
+	}
+
+	for _, p := range errorPatterns {
+		var matched []string
+		for _, line := range lines {
+			for _, pattern := range p.patterns {
+				if strings.Contains(line, pattern) {
+					matched = append(matched, line)
+					break
+				}
+			}
+		}
+		if len(matched) > 0 {
+			return p.kind, matched
+		}
+	}
+
+	if ErrIsSignal(err.wrapped) {
+		return SignalError, lines
+	}
+
+	if len(lines) > maxContextLines {
+		lines = lines[len(lines)-maxContextLines:]
+	}
+
+	return UnknownError, lines
+}
+
+func stderrLines(stderr string) []string {
+	var lines []string
+	for _, line := range strings.Split(stderr, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
 func fmtError(prefix string, err error, stderr bytes.Buffer) string {
 	return fmt.Sprintf("%s: %s\n%s", prefix, err.Error(), stderr.String())
 }
 
+// ErrKind returns the kind of the ffmpeg error, or UnknownError if the error is
+// not an ffmpeg error.
+func ErrKind(err error) ErrorKind {
+	var ffErr *Error
+	if errors.As(err, &ffErr) {
+		return ffErr.Kind()
+	}
+	return UnknownError
+}
+
 // ErrIsExit returns true if the error is a process exit non-zero error.
 func ErrIsExit(err error) bool {
 	var exitErr *exec.ExitError
@@ -47,3 +209,15 @@ func ErrIsExit(err error) bool {
 
 	return exitErr.ExitCode() > 0
 }
+
+// ErrIsSignal returns true if the error is the process being killed by a
+// signal.
+func ErrIsSignal(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled()
+}
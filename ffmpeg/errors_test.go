@@ -0,0 +1,81 @@
+package ffmpeg
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestErrorKind(t *testing.T) {
+	var tests = []struct {
+		name   string
+		err    error
+		stderr string
+		kind   ErrorKind
+		lines  []string
+	}{
+		{
+			name: "no stream",
+			err:  errors.New("exit status 1"),
+			stderr: "[mp3 @ 0x5581] Estimating duration from bitrate, this may be inaccurate\n" +
+				"Output #1, image2, to '.cover.jpg':\n" +
+				"Output file #1 does not contain any stream\n",
+			kind:  NoStreamError,
+			lines: []string{"Output file #1 does not contain any stream"},
+		},
+		{
+			name:   "corrupt input",
+			err:    errors.New("exit status 1"),
+			stderr: "test.flac: Invalid data found when processing input\n",
+			kind:   CorruptInputError,
+			lines:  []string{"test.flac: Invalid data found when processing input"},
+		},
+		{
+			name: "disk full before symptoms",
+			err:  errors.New("exit status 1"),
+			stderr: "av_interleaved_write_frame(): No space left on device\n" +
+				"Error writing trailer of .test.opus: No space left on device\n" +
+				"Error while decoding stream #0:0: Invalid data found when processing input\n",
+			kind: DiskFullError,
+			lines: []string{
+				"av_interleaved_write_frame(): No space left on device",
+				"Error writing trailer of .test.opus: No space left on device",
+			},
+		},
+		{
+			name:   "encoder not found",
+			err:    errors.New("exit status 1"),
+			stderr: "Unknown encoder 'libopus'\n",
+			kind:   EncoderNotFoundError,
+			lines:  []string{"Unknown encoder 'libopus'"},
+		},
+		{
+			name:   "stalled",
+			err:    errors.Wrap(ErrStalled, "no progress"),
+			stderr: "",
+			kind:   StalledError,
+		},
+		{
+			name:   "unknown",
+			err:    errors.New("exit status 1"),
+			stderr: "a\nb\n\nc\nd\n",
+			kind:   UnknownError,
+			lines:  []string{"b", "c", "d"},
+		},
+	}
+
+	for _, test := range tests {
+		var ffErr Error
+		ffErr.Stderr().Write([]byte(test.stderr))
+		err := ffErr.Wrap(test.err)
+
+		if kind := ErrKind(err); kind != test.kind {
+			t.Errorf("%s: expected kind %v, got %v", test.name, test.kind, kind)
+		}
+
+		if lines := ffErr.Lines(); !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: expected lines %q, got %q", test.name, test.lines, lines)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package ffmpeg
 
 import (
 	"context"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -12,12 +11,14 @@ import (
 	"github.com/pkg/errors"
 )
 
-func init() {
-	for _, arg0 := range []string{"ffmpeg"} {
+// Check returns an error if ffmpeg or ffprobe can't be found in $PATH.
+func Check() error {
+	for _, arg0 := range []string{"ffmpeg", "ffprobe"} {
 		if _, err := exec.LookPath(arg0); err != nil {
-			log.Fatalln("Failed to find", arg0+".")
+			return errors.Errorf("failed to find %s", arg0)
 		}
 	}
+	return nil
 }
 
 // ConvertExt changes a file's extension to the given ext, for example "opus".
@@ -47,33 +48,142 @@ type Result struct {
 	Progress
 	Runtime    time.Duration
 	OutputPath string
+	// InputDuration is the probed duration of the input, or 0 if it wasn't
+	// probed.
+	InputDuration time.Duration
+}
+
+// Output describes a single output file of an ffmpeg invocation. Args are the
+// output options that precede the path on the command line.
+type Output struct {
+	Path string
+	Args []string
 }
 
 // ExecuteCtx executes ffmpeg with the given arguments. It returns the final
 // progress result.
 func ExecuteCtx(ctx context.Context, src, dst string, args ...string) (*Result, error) {
-	// The path to a temporary file, which is basically the same path but with a
-	// dot prepended to the filename: /path/to/.file
-	tmpdst := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst))
+	return ExecuteOutputsCtx(ctx, src, Output{Path: dst, Args: args})
+}
+
+// ExecuteOutputsCtx executes ffmpeg once, decoding src and writing to all the
+// given outputs. Every output is written atomically, and the first one is only
+// replaced once the others are; if one fails, the first isn't written, and the
+// other files that were already replaced are removed. The returned result's
+// OutputPath is the first output.
+func ExecuteOutputsCtx(ctx context.Context, src string, outputs ...Output) (*Result, error) {
+	if len(outputs) == 0 {
+		return nil, errors.New("no outputs given")
+	}
 
-	// Convert and write to that temp file.
-	p, err := executeCtx(ctx, src, tmpdst, args...)
+	// The paths to temporary files, which are basically the same paths but
+	// with a dot prepended to the filename: /path/to/.file
+	tmpOutputs := make([]Output, len(outputs))
+	for i, output := range outputs {
+		tmpOutputs[i] = Output{
+			Path: tmpPath(output.Path),
+			Args: output.Args,
+		}
+	}
+
+	// Convert and write to those temp files.
+	p, err := executeCtx(ctx, "encode", src, tmpOutputs)
 	if err != nil {
-		os.Remove(tmpdst)
+		removeOutputs(tmpOutputs)
 		return nil, err
 	}
-	p.OutputPath = dst
+	p.OutputPath = outputs[0].Path
+
+	// Atomically rename those temp files to the intended destinations.
+	endRename := startStage(ctx, "rename")
+	err = renameOutputs(tmpOutputs, outputs)
+	endRename(err)
+
+	return p, err
+}
+
+// renameOutputs renames the temporary outputs to their destinations, last
+// first, so that the first output, which may replace a good one, is only
+// renamed once the others are in place. If one fails, the ones already renamed
+// are removed, so that no output is written without the others.
+func renameOutputs(tmpOutputs, outputs []Output) error {
+	for i := len(outputs) - 1; i >= 0; i-- {
+		if err := os.Rename(tmpOutputs[i].Path, outputs[i].Path); err != nil {
+			removeOutputs(outputs[i+1:])
+			removeOutputs(tmpOutputs[:i+1])
+			return err
+		}
+	}
+	return nil
+}
 
-	// Atomically rename that temp file to the intended destination.
-	return p, os.Rename(tmpdst, dst)
+func tmpPath(dst string) string {
+	return filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst))
 }
 
-func executeCtx(ctx context.Context, src, dst string, args ...string) (*Result, error) {
-	ffmpegArgs := make([]string, 0, len(defaultArgs)+len(args)+3)
+func removeOutputs(outputs []Output) {
+	for _, output := range outputs {
+		os.Remove(output.Path)
+	}
+}
+
+// ProbeInputCtx probes src as the "probe" stage of an invocation. The returned
+// context carries the input's duration, so that ExecuteOutputsCtx doesn't
+// probe it again.
+func ProbeInputCtx(ctx context.Context, src string) (context.Context, *Probe, error) {
+	endProbe := startStage(ctx, "probe")
+	probe, err := ProbeCtx(ctx, src)
+	endProbe(err)
+
+	if err != nil {
+		return ctx, nil, err
+	}
+	if probe.Duration > 0 {
+		ctx = WithInputDuration(ctx, probe.Duration)
+	}
+	return ctx, probe, nil
+}
+
+// executeCtx runs ffmpeg as the given stage, such as "encode".
+func executeCtx(ctx context.Context, stage, src string, outputs []Output) (res *Result, err error) {
+	var nargs = len(defaultArgs) + 2
+	for _, output := range outputs {
+		nargs += len(output.Args) + 1
+	}
+
+	ffmpegArgs := make([]string, 0, nargs)
 	ffmpegArgs = append(ffmpegArgs, defaultArgs...)
 	ffmpegArgs = append(ffmpegArgs, "-i", src)
-	ffmpegArgs = append(ffmpegArgs, args...)
-	ffmpegArgs = append(ffmpegArgs, dst)
+	for _, output := range outputs {
+		ffmpegArgs = append(ffmpegArgs, output.Args...)
+		ffmpegArgs = append(ffmpegArgs, output.Path)
+	}
+
+	trace := progressFromCtx(ctx)
+	watchdog, supervised := watchdogFromCtx(ctx)
+
+	// Only probe for the duration if someone needs it.
+	in := inputDurationFromCtx(ctx)
+	if in == 0 && (trace != nil || (supervised && watchdog.MinSpeed > 0)) {
+		endProbe := startStage(ctx, "probe")
+		probe, err := ProbeCtx(ctx, src)
+		if err == nil {
+			in = probe.Duration
+		}
+		endProbe(err)
+	}
+
+	endStage := startStage(ctx, stage)
+	defer func() { endStage(err) }()
+
+	var run *watchdogRun
+	if supervised {
+		ctx, run = watchdog.start(ctx, in)
+		defer run.stop()
+	}
+
+	log := loggerFromCtx(ctx).Component("ffmpeg").With("src", src)
+	log.Debug("Running ffmpeg", "args", strings.Join(ffmpegArgs, " "))
 
 	cmd := exec.CommandContext(ctx, "ffmpeg", ffmpegArgs...)
 	cmd.Env = append(os.Environ(), "AV_LOG_FORCE_NOCOLOR=0") // force no color
@@ -95,17 +205,37 @@ func executeCtx(ctx context.Context, src, dst string, args ...string) (*Result,
 		return nil, ffmpegErr.Wrap(err)
 	}
 
-	_, err = parseOutput(o, func(p Progress) { progress = p })
+	_, err = parseOutput(o, func(p Progress) {
+		p.Percentage = p.percentage(in)
+		if run != nil {
+			run.update(p)
+		}
+		if trace != nil {
+			trace(p)
+		}
+		progress = p
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to parse output")
 	}
 
 	if err := cmd.Wait(); err != nil {
+		// Report the watchdog's reason instead of the kill signal if it was
+		// the one that killed the process.
+		if run != nil {
+			if werr := run.stop(); werr != nil {
+				log.Warn("Killed ffmpeg", "error", werr, "duration", time.Since(now))
+				return nil, ffmpegErr.Wrap(werr)
+			}
+		}
 		return nil, ffmpegErr.Wrap(err)
 	}
 
+	log.Debug("Finished ffmpeg", "duration", time.Since(now))
+
 	return &Result{
-		Progress: progress,
-		Runtime:  time.Now().Sub(now),
+		Progress:      progress,
+		Runtime:       time.Now().Sub(now),
+		InputDuration: in,
 	}, nil
 }
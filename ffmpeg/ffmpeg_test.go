@@ -0,0 +1,77 @@
+package ffmpeg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenameOutputs(t *testing.T) {
+	var tests = []struct {
+		name    string
+		blocked int // the output with a directory in the way
+		expects map[string]string
+	}{
+		{
+			name:    "cover fails",
+			blocked: 1,
+			expects: map[string]string{"song.opus": "old", ".song.opus": "", ".cover.jpg": ""},
+		},
+		{
+			name:    "song fails",
+			blocked: 0,
+			expects: map[string]string{"cover.jpg": "", ".song.opus": "", ".cover.jpg": ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "ffsync-ffmpeg-")
+			if err != nil {
+				t.Fatal("Failed to create tmpdir:", err)
+			}
+			defer os.RemoveAll(dir)
+
+			var outputs = []Output{
+				{Path: filepath.Join(dir, "song.opus")},
+				{Path: filepath.Join(dir, "cover.jpg")},
+			}
+			var tmpOutputs = []Output{
+				{Path: tmpPath(outputs[0].Path)},
+				{Path: tmpPath(outputs[1].Path)},
+			}
+			for _, o := range tmpOutputs {
+				if err := ioutil.WriteFile(o.Path, []byte("new"), 0644); err != nil {
+					t.Fatal("Failed to write:", err)
+				}
+			}
+
+			// A non-empty directory in the way makes the rename fail.
+			if err := os.MkdirAll(filepath.Join(outputs[test.blocked].Path, "dir"), os.ModePerm); err != nil {
+				t.Fatal("Failed to mkdir:", err)
+			}
+			// The output of an earlier conversion, which is being replaced.
+			if test.blocked != 0 {
+				if err := ioutil.WriteFile(outputs[0].Path, []byte("old"), 0644); err != nil {
+					t.Fatal("Failed to write:", err)
+				}
+			}
+
+			if err := renameOutputs(tmpOutputs, outputs); err == nil {
+				t.Fatal("Expected the rename to fail")
+			}
+
+			// An empty expectation means the file must be gone.
+			for name, expect := range test.expects {
+				b, err := ioutil.ReadFile(filepath.Join(dir, name))
+				switch {
+				case expect == "" && !os.IsNotExist(err):
+					t.Errorf("Expected %s to be removed, got %v", name, err)
+				case expect != "" && string(b) != expect:
+					t.Errorf("%s: expected %q, got %q, %v", name, expect, b, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package ffmpeg
+
+import (
+	"context"
+
+	"github.com/diamondburned/ffsync/internal/logger"
+)
+
+type loggerKey struct{}
+
+// WithLogger returns a new context that makes ExecuteCtx and ExecuteOutputsCtx
+// log the invocation using l.
+func WithLogger(ctx context.Context, l *logger.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFromCtx returns the logger in the context, which may be nil.
+func loggerFromCtx(ctx context.Context) *logger.Logger {
+	l, _ := ctx.Value(loggerKey{}).(*logger.Logger)
+	return l
+}
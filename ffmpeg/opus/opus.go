@@ -6,17 +6,45 @@ import (
 	"github.com/diamondburned/ffsync/ffmpeg"
 )
 
-var (
-	Bitrate = "64k"
-	VBRMode = "on"
+// The default encoder settings.
+const (
+	DefaultBitrate = "64k"
+	DefaultVBRMode = "on"
 )
 
+// Profile is the encoder settings. Empty fields are the defaults.
+type Profile struct {
+	Bitrate string // for example "96k"
+	VBRMode string // "on", "off" or "constrained"
+}
+
+func (p Profile) orDefault() Profile {
+	if p.Bitrate == "" {
+		p.Bitrate = DefaultBitrate
+	}
+	if p.VBRMode == "" {
+		p.VBRMode = DefaultVBRMode
+	}
+	return p
+}
+
 // ConvertCtx atomically converts src to dst as an opus file.
-func ConvertCtx(ctx context.Context, src, dst string) (*ffmpeg.Result, error) {
-	return ffmpeg.ExecuteCtx(ctx, src, dst,
-		// Output format and options
-		"-f", "opus", "-vn",
-		// Audio encoding options
-		"-c:a", "libopus", "-b:a", Bitrate, "-vbr", VBRMode,
-	)
+func ConvertCtx(ctx context.Context, p Profile, src, dst string) (*ffmpeg.Result, error) {
+	return ffmpeg.ExecuteOutputsCtx(ctx, src, Output(p, dst))
+}
+
+// Output returns the ffmpeg output that encodes the audio into dst as an opus
+// file.
+func Output(p Profile, dst string) ffmpeg.Output {
+	p = p.orDefault()
+
+	return ffmpeg.Output{
+		Path: dst,
+		Args: []string{
+			// Output format and options
+			"-f", "opus", "-vn",
+			// Audio encoding options
+			"-c:a", "libopus", "-b:a", p.Bitrate, "-vbr", p.VBRMode,
+		},
+	}
 }
@@ -0,0 +1,30 @@
+package opus
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutput(t *testing.T) {
+	var tests = []struct {
+		name    string
+		profile Profile
+		args    string
+	}{
+		{"default", Profile{}, "-b:a 64k -vbr on"},
+		{"bitrate", Profile{Bitrate: "128k"}, "-b:a 128k -vbr on"},
+		{"cbr", Profile{Bitrate: "96k", VBRMode: "off"}, "-b:a 96k -vbr off"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			o := Output(test.profile, "out.opus")
+			if args := strings.Join(o.Args, " "); !strings.HasSuffix(args, test.args) {
+				t.Errorf("Expected args to end with %q, got %q", test.args, args)
+			}
+		})
+	}
+}
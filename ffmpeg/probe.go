@@ -0,0 +1,103 @@
+package ffmpeg
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Probe is the result of probing a media file using ffprobe.
+type Probe struct {
+	Duration time.Duration
+	Streams  []ProbeStream
+}
+
+// ProbeStream describes a single stream inside a probed file.
+type ProbeStream struct {
+	Index     int    `json:"index"`
+	CodecType string `json:"codec_type"` // "audio", "video", etc.
+	CodecName string `json:"codec_name"`
+	// AttachedPic is true if the stream is an embedded picture, such as an
+	// album art.
+	AttachedPic bool `json:"attached_pic,omitempty"`
+}
+
+// HasAttachedPic returns true if the probed file has an embedded picture.
+func (p *Probe) HasAttachedPic() bool {
+	for _, stream := range p.Streams {
+		if stream.AttachedPic {
+			return true
+		}
+	}
+	return false
+}
+
+// probeOutput is the JSON output of ffprobe.
+type probeOutput struct {
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+	Streams []struct {
+		Index       int    `json:"index"`
+		CodecType   string `json:"codec_type"`
+		CodecName   string `json:"codec_name"`
+		Disposition struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+}
+
+// ProbeCtx probes the given file using ffprobe.
+func ProbeCtx(ctx context.Context, src string) (*Probe, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-hide_banner",
+		"-loglevel", "error",
+		"-print_format", "json",
+		"-show_format", "-show_streams",
+		src,
+	)
+
+	ffmpegErr := Error{}
+	cmd.Stderr = ffmpegErr.Stderr()
+
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, ffmpegErr.Wrap(err)
+	}
+
+	return parseProbe(b)
+}
+
+func parseProbe(b []byte) (*Probe, error) {
+	var out probeOutput
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, errors.Wrap(err, "failed to decode ffprobe output")
+	}
+
+	var probe = Probe{
+		Streams: make([]ProbeStream, len(out.Streams)),
+	}
+
+	if out.Format.Duration != "" {
+		f, err := strconv.ParseFloat(out.Format.Duration, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse duration")
+		}
+		probe.Duration = time.Duration(f * float64(time.Second))
+	}
+
+	for i, stream := range out.Streams {
+		probe.Streams[i] = ProbeStream{
+			Index:       stream.Index,
+			CodecType:   stream.CodecType,
+			CodecName:   stream.CodecName,
+			AttachedPic: stream.Disposition.AttachedPic == 1,
+		}
+	}
+
+	return &probe, nil
+}
@@ -0,0 +1,76 @@
+package ffmpeg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testProbe = `{
+    "streams": [
+        {
+            "index": 0,
+            "codec_name": "flac",
+            "codec_type": "audio",
+            "disposition": {
+                "default": 0,
+                "attached_pic": 0
+            }
+        },
+        {
+            "index": 1,
+            "codec_name": "mjpeg",
+            "codec_type": "video",
+            "disposition": {
+                "default": 0,
+                "attached_pic": 1
+            }
+        }
+    ],
+    "format": {
+        "filename": "test.flac",
+        "duration": "83.853500"
+    }
+}`
+
+func TestParseProbe(t *testing.T) {
+	p, err := parseProbe([]byte(testProbe))
+	if err != nil {
+		t.Fatal("Failed to parse probe:", err)
+	}
+
+	var expect = &Probe{
+		Duration: 83853500 * time.Microsecond,
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "audio", CodecName: "flac"},
+			{Index: 1, CodecType: "video", CodecName: "mjpeg", AttachedPic: true},
+		},
+	}
+
+	if !reflect.DeepEqual(p, expect) {
+		t.Fatalf("Mismatch:\nExpect:\t\t%#v\nGot:\t\t%#v", expect, p)
+	}
+
+	if !p.HasAttachedPic() {
+		t.Fatal("Expected probe to have an attached picture")
+	}
+}
+
+func TestProgressPercentage(t *testing.T) {
+	var in = 100 * time.Second
+
+	var tests = []struct {
+		progress Progress
+		expect   float32
+	}{
+		{Progress{OutTimeus: 50e6, Progress: ProgressContinue}, 50},
+		{Progress{OutTimeus: 150e6, Progress: ProgressContinue}, 100},
+		{Progress{OutTimeus: 90e6, Progress: ProgressEnd}, 100},
+	}
+
+	for _, test := range tests {
+		if p := test.progress.percentage(in); p != test.expect {
+			t.Errorf("Expected %v%%, got %v%%", test.expect, p)
+		}
+	}
+}
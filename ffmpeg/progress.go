@@ -0,0 +1,76 @@
+package ffmpeg
+
+import (
+	"context"
+	"time"
+)
+
+// ProgressFunc is called on every progress update of an ffmpeg invocation.
+type ProgressFunc func(Progress)
+
+type progressKey struct{}
+
+// WithProgress returns a new context that makes ExecuteCtx and
+// ExecuteOutputsCtx call fn on every progress update. The Percentage field is
+// computed from the duration of the input, which is probed using ffprobe
+// before the invocation if it's not given by WithInputDuration.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func progressFromCtx(ctx context.Context) ProgressFunc {
+	fn, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	return fn
+}
+
+type inputDurationKey struct{}
+
+// WithInputDuration returns a new context that carries the already known
+// duration of the input, so that it doesn't need to be probed again.
+func WithInputDuration(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, inputDurationKey{}, d)
+}
+
+func inputDurationFromCtx(ctx context.Context) time.Duration {
+	d, _ := ctx.Value(inputDurationKey{}).(time.Duration)
+	return d
+}
+
+// percentage calculates the percentage of the progress over the given input
+// duration.
+func (p Progress) percentage(in time.Duration) float32 {
+	if p.Progress == ProgressEnd {
+		return 100
+	}
+	if in <= 0 {
+		return 0
+	}
+
+	f := float32(p.OutDuration()) / float32(in) * 100
+	if f > 100 {
+		f = 100
+	}
+	return f
+}
+
+// StageFunc is called when a stage of an invocation starts: "probe", "encode",
+// "rename" or "verify". The returned function is called with the stage's error when it
+// ends.
+type StageFunc func(stage string) func(error)
+
+type stageKey struct{}
+
+// WithStages returns a new context that makes ExecuteCtx and ExecuteOutputsCtx
+// call fn on every stage of the invocation, so that they can be timed.
+func WithStages(ctx context.Context, fn StageFunc) context.Context {
+	return context.WithValue(ctx, stageKey{}, fn)
+}
+
+// startStage starts the stage if the context has a StageFunc.
+func startStage(ctx context.Context, stage string) func(error) {
+	fn, _ := ctx.Value(stageKey{}).(StageFunc)
+	if fn == nil {
+		return func(error) {}
+	}
+	return fn(stage)
+}
@@ -0,0 +1,87 @@
+package ffmpeg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrVerify is returned if an output fails verification. The output is likely
+// to be fine if it's written again. The actual error is a *VerifyError.
+var ErrVerify = errors.New("output verification failed")
+
+// VerifyError is returned if an output fails verification.
+type VerifyError struct {
+	Reason string
+	// Truncated is true if the output is shorter than expected or empty.
+	// Otherwise, the output can't be decoded.
+	Truncated bool
+}
+
+func (err *VerifyError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrVerify, err.Reason)
+}
+
+// Is returns true if target is ErrVerify.
+func (err *VerifyError) Is(target error) bool {
+	return target == ErrVerify
+}
+
+// Verification describes how outputs are verified after they're written.
+type Verification struct {
+	// Tolerance is the maximum difference between the duration of the input
+	// and the duration of the decoded output.
+	Tolerance time.Duration
+}
+
+// VerifyCtx verifies the written output at dst by checking that it's not
+// empty and decoding it entirely. If in is not 0, then the decoded duration
+// must be within the tolerance of it. A *VerifyError is returned if the output
+// is bad. Decoding is reported as the "verify" stage, and not as progress.
+func (v Verification) VerifyCtx(ctx context.Context, dst string, in time.Duration) error {
+	s, err := os.Stat(dst)
+	if err != nil {
+		return errors.Wrap(err, "failed to stat output")
+	}
+	if s.Size() == 0 {
+		return &VerifyError{Reason: "output is empty", Truncated: true}
+	}
+
+	// The output should be as long as the input, so don't probe it again.
+	if in > 0 {
+		ctx = WithInputDuration(ctx, in)
+	}
+
+	// Decoding the output isn't the progress of the conversion.
+	ctx = WithProgress(ctx, nil)
+
+	r, err := executeCtx(ctx, "verify", dst, []Output{{
+		Path: os.DevNull,
+		Args: []string{"-xerror", "-f", "null"},
+	}})
+	if err != nil {
+		// Don't blame the output if we were cancelled.
+		if ctx.Err() != nil {
+			return err
+		}
+		return &VerifyError{Reason: "failed to decode output: " + err.Error()}
+	}
+
+	if in > 0 {
+		diff := in - r.OutDuration()
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > v.Tolerance {
+			return &VerifyError{
+				Reason:    fmt.Sprintf("output is %v long, but the input is %v", r.OutDuration(), in),
+				Truncated: r.OutDuration() < in,
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package ffmpeg
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrStalled is returned if ffmpeg was killed because its output time
+	// hasn't advanced within the watchdog's stall window.
+	ErrStalled = errors.New("ffmpeg stalled")
+	// ErrTimedOut is returned if ffmpeg was killed because it ran for longer
+	// than the deadline derived from the input duration.
+	ErrTimedOut = errors.New("ffmpeg timed out")
+)
+
+// ErrIsWatchdog returns true if the error is caused by the watchdog killing the
+// process.
+func ErrIsWatchdog(err error) bool {
+	return errors.Is(err, ErrStalled) || errors.Is(err, ErrTimedOut)
+}
+
+// Watchdog describes how an ffmpeg invocation is supervised.
+type Watchdog struct {
+	// StallTimeout is how long the output time may not advance before the
+	// process is killed. Zero disables stall detection.
+	StallTimeout time.Duration
+	// MinSpeed is the slowest realtime multiplier tolerated. The deadline is
+	// derived from the remaining duration of the input over the observed speed,
+	// but the speed is never assumed to be lower than MinSpeed. Zero disables
+	// the deadline.
+	MinSpeed float64
+	// Grace is added on top of the derived deadline to account for the startup
+	// and finalizing time.
+	Grace time.Duration
+	// Timeout is the deadline used if the input duration is unknown. Zero
+	// means no deadline.
+	Timeout time.Duration
+}
+
+type watchdogKey struct{}
+
+// WithWatchdog returns a new context that makes ExecuteCtx and
+// ExecuteOutputsCtx supervise ffmpeg using the given watchdog.
+func WithWatchdog(ctx context.Context, w Watchdog) context.Context {
+	return context.WithValue(ctx, watchdogKey{}, w)
+}
+
+func watchdogFromCtx(ctx context.Context) (Watchdog, bool) {
+	w, ok := ctx.Value(watchdogKey{}).(Watchdog)
+	return w, ok
+}
+
+// deadline returns the time after which the invocation should be killed. The
+// zero time is returned if there's no deadline.
+func (w Watchdog) deadline(now time.Time, in time.Duration, p Progress) time.Time {
+	if w.MinSpeed <= 0 || in <= 0 {
+		if w.Timeout <= 0 {
+			return time.Time{}
+		}
+		return now.Add(w.Timeout)
+	}
+
+	remaining := in - p.OutDuration()
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	speed := float64(p.Speed)
+	if speed < w.MinSpeed {
+		speed = w.MinSpeed
+	}
+
+	return now.Add(time.Duration(float64(remaining)/speed) + w.Grace)
+}
+
+// watchdogRun is the state of a single supervised invocation.
+type watchdogRun struct {
+	Watchdog
+	cancel context.CancelFunc
+	in     time.Duration
+
+	mutex    sync.Mutex
+	deadline time.Time
+	advanced time.Time // last time out_time_us advanced
+	outTime  int64
+	err      error
+}
+
+func (w Watchdog) start(ctx context.Context, in time.Duration) (context.Context, *watchdogRun) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var now = time.Now()
+	run := &watchdogRun{
+		Watchdog: w,
+		cancel:   cancel,
+		in:       in,
+		deadline: w.deadline(now, in, Progress{}),
+		advanced: now,
+	}
+
+	go run.watch(ctx)
+	return ctx, run
+}
+
+// update is called on every progress update.
+func (r *watchdogRun) update(p Progress) {
+	var now = time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if p.OutTimeus > r.outTime {
+		r.outTime = p.OutTimeus
+		r.advanced = now
+	}
+
+	// Only refine the deadline once we know both the input duration and the
+	// speed; otherwise, keep the initial one.
+	if r.in > 0 && p.Speed > 0 {
+		r.deadline = r.Watchdog.deadline(now, r.in, p)
+	}
+}
+
+func (r *watchdogRun) watch(ctx context.Context) {
+	var interval = time.Second
+	if r.StallTimeout > 0 && r.StallTimeout/4 < interval {
+		interval = r.StallTimeout / 4
+	}
+
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := r.check(now); err != nil {
+				r.cancel()
+				return
+			}
+		}
+	}
+}
+
+func (r *watchdogRun) check(now time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch {
+	case r.StallTimeout > 0 && now.Sub(r.advanced) > r.StallTimeout:
+		r.err = errors.Wrapf(ErrStalled,
+			"no progress for %v at %v", r.StallTimeout, time.Duration(r.outTime)*time.Microsecond)
+	case !r.deadline.IsZero() && now.After(r.deadline):
+		r.err = errors.Wrapf(ErrTimedOut,
+			"deadline exceeded at %v", time.Duration(r.outTime)*time.Microsecond)
+	}
+
+	return r.err
+}
+
+// stop stops the watchdog and returns the reason it killed the process, if
+// any.
+func (r *watchdogRun) stop() error {
+	r.cancel()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.err
+}
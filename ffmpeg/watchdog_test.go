@@ -0,0 +1,55 @@
+package ffmpeg
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWatchdogDeadline(t *testing.T) {
+	var w = Watchdog{
+		MinSpeed: 1,
+		Grace:    time.Minute,
+		Timeout:  10 * time.Minute,
+	}
+
+	var now = time.Now()
+	var in = time.Hour
+
+	var tests = []struct {
+		name     string
+		in       time.Duration
+		progress Progress
+		expect   time.Duration
+	}{
+		{"unknown duration", 0, Progress{}, 10 * time.Minute},
+		{"no progress", in, Progress{}, time.Hour + time.Minute},
+		{"fast", in, Progress{OutTimeus: 30 * 60e6, Speed: 30}, time.Minute + time.Minute},
+		{"slower than minimum", in, Progress{OutTimeus: 30 * 60e6, Speed: 0.5}, 31 * time.Minute},
+	}
+
+	for _, test := range tests {
+		d := w.deadline(now, test.in, test.progress).Sub(now)
+		if d != test.expect {
+			t.Errorf("%s: expected deadline in %v, got %v", test.name, test.expect, d)
+		}
+	}
+}
+
+func TestWatchdogStall(t *testing.T) {
+	var now = time.Now()
+
+	var run = watchdogRun{
+		Watchdog: Watchdog{StallTimeout: time.Minute},
+		cancel:   func() {},
+		advanced: now,
+	}
+
+	if err := run.check(now.Add(30 * time.Second)); err != nil {
+		t.Fatal("Unexpected error before the stall window:", err)
+	}
+
+	if err := run.check(now.Add(2 * time.Minute)); !errors.Is(err, ErrStalled) {
+		t.Fatal("Expected ErrStalled, got", err)
+	}
+}
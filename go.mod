@@ -1,12 +1,14 @@
 module github.com/diamondburned/ffsync
 
-go 1.14
+go 1.16
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/Netflix/go-env v0.0.0-20200512170851-5660fe1ab40a
 	github.com/diamondburned/sfmatch v0.0.0-20200622013314-3564cc575b5b
 	github.com/influxdata/influxdb1-client v0.0.0-20200515024757-02f0bf5dbca3
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
 	github.com/radovskyb/watcher v1.0.7
-	golang.org/x/sync v0.0.0-20200317015054-43a5402ce75a
+	go.etcd.io/bbolt v1.3.5
 )
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/ffsync/internal/history"
+	"github.com/diamondburned/ffsync/internal/osutil"
+)
+
+// record adds the ended job into the history. The sizes are read from the
+// files.
+func (a *Application) record(r history.Record) {
+	r.Time = time.Now()
+
+	if s, err := os.Stat(r.Src); err == nil {
+		r.SrcSize = s.Size()
+	}
+	if !r.Failed() {
+		if s, err := os.Stat(r.Dst); err == nil {
+			r.DstSize = s.Size()
+		}
+	}
+
+	if err := a.History.Add(r); err != nil {
+		a.Log.Component("history").Error("Failed to add to the history", "src", r.Src, "error", err)
+	}
+}
+
+// historyMain implements the history command.
+func historyMain(cmd command, args []string) {
+	fs := cmd.flags()
+	since := fs.Duration("since", 7*24*time.Hour, "only report jobs that ended within this long")
+	action := fs.String("action", "", `only report jobs of this action: "copy" or "convert"`)
+	failed := fs.Bool("failed", false, "list the failed jobs")
+	slowest := fs.Int("slowest", 10, "list this many of the slowest jobs")
+	jsonOut := fs.Bool("json", false, "print the report as JSON")
+	configPath, sets := configFlags(fs)
+	fs.Parse(args)
+
+	set := commandSettings(fs, *configPath, *sets, false)
+	db := history.Open(history.Path(osutil.StateDir(set.Dst)))
+
+	filter := history.Filter{Action: *action}
+	if *since > 0 {
+		filter.Since = time.Now().Add(-*since)
+	}
+
+	records, err := db.Query(filter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to query the history:", err)
+		os.Exit(exitError)
+	}
+
+	summary := history.Summarize(records)
+
+	var listed []history.Record
+	if *failed {
+		for _, r := range records {
+			if r.Failed() {
+				listed = append(listed, r)
+			}
+		}
+	} else if *slowest > 0 {
+		listed = history.Slowest(records, *slowest)
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(struct {
+			Summary history.Summary  `json:"summary"`
+			Records []history.Record `json:"records"`
+		}{summary, listed})
+		return
+	}
+
+	fmt.Printf("%d job(s), %d failed, took %v\n", summary.Jobs, summary.Failed, summary.Duration.Truncate(time.Second))
+	fmt.Printf("read %s, wrote %s, saved %s by converting\n",
+		formatBytes(summary.SrcBytes), formatBytes(summary.DstBytes), formatBytes(summary.Saved))
+
+	if len(listed) > 0 {
+		fmt.Println()
+	}
+
+	for _, r := range listed {
+		if r.Failed() {
+			fmt.Printf("%s\t%s\t%s\t%s\n",
+				r.Time.Format(time.RFC3339), r.Src, r.Kind, strings.ReplaceAll(r.Error, "\n", " "))
+			continue
+		}
+		fmt.Printf("%s\t%s\t%v\t%.1fx\n",
+			r.Time.Format(time.RFC3339), r.Src, r.Duration.Truncate(time.Millisecond), r.Speed)
+	}
+}
+
+// formatBytes formats the size using binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	var f = float64(n)
+	var i int
+	for ; (f >= unit || f <= -unit) && i < 5; i++ {
+		f /= unit
+	}
+
+	return fmt.Sprintf("%.1f %ciB", f, "KMGTPE"[i-1])
+}
@@ -0,0 +1,365 @@
+// Package api serves a local HTTP API and a web dashboard to inspect and control
+// a running watch, either on a TCP address or on a Unix socket.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/ffsync/internal/history"
+	"github.com/diamondburned/ffsync/internal/logger"
+	"github.com/diamondburned/ffsync/internal/retry"
+	"github.com/pkg/errors"
+)
+
+type Config struct {
+	// Address is either a TCP address, such as "localhost:8420", or the path
+	// to a Unix socket, such as "/run/ffsync/api.sock".
+	Address string `env:"FFSYNC_API_ADDRESS"`
+}
+
+// network returns the network to listen on for the address.
+func (c Config) network() string {
+	if strings.Contains(c.Address, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// Status is the state of the running watch.
+type Status struct {
+	Source      string          `json:"source"`
+	Destination string          `json:"destination"`
+	Profile     string          `json:"profile"`
+	Paused      bool            `json:"paused"`
+	Outputs     int             `json:"outputs"`
+	Queued      int             `json:"queued"`   // jobs waiting for a worker
+	Running     int             `json:"running"`  // jobs holding a worker
+	Retrying    int             `json:"retrying"` // jobs waiting to be retried
+	DeadLetters int             `json:"dead_letters"`
+	Pools       map[string]Pool `json:"pools"`
+	Recent      history.Summary `json:"recent"` // the jobs of the last day
+}
+
+// Pool is the state of a pool of workers.
+type Pool struct {
+	Size    int `json:"size"`
+	Running int `json:"running"`
+	Waiting int `json:"waiting"`
+}
+
+// Job is a queued or running job.
+type Job struct {
+	ID         uint64    `json:"id"`
+	Action     string    `json:"action"`
+	Src        string    `json:"src"`
+	Dst        string    `json:"dst"`
+	Running    bool      `json:"running"`
+	Queued     time.Time `json:"queued"`
+	Started    time.Time `json:"started"` // zero while queued
+	Percentage float32   `json:"percentage,omitempty"`
+	Speed      float32   `json:"speed,omitempty"` // times realtime
+	WroteBytes int64     `json:"wrote_bytes,omitempty"`
+}
+
+// Failures are the files that failed recently or for good.
+type Failures struct {
+	DeadLetters []retry.Entry    `json:"dead_letters"`
+	Recent      []history.Record `json:"recent"` // newest first
+}
+
+// ErrNotFound is returned by a Controller if what's asked for doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// BadRequest is returned by a Controller if the request itself is wrong, such
+// as a path outside of the source tree.
+type BadRequest struct {
+	Err error
+}
+
+func (b BadRequest) Error() string {
+	return b.Err.Error()
+}
+
+// Controller is the running watch.
+type Controller interface {
+	Status() (Status, error)
+	Jobs() []Job
+	// Failures returns up to limit recent failures.
+	Failures(limit int) (Failures, error)
+
+	// Rescan synchronizes every file whose output doesn't exist.
+	Rescan() error
+	// Pause stops starting new jobs until Resume is called. Running jobs
+	// aren't stopped.
+	Pause()
+	Resume()
+	// Requeue synchronizes the files under the source path again, including
+	// dead-lettered ones.
+	Requeue(path string) error
+	// Cancel cancels a queued or running job.
+	Cancel(id uint64) error
+	// Reencode converts the files under the source path again, even if their
+	// outputs exist.
+	Reencode(path string) error
+	// Reload loads the settings again.
+	Reload() error
+}
+
+// Server serves the API.
+type Server struct {
+	srv  *http.Server
+	c    Controller
+	log  *logger.Logger
+	host string // the host of the TCP address, if it's not a loopback one
+}
+
+// NewServer starts serving the API at the configured address. A stale Unix
+// socket is removed first.
+func NewServer(cfg Config, c Controller, log *logger.Logger) (*Server, error) {
+	s := &Server{
+		c:   c,
+		log: log.Component("api"),
+	}
+	s.srv = &http.Server{Handler: s.Handler()}
+
+	network := cfg.network()
+	if network == "tcp" {
+		s.host, _, _ = net.SplitHostPort(cfg.Address)
+	}
+	if network == "unix" {
+		if err := os.Remove(cfg.Address); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "Failed to remove the old socket")
+		}
+	}
+
+	// Listen first, so that a bad address is reported right away.
+	l, err := net.Listen(network, cfg.Address)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to listen for the API")
+	}
+
+	go func() {
+		if err := s.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.log.Error("Failed to serve", "error", err)
+		}
+	}()
+
+	return s, nil
+}
+
+// Close stops the server, waiting a bit for the requests being handled.
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+// Handler returns the handler of every endpoint, which are under /api/, and of
+// the dashboard. Requests for another host are rejected.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", dashboard())
+
+	mux.HandleFunc("/api/status", s.get(func(r *http.Request) (interface{}, error) {
+		return s.c.Status()
+	}))
+	mux.HandleFunc("/api/jobs", s.get(func(r *http.Request) (interface{}, error) {
+		return s.c.Jobs(), nil
+	}))
+	mux.HandleFunc("/api/failures", s.get(func(r *http.Request) (interface{}, error) {
+		var limit = 50
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, BadRequest{errors.Errorf("invalid limit %q", v)}
+			}
+			limit = n
+		}
+		return s.c.Failures(limit)
+	}))
+
+	mux.HandleFunc("/api/rescan", s.post(http.StatusAccepted, func(r *http.Request) error {
+		return s.c.Rescan()
+	}))
+	mux.HandleFunc("/api/pause", s.post(http.StatusNoContent, func(r *http.Request) error {
+		s.c.Pause()
+		return nil
+	}))
+	mux.HandleFunc("/api/resume", s.post(http.StatusNoContent, func(r *http.Request) error {
+		s.c.Resume()
+		return nil
+	}))
+	mux.HandleFunc("/api/reload", s.post(http.StatusNoContent, func(r *http.Request) error {
+		return s.c.Reload()
+	}))
+	mux.HandleFunc("/api/requeue", s.post(http.StatusAccepted, func(r *http.Request) error {
+		path, err := pathParam(r)
+		if err != nil {
+			return err
+		}
+		return s.c.Requeue(path)
+	}))
+	mux.HandleFunc("/api/reencode", s.post(http.StatusAccepted, func(r *http.Request) error {
+		path, err := pathParam(r)
+		if err != nil {
+			return err
+		}
+		return s.c.Reencode(path)
+	}))
+	mux.HandleFunc("/api/cancel", s.post(http.StatusNoContent, func(r *http.Request) error {
+		v := r.FormValue("id")
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return BadRequest{errors.Errorf("invalid id %q", v)}
+		}
+		return s.c.Cancel(id)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.checkHost(r); err != nil {
+			s.log.Warn("Rejected", "path", r.URL.Path, "host", r.Host, "error", err)
+			s.writeError(w, http.StatusForbidden, err)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// checkHost returns an error if the request isn't for the server's own host,
+// which keeps web pages from reaching a TCP address through DNS rebinding: the
+// page would be of the same origin, but its Host is its own domain. Requests
+// over a Unix socket can't come from a web page.
+func (s *Server) checkHost(r *http.Request) error {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+
+	switch {
+	case host == "localhost", host == "127.0.0.1", host == "::1":
+		return nil
+	case s.host != "" && host == s.host:
+		return nil
+	default:
+		return errors.Errorf("unexpected host %q", r.Host)
+	}
+}
+
+// pathParam returns the path parameter of the request, which is required.
+func pathParam(r *http.Request) (string, error) {
+	path := r.FormValue("path")
+	if path == "" {
+		return "", BadRequest{errors.New("missing path")}
+	}
+	return path, nil
+}
+
+// get returns a handler that writes the value returned by fn as JSON.
+func (s *Server) get(fn func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			s.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		v, err := fn(r)
+		if err != nil {
+			s.fail(w, r, err)
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, v)
+	}
+}
+
+// actionHeader must be set on every action, which keeps other web pages from
+// sending them: browsers only let pages of the same origin set it.
+const actionHeader = "X-Requested-With"
+
+// post returns a handler that runs the action fn and responds with the given
+// status code.
+func (s *Server) post(code int, fn func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			s.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		if err := checkOrigin(r); err != nil {
+			s.log.Warn("Rejected", "path", r.URL.Path, "origin", r.Header.Get("Origin"), "error", err)
+			s.writeError(w, http.StatusForbidden, err)
+			return
+		}
+
+		if err := fn(r); err != nil {
+			s.fail(w, r, err)
+			return
+		}
+
+		s.log.Info("Handled", "path", r.URL.Path)
+		w.WriteHeader(code)
+	}
+}
+
+// checkOrigin returns an error if the request may come from another web page.
+func checkOrigin(r *http.Request) error {
+	if r.Header.Get(actionHeader) == "" {
+		return errors.Errorf("missing %s header", actionHeader)
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return errors.Errorf("cross-origin request from %q", origin)
+		}
+	}
+
+	return nil
+}
+
+// fail writes the error with the status code matching it.
+func (s *Server) fail(w http.ResponseWriter, r *http.Request, err error) {
+	var code = http.StatusInternalServerError
+
+	switch err.(type) {
+	case BadRequest:
+		code = http.StatusBadRequest
+	default:
+		if err == ErrNotFound {
+			code = http.StatusNotFound
+		}
+	}
+
+	if code == http.StatusInternalServerError {
+		s.log.Error("Request failed", "path", r.URL.Path, "error", err)
+	}
+
+	s.writeError(w, code, err)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, code int, err error) {
+	s.writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.log.Debug("Failed to write the response", "error", err)
+	}
+}
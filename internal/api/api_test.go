@@ -0,0 +1,257 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diamondburned/ffsync/internal/logger"
+	"github.com/pkg/errors"
+)
+
+type fakeController struct {
+	paused   bool
+	requeued []string
+	canceled []uint64
+}
+
+func (f *fakeController) Status() (Status, error) {
+	return Status{Source: "/src", Paused: f.paused, Outputs: 2}, nil
+}
+
+func (f *fakeController) Jobs() []Job {
+	return []Job{{ID: 1, Action: "convert", Src: "/src/a.flac", Running: true, Percentage: 50}}
+}
+
+func (f *fakeController) Failures(limit int) (Failures, error) {
+	return Failures{}, errors.Errorf("limit %d", limit)
+}
+
+func (f *fakeController) Rescan() error { return nil }
+func (f *fakeController) Pause()        { f.paused = true }
+func (f *fakeController) Resume()       { f.paused = false }
+func (f *fakeController) Reload() error { return nil }
+
+func (f *fakeController) Requeue(path string) error {
+	if !strings.HasPrefix(path, "/src/") {
+		return BadRequest{errors.New("not in the source")}
+	}
+	f.requeued = append(f.requeued, path)
+	return nil
+}
+
+func (f *fakeController) Cancel(id uint64) error {
+	if id != 1 {
+		return ErrNotFound
+	}
+	f.canceled = append(f.canceled, id)
+	return nil
+}
+
+func (f *fakeController) Reencode(path string) error { return nil }
+
+func TestHandler(t *testing.T) {
+	var c = &fakeController{}
+	var s = &Server{c: c, log: logger.New(ioutil.Discard, logger.Config{})}
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	do := func(method, path string, form url.Values) (int, map[string]interface{}) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Requested-With", "test")
+
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		return r.StatusCode, body
+	}
+
+	var tests = []struct {
+		method string
+		path   string
+		form   url.Values
+		code   int
+	}{
+		{"POST", "/api/pause", nil, http.StatusNoContent},
+		{"POST", "/api/requeue", url.Values{"path": {"/src/album"}}, http.StatusAccepted},
+		{"POST", "/api/requeue", url.Values{"path": {"/etc"}}, http.StatusBadRequest},
+		{"POST", "/api/requeue", nil, http.StatusBadRequest},
+		{"POST", "/api/cancel", url.Values{"id": {"1"}}, http.StatusNoContent},
+		{"POST", "/api/cancel", url.Values{"id": {"2"}}, http.StatusNotFound},
+		{"POST", "/api/cancel", url.Values{"id": {"one"}}, http.StatusBadRequest},
+		{"GET", "/api/pause", nil, http.StatusMethodNotAllowed},
+		{"POST", "/api/status", nil, http.StatusMethodNotAllowed},
+		{"GET", "/api/failures?limit=0", nil, http.StatusBadRequest},
+		{"GET", "/api/failures?limit=5", nil, http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		code, body := do(test.method, test.path, test.form)
+		if code != test.code {
+			t.Errorf("%s %s %v: expected %d, got %d", test.method, test.path, test.form, test.code, code)
+		}
+		if code >= 400 && body["error"] == nil {
+			t.Errorf("%s %s: missing error in %v", test.method, test.path, body)
+		}
+	}
+
+	code, body := do("GET", "/api/status", nil)
+	if code != http.StatusOK || body["paused"] != true || body["source"] != "/src" {
+		t.Errorf("Unexpected status %d: %v", code, body)
+	}
+
+	if len(c.requeued) != 1 || c.requeued[0] != "/src/album" {
+		t.Errorf("Unexpected requeued paths: %v", c.requeued)
+	}
+	if len(c.canceled) != 1 {
+		t.Errorf("Unexpected canceled jobs: %v", c.canceled)
+	}
+}
+
+func TestServerSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffsync-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var sock = filepath.Join(dir, "api.sock")
+
+	// A stale socket left by a previous run.
+	if err := ioutil.WriteFile(sock, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(Config{Address: sock}, &fakeController{}, logger.New(ioutil.Discard, logger.Config{}))
+	if err != nil {
+		t.Fatal("Failed to start the server:", err)
+	}
+	defer s.Close()
+
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+
+	r, err := client.Get("http://ffsync/api/jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+
+	var jobs []Job
+	if err := json.NewDecoder(r.Body).Decode(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != 1 || !jobs[0].Running {
+		t.Errorf("Unexpected jobs: %+v", jobs)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	var s = &Server{c: &fakeController{}, log: logger.New(ioutil.Discard, logger.Config{})}
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	for _, path := range []string{"/", "/dashboard.js", "/dashboard.css"} {
+		r, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+
+		if r.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", path, r.StatusCode)
+		}
+	}
+}
+
+func TestCrossSite(t *testing.T) {
+	var c = &fakeController{}
+	var s = &Server{c: c, log: logger.New(ioutil.Discard, logger.Config{})}
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	var tests = []struct {
+		name   string
+		header map[string]string
+		code   int
+	}{
+		{"form", nil, http.StatusForbidden},
+		{"other origin", map[string]string{"X-Requested-With": "x", "Origin": "http://evil.example"}, http.StatusForbidden},
+		{"same origin", map[string]string{"X-Requested-With": "x", "Origin": srv.URL}, http.StatusNoContent},
+		{"no origin", map[string]string{"X-Requested-With": "x"}, http.StatusNoContent},
+		{"rebound host", map[string]string{"X-Requested-With": "x", "Host": "evil.example"}, http.StatusForbidden},
+		{"localhost", map[string]string{"X-Requested-With": "x", "Host": "localhost:8420"}, http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", srv.URL+"/api/pause", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range test.header {
+			req.Header.Set(k, v)
+		}
+		if host := test.header["Host"]; host != "" {
+			req.Host = host
+		}
+
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+
+		if r.StatusCode != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, r.StatusCode)
+		}
+		if paused := r.StatusCode == http.StatusNoContent; c.paused != paused {
+			t.Errorf("%s: expected paused %v", test.name, paused)
+		}
+		c.paused = false
+	}
+
+	// Reading is rejected for other hosts as well.
+	req, err := http.NewRequest("GET", srv.URL+"/api/status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "evil.example"
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	if r.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a status of another host to be forbidden, got %d", r.StatusCode)
+	}
+}
@@ -0,0 +1,19 @@
+package api
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed dashboard
+var dashboardFS embed.FS
+
+// dashboard serves the web dashboard, which only talks to the API.
+func dashboard() http.Handler {
+	sub, err := fs.Sub(dashboardFS, "dashboard")
+	if err != nil {
+		panic(err) // the directory is embedded
+	}
+	return http.FileServer(http.FS(sub))
+}
@@ -0,0 +1,196 @@
+"use strict";
+
+// refreshEvery is how often the dashboard polls the API, in milliseconds.
+const refreshEvery = 2000;
+
+// source is the source tree, which is trimmed from the paths shown.
+let source = "";
+
+const $ = (id) => document.getElementById(id);
+
+async function get(path) {
+	const r = await fetch(path);
+	const body = await r.json();
+	if (!r.ok) {
+		throw new Error(body.error);
+	}
+	return body;
+}
+
+async function post(path, params) {
+	const r = await fetch(path, {
+		method: "POST",
+		headers: { "X-Requested-With": "ffsync" },
+		body: new URLSearchParams(params),
+	});
+	if (!r.ok) {
+		const body = await r.json();
+		throw new Error(body.error);
+	}
+}
+
+// name returns the path relative to the source tree.
+function name(path) {
+	if (source && path.startsWith(source + "/")) {
+		return path.slice(source.length + 1);
+	}
+	return path;
+}
+
+function bytes(n) {
+	const units = ["B", "KB", "MB", "GB", "TB"];
+	let i = 0;
+	for (; n >= 1024 && i < units.length - 1; i++) {
+		n /= 1024;
+	}
+	return `${n.toFixed(i > 0 ? 1 : 0)} ${units[i]}`;
+}
+
+function since(time) {
+	const s = Math.max(0, Math.round((Date.now() - new Date(time)) / 1000));
+	if (s < 60) return `${s}s ago`;
+	if (s < 3600) return `${Math.round(s / 60)}m ago`;
+	if (s < 86400) return `${Math.round(s / 3600)}h ago`;
+	return `${Math.round(s / 86400)}d ago`;
+}
+
+function clone(id) {
+	return $(id).content.firstElementChild.cloneNode(true);
+}
+
+function renderStatus(st) {
+	source = st.source;
+	$("destination").textContent = st.destination;
+
+	const state = $("state");
+	if (st.paused) {
+		state.textContent = "Paused";
+		state.className = "state busy";
+	} else if (st.running + st.queued + st.retrying > 0) {
+		state.textContent = "Syncing…";
+		state.className = "state busy";
+	} else if (st.dead_letters > 0) {
+		state.textContent = "Some files failed";
+		state.className = "state bad";
+	} else {
+		state.textContent = "Up to date";
+		state.className = "state ok";
+	}
+
+	const stats = [
+		["Files", st.outputs],
+		["Running", st.running],
+		["Waiting", st.queued],
+		["Retrying", st.retrying],
+		["Failed", st.dead_letters],
+		["Done today", st.recent.jobs - st.recent.failed],
+		["Saved today", bytes(st.recent.saved_bytes)],
+		["Profile", st.profile],
+	];
+
+	$("stats").replaceChildren(...stats.map(([label, value]) => {
+		const div = document.createElement("div");
+		const dt = document.createElement("dt");
+		const dd = document.createElement("dd");
+		dt.textContent = label;
+		dd.textContent = value;
+		div.append(dt, dd);
+		return div;
+	}));
+}
+
+function renderJobs(jobs) {
+	$("jobs-empty").hidden = jobs.length > 0;
+
+	// Running jobs go first.
+	jobs.sort((a, b) => (b.running - a.running) || (a.id - b.id));
+
+	$("jobs").replaceChildren(...jobs.map((job) => {
+		const li = clone("job");
+		li.querySelector(".name").textContent = `${job.action} ${name(job.src)}`;
+
+		const progress = li.querySelector("progress");
+		const detail = li.querySelector(".detail");
+
+		if (!job.running) {
+			progress.hidden = true;
+			detail.textContent = `Waiting since ${since(job.queued)}`;
+		} else if (job.action === "convert") {
+			progress.value = job.percentage || 0;
+			detail.textContent = `${Math.floor(job.percentage || 0)}%, ` +
+				`${(job.speed || 0).toFixed(1)}× speed, ${bytes(job.wrote_bytes || 0)} written`;
+		} else {
+			progress.removeAttribute("value");
+			detail.textContent = `Started ${since(job.started)}`;
+		}
+
+		return li;
+	}));
+}
+
+function renderFailures(f) {
+	// Dead-lettered files aren't retried anymore, so they're shown first. Other
+	// failures are only shown once per file.
+	const items = f.dead_letters.map((e) => ({
+		src: e.src,
+		action: e.action,
+		error: e.error,
+		detail: `Gave up after ${e.attempts} attempt(s), ${since(e.time)}`,
+	}));
+
+	const seen = new Set(items.map((item) => item.src));
+	for (const r of f.recent) {
+		if (!seen.has(r.src)) {
+			seen.add(r.src);
+			items.push({ src: r.src, action: r.action, error: r.error, detail: `Failed ${since(r.time)}` });
+		}
+	}
+
+	$("failures-empty").hidden = items.length > 0;
+
+	$("failures").replaceChildren(...items.map((item) => {
+		const li = clone("failure");
+		li.querySelector(".name").textContent = `${item.action} ${name(item.src)}`;
+		li.querySelector(".detail").textContent = item.detail;
+		li.querySelector("pre").textContent = item.error;
+
+		const button = li.querySelector("button");
+		button.addEventListener("click", () => action(button, "/api/requeue", { path: item.src }));
+
+		return li;
+	}));
+}
+
+// action runs the action behind the button, which is disabled meanwhile.
+async function action(button, path, params) {
+	button.disabled = true;
+	try {
+		await post(path, params);
+		await refresh();
+	} catch (err) {
+		alert(`Failed: ${err.message}`);
+	} finally {
+		button.disabled = false;
+	}
+}
+
+async function refresh() {
+	try {
+		const [st, jobs, failures] = await Promise.all([
+			get("/api/status"),
+			get("/api/jobs"),
+			get("/api/failures?limit=20"),
+		]);
+		renderStatus(st);
+		renderJobs(jobs);
+		renderFailures(failures);
+	} catch (err) {
+		$("state").textContent = `Not connected: ${err.message}`;
+		$("state").className = "state bad";
+	}
+}
+
+$("rescan").addEventListener("click", (ev) => action(ev.target, "/api/rescan", {}));
+
+refresh();
+setInterval(refresh, refreshEvery);
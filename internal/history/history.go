@@ -0,0 +1,283 @@
+// Package history keeps a local database of every finished or failed job, so
+// that past conversions can be reported on without a metrics backend.
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// lockTimeout is how long to wait for another process using the database.
+const lockTimeout = 10 * time.Second
+
+var recordsBucket = []byte("records")
+
+// Record is a job that ended.
+type Record struct {
+	Time    time.Time `json:"time"` // when the job ended
+	Action  string    `json:"action"`
+	Profile string    `json:"profile,omitempty"` // the encoder settings, such as "opus 64k"
+	Src     string    `json:"src"`
+	Dst     string    `json:"dst"`
+
+	// Duration is how long the job took, and Runtime is how long ffmpeg ran
+	// for. Encoded is the duration of the encoded audio.
+	Duration time.Duration `json:"duration"`
+	Runtime  time.Duration `json:"runtime,omitempty"`
+	Encoded  time.Duration `json:"encoded,omitempty"`
+
+	SrcSize int64   `json:"src_size,omitempty"`
+	DstSize int64   `json:"dst_size,omitempty"`
+	Speed   float32 `json:"speed,omitempty"`   // times realtime
+	Bitrate float32 `json:"bitrate,omitempty"` // kbit/s
+
+	Kind  string `json:"kind,omitempty"` // the failure reason
+	Error string `json:"error,omitempty"`
+}
+
+// Failed returns true if the job failed.
+func (r Record) Failed() bool {
+	return r.Error != ""
+}
+
+// Saved returns the number of bytes saved by converting the file instead of
+// copying it, which is 0 if the job failed.
+func (r Record) Saved() int64 {
+	if r.Failed() || r.Action != "convert" || r.DstSize == 0 {
+		return 0
+	}
+	return r.SrcSize - r.DstSize
+}
+
+// Path returns the path to the database inside the given state directory.
+func Path(stateDir string) string {
+	return filepath.Join(stateDir, "history.db")
+}
+
+// batchDelay is how long Add waits for other records to be written along.
+const batchDelay = 10 * time.Millisecond
+
+// DB is the history database. It's only opened for as long as each write or
+// query takes, so that other processes can read it while ffsync is running.
+// Records added around the same time are written together.
+type DB struct {
+	path  string
+	mutex sync.Mutex // guards the file
+
+	batchMutex sync.Mutex
+	batch      *batch
+}
+
+// batch is records being written in one transaction.
+type batch struct {
+	records []Record
+	done    chan struct{}
+	err     error
+}
+
+// Open returns the database at the given path. The file is created on the
+// first Add.
+func Open(path string) *DB {
+	return &DB{path: path}
+}
+
+// Add adds the record into the database. It returns once the record is
+// written along with the others added in the meantime.
+func (d *DB) Add(r Record) error {
+	d.batchMutex.Lock()
+	b := d.batch
+	if b == nil {
+		b = &batch{done: make(chan struct{})}
+		d.batch = b
+		time.AfterFunc(batchDelay, func() { d.flush(b) })
+	}
+	b.records = append(b.records, r)
+	d.batchMutex.Unlock()
+
+	<-b.done
+	return b.err
+}
+
+// flush writes the batch. Records added after this are put into the next one.
+func (d *DB) flush(b *batch) {
+	d.batchMutex.Lock()
+	d.batch = nil
+	d.batchMutex.Unlock()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	b.err = d.write(b.records)
+	close(b.done)
+}
+
+func (d *DB) write(records []Record) error {
+	if err := os.MkdirAll(filepath.Dir(d.path), os.ModePerm); err != nil {
+		return errors.Wrap(err, "failed to mkdir -p state directory")
+	}
+
+	db, err := bolt.Open(d.path, 0644, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return errors.Wrap(err, "failed to open history")
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(recordsBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range records {
+			v, err := json.Marshal(r)
+			if err != nil {
+				return errors.Wrap(err, "failed to encode record")
+			}
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key(r.Time, seq), v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// key returns the key of a record, which sorts records by time.
+func key(t time.Time, seq uint64) []byte {
+	var k [16]byte
+	binary.BigEndian.PutUint64(k[:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k[:]
+}
+
+// Filter selects records. The zero value selects every record.
+type Filter struct {
+	Since  time.Time // inclusive; zero for the beginning
+	Until  time.Time // exclusive; zero for now
+	Action string    // "copy" or "convert"; empty for both
+	Failed bool      // only failed jobs
+}
+
+func (f Filter) match(r Record) bool {
+	return (f.Action == "" || r.Action == f.Action) && (!f.Failed || r.Failed())
+}
+
+// Query returns the records selected by the filter sorted by time.
+func (d *DB) Query(f Filter) ([]Record, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, err := os.Stat(d.path); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	db, err := bolt.Open(d.path, 0644, &bolt.Options{Timeout: lockTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open history")
+	}
+	defer db.Close()
+
+	var records []Record
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(recordsBucket)
+		if b == nil {
+			return nil
+		}
+
+		var until []byte
+		if !f.Until.IsZero() {
+			until = key(f.Until, 0)
+		}
+
+		c := b.Cursor()
+
+		// The zero time doesn't fit in a key, so start from the first record.
+		var k, v []byte
+		if f.Since.IsZero() {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(key(f.Since, 0))
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			if until != nil && string(k) >= string(until) {
+				break
+			}
+
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return errors.Wrap(err, "failed to decode record")
+			}
+			if f.match(r) {
+				records = append(records, r)
+			}
+		}
+
+		return nil
+	})
+
+	return records, err
+}
+
+// Summary is the totals of some records.
+type Summary struct {
+	Jobs     int           `json:"jobs"`
+	Failed   int           `json:"failed"`
+	SrcBytes int64         `json:"src_bytes"`
+	DstBytes int64         `json:"dst_bytes"`
+	Saved    int64         `json:"saved_bytes"` // by converting
+	Duration time.Duration `json:"duration"`
+}
+
+// Summarize adds up the records.
+func Summarize(records []Record) Summary {
+	var s Summary
+
+	for _, r := range records {
+		s.Jobs++
+		s.Duration += r.Duration
+
+		if r.Failed() {
+			s.Failed++
+			continue
+		}
+
+		s.SrcBytes += r.SrcSize
+		s.DstBytes += r.DstSize
+		s.Saved += r.Saved()
+	}
+
+	return s
+}
+
+// Slowest returns the n successful jobs that took the longest, slowest first.
+func Slowest(records []Record, n int) []Record {
+	var slowest = make([]Record, 0, len(records))
+	for _, r := range records {
+		if !r.Failed() {
+			slowest = append(slowest, r)
+		}
+	}
+
+	sort.SliceStable(slowest, func(i, j int) bool {
+		return slowest[i].Duration > slowest[j].Duration
+	})
+
+	if len(slowest) > n {
+		slowest = slowest[:n]
+	}
+	return slowest
+}
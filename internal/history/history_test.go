@@ -0,0 +1,123 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffsync-history-")
+	if err != nil {
+		t.Fatal("Failed to create tmpdir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := Open(Path(filepath.Join(dir, ".ffsync")))
+
+	records, err := d.Query(Filter{})
+	if err != nil || len(records) != 0 {
+		t.Fatalf("Expected no records before the first Add, got %v, %v", records, err)
+	}
+
+	var now = time.Now()
+
+	var added = []Record{
+		{Time: now.Add(-10 * 24 * time.Hour), Action: "convert", Src: "old.flac", SrcSize: 1000, DstSize: 100, Duration: time.Second},
+		{Time: now.Add(-2 * time.Hour), Action: "convert", Src: "a.flac", SrcSize: 500, DstSize: 50, Duration: 3 * time.Second},
+		{Time: now.Add(-time.Hour), Action: "convert", Src: "b.flac", Error: "oops", Kind: "corrupt input"},
+		{Time: now, Action: "copy", Src: "cover.jpg", SrcSize: 10, DstSize: 10, Duration: 2 * time.Second},
+	}
+	for _, r := range added {
+		if err := d.Add(r); err != nil {
+			t.Fatal("Failed to add:", err)
+		}
+	}
+
+	var week = Filter{Since: now.Add(-7 * 24 * time.Hour)}
+
+	records, err = d.Query(week)
+	if err != nil {
+		t.Fatal("Failed to query:", err)
+	}
+	if len(records) != 3 || records[0].Src != "a.flac" {
+		t.Fatalf("Unexpected records of the last week: %+v", records)
+	}
+
+	s := Summarize(records)
+	if s.Jobs != 3 || s.Failed != 1 || s.Saved != 450 || s.DstBytes != 60 {
+		t.Errorf("Unexpected summary: %+v", s)
+	}
+
+	slowest := Slowest(records, 1)
+	if len(slowest) != 1 || slowest[0].Src != "a.flac" {
+		t.Errorf("Unexpected slowest: %+v", slowest)
+	}
+
+	week.Failed = true
+
+	failed, err := d.Query(week)
+	if err != nil {
+		t.Fatal("Failed to query:", err)
+	}
+	if len(failed) != 1 || failed[0].Kind != "corrupt input" {
+		t.Errorf("Unexpected failures: %+v", failed)
+	}
+
+	copies, err := d.Query(Filter{Action: "copy", Until: now})
+	if err != nil {
+		t.Fatal("Failed to query:", err)
+	}
+	if len(copies) != 0 {
+		t.Errorf("Expected Until to be exclusive, got %+v", copies)
+	}
+
+	all, err := d.Query(Filter{})
+	if err != nil {
+		t.Fatal("Failed to query:", err)
+	}
+	if len(all) != len(added) || all[0].Src != "old.flac" {
+		t.Errorf("Expected the zero filter to select every record, got %+v", all)
+	}
+
+	older, err := d.Query(Filter{Until: now.Add(-time.Hour)})
+	if err != nil {
+		t.Fatal("Failed to query:", err)
+	}
+	if len(older) != 2 || older[1].Src != "a.flac" {
+		t.Errorf("Unexpected records until an hour ago: %+v", older)
+	}
+}
+
+func TestDBConcurrentAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffsync-history-")
+	if err != nil {
+		t.Fatal("Failed to create tmpdir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := Open(Path(dir))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.Add(Record{Time: time.Now(), Action: "copy"}); err != nil {
+				t.Error("Failed to add:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	records, err := d.Query(Filter{})
+	if err != nil {
+		t.Fatal("Failed to query:", err)
+	}
+	if len(records) != 100 {
+		t.Errorf("Expected 100 records, got %d", len(records))
+	}
+}
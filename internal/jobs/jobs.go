@@ -0,0 +1,128 @@
+// Package jobs keeps track of the live state of queued and running jobs.
+package jobs
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/ffsync/ffmpeg"
+)
+
+// Job is the state of a single queued or running job.
+type Job struct {
+	ID       uint64
+	Action   string // such as "convert"
+	Src      string
+	Dst      string
+	Queued   time.Time
+	Started  time.Time // zero while queued
+	Updated  time.Time // last progress update
+	Progress ffmpeg.Progress
+
+	cancel func()
+}
+
+// Running returns true if the job holds a worker.
+func (j Job) Running() bool {
+	return !j.Started.IsZero()
+}
+
+// Stalled returns true if the job hasn't made progress for the given duration.
+func (j Job) Stalled(now time.Time, window time.Duration) bool {
+	return now.Sub(j.Updated) > window
+}
+
+// Tracker tracks queued and running jobs. The zero value is ready to use.
+type Tracker struct {
+	mutex sync.Mutex
+	jobs  map[uint64]*Job
+	last  uint64
+}
+
+// Queue starts tracking a job waiting for a worker. The returned ID is given
+// to the other methods, and cancel is called when the job is canceled. Done
+// must be called once the job is finished.
+func (t *Tracker) Queue(action, src, dst string, cancel func()) uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.jobs == nil {
+		t.jobs = map[uint64]*Job{}
+	}
+
+	t.last++
+	t.jobs[t.last] = &Job{
+		ID:     t.last,
+		Action: action,
+		Src:    src,
+		Dst:    dst,
+		Queued: time.Now(),
+		cancel: cancel,
+	}
+
+	return t.last
+}
+
+// Start marks the job as running.
+func (t *Tracker) Start(id uint64) {
+	var now = time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if job, ok := t.jobs[id]; ok {
+		job.Started = now
+		job.Updated = now
+	}
+}
+
+// Progress returns the function to be passed to ffmpeg.WithProgress.
+func (t *Tracker) Progress(id uint64) ffmpeg.ProgressFunc {
+	return func(p ffmpeg.Progress) {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		if job, ok := t.jobs[id]; ok {
+			job.Progress = p
+			job.Updated = time.Now()
+		}
+	}
+}
+
+// Done stops tracking the job.
+func (t *Tracker) Done(id uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.jobs, id)
+}
+
+// Cancel cancels the job. False is returned if there's no such job.
+func (t *Tracker) Cancel(id uint64) bool {
+	t.mutex.Lock()
+	job, ok := t.jobs[id]
+	t.mutex.Unlock()
+
+	if ok {
+		job.cancel()
+	}
+	return ok
+}
+
+// Snapshot returns a copy of all jobs, sorted by the time they were queued.
+func (t *Tracker) Snapshot() []Job {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var jobs = make([]Job, 0, len(t.jobs))
+	for _, job := range t.jobs {
+		jobs = append(jobs, *job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID < jobs[j].ID
+	})
+
+	return jobs
+}
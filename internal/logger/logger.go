@@ -0,0 +1,307 @@
+// Package logger implements a leveled logger that writes structured lines,
+// either as logfmt-like text or as JSON.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Level int8
+
+const (
+	Debug Level = iota - 1
+	Info
+	Warn
+	Error
+)
+
+var levelNames = map[Level]string{
+	Debug: "debug",
+	Info:  "info",
+	Warn:  "warn",
+	Error: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("Level(%d)", l)
+}
+
+// syslog returns the syslog priority of the level, which journald reads from
+// the line prefix.
+func (l Level) syslog() int {
+	switch l {
+	case Debug:
+		return 7
+	case Info:
+		return 6
+	case Warn:
+		return 4
+	default:
+		return 3
+	}
+}
+
+// ParseLevel parses the level name.
+func ParseLevel(name string) (Level, error) {
+	for level, n := range levelNames {
+		if n == name {
+			return level, nil
+		}
+	}
+	return 0, errors.Errorf("unknown log level %q", name)
+}
+
+type Format string
+
+const (
+	// Text writes logfmt-like lines: key=value pairs after the message.
+	Text Format = "text"
+	// JSON writes a JSON object per line.
+	JSON Format = "json"
+)
+
+// ParseFormat parses the format name. An empty name is Text.
+func ParseFormat(name string) (Format, error) {
+	switch Format(name) {
+	case "", Text:
+		return Text, nil
+	case JSON:
+		return JSON, nil
+	default:
+		return "", errors.Errorf("unknown log format %q", name)
+	}
+}
+
+// Config is the verbosity and format of the logs.
+type Config struct {
+	Format Format
+	Level  Level
+	// Levels overrides the level of some components.
+	Levels map[string]Level
+	// Journal prefixes text lines with their syslog priority and leaves out
+	// the time, which journald adds by itself.
+	Journal bool
+}
+
+// ParseLevels parses a comma-separated list of levels, such as
+// "info,sync=debug". Entries without a component set the default level.
+func (c *Config) ParseLevels(s string) error {
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+
+		level, err := ParseLevel(parts[len(parts)-1])
+		if err != nil {
+			return err
+		}
+
+		if len(parts) == 1 {
+			c.Level = level
+			continue
+		}
+
+		if c.Levels == nil {
+			c.Levels = map[string]Level{}
+		}
+		c.Levels[parts[0]] = level
+	}
+
+	return nil
+}
+
+// output is the destination shared by a logger and the loggers derived from
+// it.
+type output struct {
+	mutex sync.Mutex
+	w     io.Writer
+	cfg   Config
+}
+
+// Logger writes leveled lines with fields. A nil Logger writes to Default.
+type Logger struct {
+	out       *output
+	component string
+	fields    []interface{} // key-value pairs
+}
+
+// Default writes text lines of info and above to stderr.
+var Default = New(os.Stderr, Config{Format: Text, Level: Info})
+
+// New creates a logger that writes to w.
+func New(w io.Writer, cfg Config) *Logger {
+	return &Logger{out: &output{w: w, cfg: cfg}}
+}
+
+func (l *Logger) orDefault() *Logger {
+	if l == nil {
+		return Default
+	}
+	return l
+}
+
+// Component returns a logger for the named component, whose level may be
+// overridden.
+func (l *Logger) Component(name string) *Logger {
+	l = l.orDefault()
+	return &Logger{out: l.out, component: name, fields: l.fields}
+}
+
+// With returns a logger that adds the given key-value pairs to every line.
+func (l *Logger) With(kvs ...interface{}) *Logger {
+	l = l.orDefault()
+
+	fields := make([]interface{}, 0, len(l.fields)+len(kvs))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kvs...)
+
+	return &Logger{out: l.out, component: l.component, fields: fields}
+}
+
+// Enabled returns true if lines of the level are written.
+func (l *Logger) Enabled(level Level) bool {
+	l = l.orDefault()
+
+	min := l.out.cfg.Level
+	if override, ok := l.out.cfg.Levels[l.component]; ok {
+		min = override
+	}
+	return level >= min
+}
+
+func (l *Logger) Debug(msg string, kvs ...interface{}) { l.Log(Debug, msg, kvs...) }
+func (l *Logger) Info(msg string, kvs ...interface{})  { l.Log(Info, msg, kvs...) }
+func (l *Logger) Warn(msg string, kvs ...interface{})  { l.Log(Warn, msg, kvs...) }
+func (l *Logger) Error(msg string, kvs ...interface{}) { l.Log(Error, msg, kvs...) }
+
+// Log writes a line with the message and the key-value pairs, which follow the
+// logger's own.
+func (l *Logger) Log(level Level, msg string, kvs ...interface{}) {
+	l = l.orDefault()
+	if !l.Enabled(level) {
+		return
+	}
+
+	var fields = make([]interface{}, 0, len(l.fields)+len(kvs))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kvs...)
+
+	var buf bytes.Buffer
+	var now = time.Now()
+
+	switch l.out.cfg.Format {
+	case JSON:
+		l.writeJSON(&buf, now, level, msg, fields)
+	default:
+		l.writeText(&buf, now, level, msg, fields)
+	}
+
+	l.out.mutex.Lock()
+	l.out.w.Write(buf.Bytes())
+	l.out.mutex.Unlock()
+}
+
+// Fatal writes an error line, then exits.
+func (l *Logger) Fatal(msg string, kvs ...interface{}) {
+	l.Log(Error, msg, kvs...)
+	os.Exit(1)
+}
+
+func (l *Logger) writeText(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []interface{}) {
+	if l.out.cfg.Journal {
+		fmt.Fprintf(buf, "<%d>", level.syslog())
+	} else {
+		buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+		buf.WriteString(strings.ToUpper(level.String()))
+		buf.WriteByte(' ')
+	}
+
+	if l.component != "" {
+		buf.WriteString("[" + l.component + "] ")
+	}
+	buf.WriteString(msg)
+
+	eachField(fields, func(k string, v interface{}) {
+		buf.WriteByte(' ')
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(textValue(v))
+	})
+
+	buf.WriteByte('\n')
+}
+
+func (l *Logger) writeJSON(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []interface{}) {
+	var obj = map[string]interface{}{
+		"time":  now.Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   msg,
+	}
+	if l.component != "" {
+		obj["component"] = l.component
+	}
+
+	eachField(fields, func(k string, v interface{}) {
+		switch v := v.(type) {
+		case error:
+			obj[k] = v.Error()
+		case time.Duration:
+			obj[k] = v.Seconds()
+		case fmt.Stringer:
+			obj[k] = v.String()
+		default:
+			obj[k] = v
+		}
+	})
+
+	if err := json.NewEncoder(buf).Encode(obj); err != nil {
+		buf.Reset()
+		fmt.Fprintf(buf, `{"level":"error","msg":"failed to encode log line: %s"}`+"\n", err)
+	}
+}
+
+// eachField calls fn with each key-value pair. A key without a value is kept
+// with a nil value.
+func eachField(kvs []interface{}, fn func(string, interface{})) {
+	for i := 0; i < len(kvs); i += 2 {
+		k := fmt.Sprint(kvs[i])
+		if i+1 < len(kvs) {
+			fn(k, kvs[i+1])
+		} else {
+			fn(k, nil)
+		}
+	}
+}
+
+// textValue formats the value, quoting it if it has spaces or quotes.
+func textValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,81 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLevels(t *testing.T) {
+	var cfg Config
+	if err := cfg.ParseLevels("warn, sync=debug,ffmpeg=error"); err != nil {
+		t.Fatal("Failed to parse levels:", err)
+	}
+
+	var buf bytes.Buffer
+	l := New(&buf, cfg)
+
+	l.Info("dropped")
+	l.Warn("kept")
+	l.Component("sync").Debug("kept")
+	l.Component("ffmpeg").Warn("dropped")
+	l.Component("ffmpeg").Error("kept")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %q", lines)
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "kept") {
+			t.Errorf("Unexpected line %q", line)
+		}
+	}
+
+	if err := cfg.ParseLevels("loud"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
+
+func TestText(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, Config{Journal: true}).Component("sync").With("src", "a b.flac")
+
+	l.Error("Failed", "error", errors.New("oops"), "attempt", 2)
+
+	const expected = `<3>[sync] Failed src="a b.flac" error=oops attempt=2` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, Config{Format: JSON, Level: Debug}).Component("ffmpeg")
+
+	l.Debug("Finished", "src", "a.flac", "duration", 1500*time.Millisecond, "error", errors.New("oops"))
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal("Failed to decode line:", err)
+	}
+
+	expected := map[string]interface{}{
+		"level":     "debug",
+		"msg":       "Finished",
+		"component": "ffmpeg",
+		"src":       "a.flac",
+		"duration":  1.5,
+		"error":     "oops",
+	}
+	for k, v := range expected {
+		if line[k] != v {
+			t.Errorf("Expected %s to be %v, got %v", k, v, line[k])
+		}
+	}
+	if _, ok := line["time"]; !ok {
+		t.Error("Missing time")
+	}
+}
@@ -3,49 +3,192 @@ package osutil
 import (
 	"context"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/diamondburned/ffsync/internal/logger"
 	"github.com/pkg/errors"
 )
 
-// Copy copies file src to dst.
+// StateDir returns the directory inside the destination where ffsync keeps its
+// own state. It is hidden, so it's never mistaken for synchronized files.
+func StateDir(dst string) string {
+	return filepath.Join(dst, ".ffsync")
+}
+
+// Copier copies files. The zero value is ready to use.
+type Copier struct {
+	// Strategy is how files are copied. The default is Hardlink.
+	Strategy Strategy
+	// Durable makes copies synced to disk before they're renamed into place,
+	// so that a crash never leaves a file that looks complete but isn't.
+	Durable bool
+	// Preserve is applied to copies before they're renamed into place.
+	Preserve Preserve
+	// Log logs the fallbacks from one way of copying to another.
+	Log *logger.Logger
+}
+
+// Copy copies file src to dst using the zero value Copier.
 func Copy(ctx context.Context, src, dst string) error {
-	// Attempt to hard link for performance.
-	if err := os.Link(src, dst); err == nil {
-		return nil
+	return Copier{}.Copy(ctx, src, dst)
+}
+
+// Copy copies file src to dst using the Copier's strategy. An existing dst is
+// atomically replaced.
+func (c Copier) Copy(ctx context.Context, src, dst string) error {
+	switch c.Strategy.orDefault() {
+	case Hardlink:
+		// Attempt to hard link for performance.
+		err := c.linkAtomic(os.Link, src, dst)
+		if err == nil {
+			return nil
+		}
+		c.Log.Debug("Failed to hard link, copying instead", "src", src, "dst", dst, "error", err)
+	case Symlink:
+		abs, err := filepath.Abs(src)
+		if err != nil {
+			return errors.Wrap(err, "failed to get the absolute path for src")
+		}
+		return c.linkAtomic(os.Symlink, abs, dst)
 	}
 
-	return slowCopy(ctx, src, dst)
+	return c.copyAtomic(ctx, src, dst)
+}
+
+// tmpPath returns the path to a temporary file, which is the same path but with
+// a dot prepended to the filename, like what ffmpeg.ExecuteCtx does.
+func tmpPath(dst string) string {
+	return filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst))
 }
 
-// slowCopy force copies the content of a file.
-func slowCopy(ctx context.Context, src, dst string) error {
+// linkAtomic links src to a temporary file using the given link function, then
+// renames it to dst.
+func (c Copier) linkAtomic(link func(src, dst string) error, src, dst string) error {
+	tmpdst := tmpPath(dst)
+
+	// Clean up whatever was left from before, since link won't override it.
+	os.Remove(tmpdst)
+
+	if err := link(src, tmpdst); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpdst, dst); err != nil {
+		os.Remove(tmpdst)
+		return errors.Wrap(err, "failed to rename dst")
+	}
+
+	if c.Durable {
+		if err := syncDir(filepath.Dir(dst)); err != nil {
+			return errors.Wrap(err, "failed to sync dst directory")
+		}
+	}
+
+	return nil
+}
+
+// copyChunk is the size of each chunk copied before checking the context.
+const copyChunk = 32 << 20 // 32MB
+
+// copyAtomic copies the content of a file into a temporary file, which is then
+// renamed to dst. The file is reflinked if possible; otherwise, the kernel does
+// the copying with copy_file_range if it can.
+func (c Copier) copyAtomic(ctx context.Context, src, dst string) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return errors.Wrap(err, "failed to open src")
 	}
 	defer srcFile.Close()
 
-	dstFile, err := os.Create(dst)
+	tmpdst := tmpPath(dst)
+
+	// The source's mode is only applied if it's preserved.
+	dstFile, err := os.OpenFile(tmpdst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return errors.Wrap(err, "failed to create dst")
 	}
-	defer dstFile.Close()
 
-	if t, ok := ctx.Deadline(); ok {
-		srcFile.SetDeadline(t)
-		dstFile.SetDeadline(t)
+	if err := c.copyFile(ctx, dstFile, srcFile); err != nil {
+		dstFile.Close()
+		os.Remove(tmpdst)
+		return err
 	}
 
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return errors.Wrap(err, "failed to copy")
+	if err := dstFile.Close(); err != nil {
+		os.Remove(tmpdst)
+		return errors.Wrap(err, "failed to close dst")
+	}
+
+	if err := c.Preserve.Apply(src, tmpdst); err != nil {
+		os.Remove(tmpdst)
+		return err
+	}
+
+	if err := os.Rename(tmpdst, dst); err != nil {
+		os.Remove(tmpdst)
+		return errors.Wrap(err, "failed to rename dst")
+	}
+
+	if c.Durable {
+		// Persist the rename as well.
+		if err := syncDir(filepath.Dir(dst)); err != nil {
+			return errors.Wrap(err, "failed to sync dst directory")
+		}
+	}
+
+	return nil
+}
+
+func (c Copier) copyFile(ctx context.Context, dst, src *os.File) error {
+	// Only copy the content if reflinking isn't wanted or possible.
+	var fullCopy = c.Strategy == FullCopy
+	if !fullCopy {
+		if err := reflink(dst, src); err != nil {
+			c.Log.Debug("Failed to reflink, copying instead", "src", src.Name(), "error", err)
+			fullCopy = true
+		}
+	}
+
+	if fullCopy {
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			// io.CopyN keeps src an *os.File underneath, so the kernel can
+			// still do the copying.
+			_, err := io.CopyN(dst, src, copyChunk)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errors.Wrap(err, "failed to copy")
+			}
+		}
+	}
+
+	if c.Durable {
+		if err := dst.Sync(); err != nil {
+			return errors.Wrap(err, "failed to sync dst")
+		}
 	}
 
 	return nil
 }
 
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
 func MoveTimeout(timeout time.Duration, src, dst string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -60,10 +203,9 @@ func Move(ctx context.Context, src, dst string) error {
 		return nil
 	}
 
-	// Fall back to slow copy. Since rename wouldn't work, hard link wouldn't
-	// either.
-	if err := slowCopy(ctx, src, dst); err != nil {
-		os.Remove(dst)
+	// Fall back to copying. Since rename wouldn't work, hard link wouldn't
+	// either. Keep the mode, like rename would.
+	if err := (Copier{Preserve: Preserve{Mode: true}}).copyAtomic(ctx, src, dst); err != nil {
 		return errors.Wrap(err, "failed to copy")
 	}
 
@@ -74,27 +216,101 @@ func Move(ctx context.Context, src, dst string) error {
 	return nil
 }
 
-// RemoveAllIfEmpty removes everything in removeDir, but it removes the
-// directory as well if emptyFile's directory has nothing in it anymore.
-func RemoveAllIfEmpty(emptyFile, removeDir string) error {
-	f, err := os.Open(filepath.Dir(emptyFile))
+// MergeDir moves everything in the src directory into the dst directory, which
+// may already exist. Entries that already exist in dst are kept over the ones
+// in src, which are then removed like RemoveOutputs does: known files are put
+// into the trash, and the others are kept in src.
+func MergeDir(src, dst string, known func(string) bool, trash Trash, removed func(string)) error {
+	// Try the fast way.
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	if err := mergeDir(src, dst); err != nil {
+		return err
+	}
+
+	// Whatever is left conflicted with something in dst.
+	return RemoveOutputs(src, known, trash, removed)
+}
+
+func mergeDir(src, dst string) error {
+	entries, err := ioutil.ReadDir(src)
 	if err != nil {
-		return errors.Wrap(err, "failed to open")
+		return errors.Wrap(err, "failed to read src")
 	}
-	defer f.Close()
 
-	// It's likely this isn't a directory if we can't read it, so we can try and
-	// remove everything anyway.
-	n, err := f.Readdirnames(1)
-	if err != nil || len(n) > 0 {
-		return os.RemoveAll(removeDir)
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return errors.Wrap(err, "failed to mkdir -p dst")
 	}
 
-	// If this is an empty directory, then remove the other one.
-	if len(n) == 0 {
-		return os.RemoveAll(filepath.Dir(removeDir))
+	for _, entry := range entries {
+		srcPath := filepath.Join(src, entry.Name())
+		dstPath := filepath.Join(dst, entry.Name())
+
+		dstInfo, err := os.Lstat(dstPath)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Rename(srcPath, dstPath); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case entry.IsDir() && dstInfo.IsDir():
+			if err := mergeDir(srcPath, dstPath); err != nil {
+				return err
+			}
+		}
 	}
 
-	// Impossible case.
 	return nil
 }
+
+// RemoveOutputs removes the file at path, or every file under it if it's a
+// directory, but only if known returns true for it. The files are put into the
+// trash, and removed is called for each of them. Directories are only removed
+// once they're empty, so unknown files are kept along with their directories.
+func RemoveOutputs(path string, known func(string) bool, trash Trash, removed func(string)) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "failed to stat")
+	}
+
+	if !info.IsDir() {
+		if !known(path) {
+			trash.Log.Debug("Keeping unknown file", "dst", path)
+			return nil
+		}
+		if err := trash.Put(path); err != nil {
+			return errors.Wrap(err, "failed to trash")
+		}
+		removed(path)
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read directory")
+	}
+
+	var firstErr error
+	for _, entry := range entries {
+		err := RemoveOutputs(filepath.Join(path, entry.Name()), known, trash, removed)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// This only works if the directory is empty now, which is fine.
+	os.Remove(path)
+
+	return firstErr
+}
+
+// SymlinkAtomic atomically makes dst a symbolic link to target.
+func SymlinkAtomic(target, dst string) error {
+	return Copier{}.linkAtomic(os.Symlink, target, dst)
+}
@@ -0,0 +1,325 @@
+package osutil
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osutil-test-")
+	if err != nil {
+		t.Fatal("Failed to mktemp:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	var data = bytes.Repeat([]byte("ffsync"), 1<<16)
+
+	src := filepath.Join(dir, "src.jpg")
+	if err := ioutil.WriteFile(src, data, 0640); err != nil {
+		t.Fatal("Failed to write src:", err)
+	}
+
+	dst := filepath.Join(dir, "dst.jpg")
+	c := Copier{Durable: true, Preserve: Preserve{Mode: true}}
+	if err := c.copyAtomic(context.Background(), src, dst); err != nil {
+		t.Fatal("Failed to copy:", err)
+	}
+
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal("Failed to read dst:", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatal("Copied file has different content")
+	}
+
+	s, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal("Failed to stat dst:", err)
+	}
+	if s.Mode().Perm() != 0640 {
+		t.Fatalf("Unexpected mode %v", s.Mode())
+	}
+
+	// The temporary file must be gone after the rename.
+	if _, err := os.Stat(filepath.Join(dir, ".dst.jpg")); !os.IsNotExist(err) {
+		t.Fatal("Temporary file still exists:", err)
+	}
+}
+
+func TestCopyStrategies(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osutil-test-")
+	if err != nil {
+		t.Fatal("Failed to mktemp:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	src := filepath.Join(dir, "src.jpg")
+	if err := ioutil.WriteFile(src, []byte("ffsync"), 0644); err != nil {
+		t.Fatal("Failed to write src:", err)
+	}
+
+	dst := filepath.Join(dir, "dst.jpg")
+
+	// Convert the same output through every strategy, which should replace it
+	// every time.
+	for _, strategy := range []Strategy{Hardlink, Symlink, FullCopy, Hardlink} {
+		c := Copier{Strategy: strategy}
+		if err := c.Copy(context.Background(), src, dst); err != nil {
+			t.Fatalf("Failed to copy using %s: %v", strategy, err)
+		}
+
+		if !strategy.Matches(src, dst) {
+			t.Fatalf("Output does not match strategy %s", strategy)
+		}
+
+		b, err := ioutil.ReadFile(dst)
+		if err != nil || string(b) != "ffsync" {
+			t.Fatalf("Unexpected content using %s: %q, %v", strategy, b, err)
+		}
+	}
+
+	if Symlink.Matches(src, dst) {
+		t.Fatal("Hard link unexpectedly matches symlink")
+	}
+}
+
+func TestPreserve(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osutil-test-")
+	if err != nil {
+		t.Fatal("Failed to mktemp:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	src := filepath.Join(dir, "src", "album", "a.flac")
+	dst := filepath.Join(dir, "dst", "album", "a.opus")
+
+	for _, path := range []string{src, dst} {
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal("Failed to mkdir:", err)
+		}
+	}
+
+	if err := ioutil.WriteFile(src, []byte("flac"), 0600); err != nil {
+		t.Fatal("Failed to write src:", err)
+	}
+	if err := ioutil.WriteFile(dst, []byte("opus"), 0644); err != nil {
+		t.Fatal("Failed to write dst:", err)
+	}
+
+	var mtime = time.Date(2020, 6, 22, 0, 0, 0, 0, time.UTC)
+	for _, path := range []string{src, filepath.Dir(src), filepath.Dir(filepath.Dir(src))} {
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal("Failed to chtimes:", err)
+		}
+	}
+
+	var p = Preserve{Mode: true}
+
+	if err := p.Apply(src, dst); err != nil {
+		t.Fatal("Failed to apply:", err)
+	}
+	if err := p.ApplyDirs(src, dst, filepath.Join(dir, "dst")); err != nil {
+		t.Fatal("Failed to apply to directories:", err)
+	}
+
+	for _, path := range []string{dst, filepath.Dir(dst), filepath.Dir(filepath.Dir(dst))} {
+		s, err := os.Stat(path)
+		if err != nil {
+			t.Fatal("Failed to stat:", err)
+		}
+		if !s.ModTime().Equal(mtime) {
+			t.Errorf("%s: expected mtime %v, got %v", path, mtime, s.ModTime())
+		}
+	}
+
+	s, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal("Failed to stat dst:", err)
+	}
+	if s.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", s.Mode())
+	}
+}
+
+func TestRemoveOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osutil-test-")
+	if err != nil {
+		t.Fatal("Failed to mktemp:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	album := filepath.Join(dir, "album")
+	if err := os.Mkdir(album, os.ModePerm); err != nil {
+		t.Fatal("Failed to mkdir:", err)
+	}
+
+	known := filepath.Join(album, "song.opus")
+	unknown := filepath.Join(album, "notes.txt")
+	for _, path := range []string{known, unknown} {
+		if err := ioutil.WriteFile(path, []byte("ffsync"), 0644); err != nil {
+			t.Fatal("Failed to write:", err)
+		}
+	}
+
+	trash := Trash{Root: dir, Retention: time.Hour}
+
+	var removed []string
+	err = RemoveOutputs(album, func(path string) bool { return path == known }, trash, func(path string) {
+		removed = append(removed, path)
+	})
+	if err != nil {
+		t.Fatal("Failed to remove outputs:", err)
+	}
+
+	if len(removed) != 1 || removed[0] != known {
+		t.Fatalf("Unexpected removed files %q", removed)
+	}
+	if _, err := os.Stat(unknown); err != nil {
+		t.Fatal("Unknown file was removed:", err)
+	}
+
+	day := filepath.Join(trash.Dir(), time.Now().Format(trashDateFormat))
+	if _, err := os.Stat(filepath.Join(day, "album", "song.opus")); err != nil {
+		t.Fatal("Removed file is not in the trash:", err)
+	}
+
+	// Nothing is old enough yet.
+	if purged, _ := trash.Purge(time.Now()); len(purged) > 0 {
+		t.Fatalf("Unexpected purge %q", purged)
+	}
+
+	purged, err := trash.Purge(time.Now().Add(48 * time.Hour))
+	if err != nil {
+		t.Fatal("Failed to purge:", err)
+	}
+	if len(purged) != 1 || purged[0] != day {
+		t.Fatalf("Unexpected purge %q", purged)
+	}
+}
+
+func TestMergeDir(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osutil-test-")
+	if err != nil {
+		t.Fatal("Failed to mktemp:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	src := filepath.Join(dir, "old")
+	dst := filepath.Join(dir, "new")
+
+	var files = map[string]string{
+		"old/moved.opus":      "moved",
+		"old/song.opus":       "old output",
+		"old/notes.txt":       "user file",
+		"old/disc/track.opus": "old output",
+		"new/song.opus":       "new output",
+		"new/notes.txt":       "user file",
+		"new/disc/track.opus": "new output",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal("Failed to mkdir:", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal("Failed to write:", err)
+		}
+	}
+
+	trash := Trash{Root: dir, Retention: time.Hour}
+	known := func(path string) bool { return filepath.Ext(path) == ".opus" }
+
+	var removed []string
+	err = MergeDir(src, dst, known, trash, func(path string) {
+		removed = append(removed, path)
+	})
+	if err != nil {
+		t.Fatal("Failed to merge:", err)
+	}
+
+	var expects = map[string]string{
+		"new/moved.opus":      "moved",
+		"new/song.opus":       "new output",
+		"new/disc/track.opus": "new output",
+		"old/notes.txt":       "user file", // conflicting, but not an output
+	}
+	for name, expect := range expects {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(b) != expect {
+			t.Errorf("%s: expected %q, got %q, %v", name, expect, b, err)
+		}
+	}
+
+	if len(removed) != 2 {
+		t.Errorf("Unexpected removed files %q", removed)
+	}
+
+	day := filepath.Join(trash.Dir(), time.Now().Format(trashDateFormat))
+	for _, name := range []string{"old/song.opus", "old/disc/track.opus"} {
+		if _, err := os.Stat(filepath.Join(day, name)); err != nil {
+			t.Error("Conflicting output is not in the trash:", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(src, "disc")); !os.IsNotExist(err) {
+		t.Error("Expected the empty directory to be removed, got", err)
+	}
+}
+
+func TestCopyMode(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osutil-test-")
+	if err != nil {
+		t.Fatal("Failed to mktemp:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	src := filepath.Join(dir, "src.jpg")
+	if err := ioutil.WriteFile(src, []byte("ffsync"), 0600); err != nil {
+		t.Fatal("Failed to write src:", err)
+	}
+	if err := os.Chmod(src, 0600); err != nil {
+		t.Fatal("Failed to chmod src:", err)
+	}
+
+	// The mode of a new file, which depends on the umask.
+	ref := filepath.Join(dir, "ref")
+	if err := ioutil.WriteFile(ref, nil, 0666); err != nil {
+		t.Fatal("Failed to write:", err)
+	}
+	refInfo, err := os.Stat(ref)
+	if err != nil {
+		t.Fatal("Failed to stat:", err)
+	}
+
+	var tests = []struct {
+		preserve bool
+		expect   os.FileMode
+	}{
+		{false, refInfo.Mode().Perm()},
+		{true, 0600},
+	}
+
+	for _, test := range tests {
+		dst := filepath.Join(dir, "dst.jpg")
+
+		c := Copier{Strategy: FullCopy, Preserve: Preserve{Mode: test.preserve}}
+		if err := c.Copy(context.Background(), src, dst); err != nil {
+			t.Fatal("Failed to copy:", err)
+		}
+
+		s, err := os.Stat(dst)
+		if err != nil {
+			t.Fatal("Failed to stat dst:", err)
+		}
+		if s.Mode().Perm() != test.expect {
+			t.Errorf("Preserve mode %v: expected %v, got %v", test.preserve, test.expect, s.Mode().Perm())
+		}
+
+		os.Remove(dst)
+	}
+}
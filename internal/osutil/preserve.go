@@ -0,0 +1,116 @@
+package osutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Preserve describes which attributes of source files are preserved on their
+// outputs. The modification time is always preserved.
+type Preserve struct {
+	Atime bool
+	Mode  bool
+	// Xattrs is the list of prefixes of extended attribute names to copy, such
+	// as "user.".
+	Xattrs []string
+}
+
+// Apply applies the attributes of src onto dst. Hard links and symlinks are
+// left alone, since they either already share the attributes or would change
+// the source's.
+func (p Preserve) Apply(src, dst string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return errors.Wrap(err, "failed to stat src")
+	}
+
+	dstInfo, err := os.Lstat(dst)
+	if err != nil {
+		return errors.Wrap(err, "failed to stat dst")
+	}
+
+	if dstInfo.Mode()&os.ModeSymlink != 0 || os.SameFile(srcInfo, dstInfo) {
+		return nil
+	}
+
+	if p.Mode {
+		if err := os.Chmod(dst, srcInfo.Mode().Perm()); err != nil {
+			return errors.Wrap(err, "failed to chmod")
+		}
+	}
+
+	if len(p.Xattrs) > 0 {
+		if err := copyXattrs(src, dst, p.matchXattr); err != nil {
+			return errors.Wrap(err, "failed to copy xattrs")
+		}
+	}
+
+	// Keep the current access time unless we want the source's.
+	var atime = fileAtime(dstInfo)
+	if p.Atime {
+		atime = fileAtime(srcInfo)
+	}
+
+	if err := os.Chtimes(dst, atime, srcInfo.ModTime()); err != nil {
+		return errors.Wrap(err, "failed to chtimes")
+	}
+
+	return nil
+}
+
+// ApplyDirs restores the modification times of the directories containing dst
+// up to dstRoot from the directories containing src, since writing the output
+// changes them.
+func (p Preserve) ApplyDirs(src, dst, dstRoot string) error {
+	var srcDir = filepath.Dir(src)
+	var dstDir = filepath.Dir(dst)
+	var root = filepath.Clean(dstRoot)
+
+	for {
+		if err := p.applyDir(srcDir, dstDir); err != nil {
+			return err
+		}
+
+		if dstDir == root || !strings.HasPrefix(dstDir, root) {
+			return nil
+		}
+
+		srcDir = filepath.Dir(srcDir)
+		dstDir = filepath.Dir(dstDir)
+	}
+}
+
+func (p Preserve) applyDir(srcDir, dstDir string) error {
+	srcInfo, err := os.Stat(srcDir)
+	if err != nil {
+		return errors.Wrap(err, "failed to stat src directory")
+	}
+
+	dstInfo, err := os.Stat(dstDir)
+	if err != nil {
+		return errors.Wrap(err, "failed to stat dst directory")
+	}
+
+	var atime = fileAtime(dstInfo)
+	if p.Atime {
+		atime = fileAtime(srcInfo)
+	}
+
+	if err := os.Chtimes(dstDir, atime, srcInfo.ModTime()); err != nil {
+		return errors.Wrap(err, "failed to chtimes directory")
+	}
+
+	return nil
+}
+
+func (p Preserve) matchXattr(name string) bool {
+	for _, prefix := range p.Xattrs {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
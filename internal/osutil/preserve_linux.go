@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package osutil
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"time"
+)
+
+func fileAtime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return info.ModTime()
+}
+
+// copyXattrs copies the extended attributes that match from src to dst.
+func copyXattrs(src, dst string, match func(name string) bool) error {
+	names, err := listXattrs(src)
+	if err != nil {
+		// The filesystem doesn't support xattrs, so there's nothing to copy.
+		if err == syscall.ENOTSUP {
+			return nil
+		}
+		return &os.PathError{Op: "listxattr", Path: src, Err: err}
+	}
+
+	for _, name := range names {
+		if !match(name) {
+			continue
+		}
+
+		value, err := getXattr(src, name)
+		if err != nil {
+			return &os.PathError{Op: "getxattr", Path: src, Err: err}
+		}
+
+		if err := syscall.Setxattr(dst, name, value, 0); err != nil {
+			return &os.PathError{Op: "setxattr", Path: dst, Err: err}
+		}
+	}
+
+	return nil
+}
+
+func listXattrs(path string) ([]string, error) {
+	sz, err := syscall.Listxattr(path, nil)
+	if err != nil || sz == 0 {
+		return nil, err
+	}
+
+	buf := make([]byte, sz)
+	sz, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range bytes.Split(buf[:sz], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+
+	return names, nil
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	sz, err := syscall.Getxattr(path, name, nil)
+	if err != nil || sz == 0 {
+		return nil, err
+	}
+
+	buf := make([]byte, sz)
+	sz, err = syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:sz], nil
+}
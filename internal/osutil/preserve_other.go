@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package osutil
+
+import (
+	"os"
+	"time"
+)
+
+func fileAtime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+func copyXattrs(src, dst string, match func(name string) bool) error {
+	return nil
+}
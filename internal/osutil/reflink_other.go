@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package osutil
+
+import (
+	"errors"
+	"os"
+)
+
+func reflink(dst, src *os.File) error {
+	return errors.New("reflink not supported")
+}
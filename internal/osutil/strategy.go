@@ -0,0 +1,111 @@
+package osutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Strategy is how a Copier copies files.
+type Strategy string
+
+const (
+	// Hardlink hard links the file, or copies it if that fails, for example
+	// across filesystems. This is the default.
+	Hardlink Strategy = "hardlink"
+	// Symlink makes a symbolic link to the absolute path of the file.
+	Symlink Strategy = "symlink"
+	// Reflink makes a copy-on-write copy of the file if the filesystem
+	// supports it, or copies it otherwise.
+	Reflink Strategy = "reflink"
+	// FullCopy always copies the file's content.
+	FullCopy Strategy = "copy"
+)
+
+// Strategies is the list of all strategies.
+var Strategies = []Strategy{Hardlink, Symlink, Reflink, FullCopy}
+
+// ParseStrategy parses the strategy name. An empty name is Hardlink.
+func ParseStrategy(name string) (Strategy, error) {
+	if name == "" {
+		return Hardlink, nil
+	}
+	for _, s := range Strategies {
+		if string(s) == name {
+			return s, nil
+		}
+	}
+	return "", errors.Errorf("unknown copy strategy %q", name)
+}
+
+// orDefault returns Hardlink if the strategy is empty.
+func (s Strategy) orDefault() Strategy {
+	if s == "" {
+		return Hardlink
+	}
+	return s
+}
+
+// Matches returns true if dst looks like it was copied from src using the
+// strategy. Reflink and FullCopy can't be told apart, so they match each
+// other.
+func (s Strategy) Matches(src, dst string) bool {
+	dstInfo, err := os.Lstat(dst)
+	if err != nil {
+		return false
+	}
+
+	if s.orDefault() == Symlink {
+		if dstInfo.Mode()&os.ModeSymlink == 0 {
+			return false
+		}
+		target, err := os.Readlink(dst)
+		return err == nil && target == src
+	}
+
+	if !dstInfo.Mode().IsRegular() {
+		return false
+	}
+
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false
+	}
+
+	// A hard link may not have been possible, in which case a copy is fine
+	// too, but we can't tell without trying again.
+	linked := os.SameFile(srcInfo, dstInfo)
+	return linked == (s.orDefault() == Hardlink)
+}
+
+// strategyFile returns the path to the file that records the strategy used
+// for the destination.
+func strategyFile(stateDir string) string {
+	return filepath.Join(stateDir, "copy-strategy")
+}
+
+// ReadStrategy reads the strategy recorded in the state directory. An empty
+// strategy is returned if none was recorded.
+func ReadStrategy(stateDir string) (Strategy, error) {
+	b, err := ioutil.ReadFile(strategyFile(stateDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return ParseStrategy(strings.TrimSpace(string(b)))
+}
+
+// WriteStrategy records the strategy into the state directory.
+func WriteStrategy(stateDir string, s Strategy) error {
+	if err := os.MkdirAll(stateDir, os.ModePerm); err != nil {
+		return errors.Wrap(err, "failed to mkdir -p state directory")
+	}
+
+	return ioutil.WriteFile(strategyFile(stateDir), []byte(s.orDefault()+"\n"), 0644)
+}
@@ -0,0 +1,92 @@
+package osutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/diamondburned/ffsync/internal/logger"
+	"github.com/pkg/errors"
+)
+
+// trashDateFormat is the format of the names of the directories inside the
+// trash, one for each day.
+const trashDateFormat = "2006-01-02"
+
+// Trash is where removed outputs are kept for a while instead of being removed
+// right away.
+type Trash struct {
+	Root string // destination root
+	// Retention is how long removed outputs are kept for. Zero removes them
+	// right away.
+	Retention time.Duration
+	// Log logs what's put into the trash.
+	Log *logger.Logger
+}
+
+// Dir returns the trash directory.
+func (t Trash) Dir() string {
+	return filepath.Join(StateDir(t.Root), "trash")
+}
+
+// Put moves the file at path into the trash, keeping its path relative to the
+// destination root, or removes it if there's no retention.
+func (t Trash) Put(path string) error {
+	if t.Retention <= 0 {
+		return os.Remove(path)
+	}
+
+	rel, err := filepath.Rel(t.Root, path)
+	if err != nil {
+		return errors.Wrap(err, "path is not in the destination")
+	}
+
+	dst := filepath.Join(t.Dir(), time.Now().Format(trashDateFormat), rel)
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return errors.Wrap(err, "failed to mkdir -p trash")
+	}
+
+	if err := os.Rename(path, dst); err != nil {
+		return err
+	}
+
+	t.Log.Debug("Trashed output", "dst", path, "trash", dst)
+	return nil
+}
+
+// Purge removes everything in the trash that is older than the retention. It
+// returns the removed directories.
+func (t Trash) Purge(now time.Time) ([]string, error) {
+	entries, err := ioutil.ReadDir(t.Dir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to read trash")
+	}
+
+	var purged []string
+
+	for _, entry := range entries {
+		date, err := time.ParseInLocation(trashDateFormat, entry.Name(), time.Local)
+		if err != nil {
+			continue
+		}
+
+		// The whole day has to be past the retention.
+		if now.Sub(date.AddDate(0, 0, 1)) < t.Retention {
+			continue
+		}
+
+		path := filepath.Join(t.Dir(), entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			return purged, errors.Wrap(err, "failed to purge trash")
+		}
+
+		purged = append(purged, path)
+	}
+
+	return purged, nil
+}
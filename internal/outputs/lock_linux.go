@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package outputs
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive lock on the file at path, which is created if
+// needed. False is returned if another process holds it.
+func tryLock(path string) (unlock func(), ok bool, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, false, nil
+		}
+		return nil, false, &os.SyscallError{Syscall: "flock", Err: err}
+	}
+
+	// Closing the file releases the lock.
+	return func() { f.Close() }, true, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package outputs
+
+// tryLock always succeeds, so a manifest compacted by another process at the
+// same time may lose the outputs it records.
+func tryLock(path string) (unlock func(), ok bool, err error) {
+	return func() {}, true, nil
+}
@@ -0,0 +1,353 @@
+// Package outputs keeps track of the outputs written by ffsync, so that files
+// put into the destination by anything else are never removed.
+package outputs
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Manifest is the set of outputs written into a destination. It is persisted
+// as an append-only journal inside the state directory, which is compacted
+// when it's opened by the only process using it. Each line of the journal is
+// "+" or "-" followed by the quoted path relative to the destination.
+type Manifest struct {
+	root   string
+	path   string
+	unlock func()
+
+	mutex   sync.Mutex
+	outputs map[string]struct{} // relative to root
+	journal *os.File
+	partial bool // the journal ends with a line cut short
+}
+
+// Open opens the manifest of the destination root inside the given state
+// directory. The returned boolean is false if the manifest didn't exist yet,
+// in which case the caller may want to fill it with the existing outputs.
+//
+// The manifest is locked until it's closed. If another process holds the lock,
+// then the journal is only appended to, since compacting it would replace the
+// file that process appends to. Outputs added by the other process meanwhile
+// aren't seen.
+func Open(root, stateDir string) (*Manifest, bool, error) {
+	m := newManifest(root, stateDir)
+
+	if err := os.MkdirAll(stateDir, os.ModePerm); err != nil {
+		return nil, false, errors.Wrap(err, "failed to mkdir -p state directory")
+	}
+
+	unlock, locked, err := tryLock(m.path + ".lock")
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to lock manifest")
+	}
+
+	existed, err := m.load()
+	if err == nil && locked {
+		err = m.compact()
+	}
+	if err == nil {
+		err = m.openJournal()
+	}
+	if err != nil {
+		if locked {
+			unlock()
+		}
+		return nil, false, err
+	}
+
+	if locked {
+		m.unlock = unlock
+	}
+
+	return m, existed, nil
+}
+
+// Read returns the outputs in the manifest of the destination root inside the
+// given state directory without opening it for writing. The paths are absolute
+// and sorted.
+func Read(root, stateDir string) ([]string, error) {
+	m := newManifest(root, stateDir)
+	if _, err := m.load(); err != nil {
+		return nil, err
+	}
+	return m.Paths(), nil
+}
+
+func newManifest(root, stateDir string) *Manifest {
+	return &Manifest{
+		root:    filepath.Clean(root),
+		path:    filepath.Join(stateDir, "outputs"),
+		outputs: map[string]struct{}{},
+	}
+}
+
+func (m *Manifest) load() (bool, error) {
+	f, err := os.Open(m.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "failed to open manifest")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		adv, token, err := bufio.ScanLines(data, atEOF)
+		if atEOF && adv == len(data) && adv > 0 && data[adv-1] != '\n' {
+			m.partial = true
+		}
+		return adv, token, err
+	})
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 2 {
+			continue
+		}
+
+		// A line cut short by a crash can't be unquoted, and the change it
+		// was for is lost.
+		rel, ok := unquote(line[1:])
+		if !ok {
+			continue
+		}
+
+		switch line[0] {
+		case '+':
+			m.outputs[rel] = struct{}{}
+		case '-':
+			delete(m.outputs, rel)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, errors.Wrap(err, "failed to read manifest")
+	}
+
+	return true, nil
+}
+
+// compact rewrites the journal with only the current outputs.
+func (m *Manifest) compact() error {
+	var paths = make([]string, 0, len(m.outputs))
+	for path := range m.outputs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	tmp := filepath.Join(filepath.Dir(m.path), "."+filepath.Base(m.path))
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, "failed to create manifest")
+	}
+
+	w := bufio.NewWriter(f)
+	for _, path := range paths {
+		w.WriteString("+" + strconv.Quote(path) + "\n")
+	}
+
+	err = w.Flush()
+	if err == nil {
+		// Make sure the outputs are on disk before the old journal is gone.
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to write manifest")
+	}
+
+	if err := os.Rename(tmp, m.path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to rename manifest")
+	}
+
+	m.partial = false
+	return nil
+}
+
+// openJournal opens the journal for appending, which other processes may do at
+// the same time.
+func (m *Manifest) openJournal() error {
+	f, err := os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open manifest")
+	}
+
+	// End the line cut short, so that it doesn't swallow the next one.
+	if m.partial {
+		if _, err := f.WriteString("\n"); err != nil {
+			f.Close()
+			return errors.Wrap(err, "failed to write manifest")
+		}
+	}
+
+	m.journal = f
+	return nil
+}
+
+// Close closes the journal and releases the lock.
+func (m *Manifest) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	err := m.journal.Close()
+	if m.unlock != nil {
+		m.unlock()
+		m.unlock = nil
+	}
+	return err
+}
+
+func (m *Manifest) rel(path string) (string, bool) {
+	rel, err := filepath.Rel(m.root, filepath.Clean(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
+func (m *Manifest) write(op byte, rel string) error {
+	_, err := m.journal.WriteString(string(op) + strconv.Quote(rel) + "\n")
+	return err
+}
+
+// unquote returns the path in a journal line. Paths written before they were
+// quoted are taken as they are.
+func unquote(s string) (string, bool) {
+	if !strings.HasPrefix(s, `"`) {
+		return s, true
+	}
+	rel, err := strconv.Unquote(s)
+	return rel, err == nil
+}
+
+// Add adds the given output paths.
+func (m *Manifest) Add(paths ...string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, path := range paths {
+		rel, ok := m.rel(path)
+		if !ok {
+			continue
+		}
+		if _, ok := m.outputs[rel]; ok {
+			continue
+		}
+
+		m.outputs[rel] = struct{}{}
+		if err := m.write('+', rel); err != nil {
+			return errors.Wrap(err, "failed to write manifest")
+		}
+	}
+
+	return nil
+}
+
+// Remove removes the given output paths.
+func (m *Manifest) Remove(paths ...string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, path := range paths {
+		rel, ok := m.rel(path)
+		if !ok {
+			continue
+		}
+		if _, ok := m.outputs[rel]; !ok {
+			continue
+		}
+
+		delete(m.outputs, rel)
+		if err := m.write('-', rel); err != nil {
+			return errors.Wrap(err, "failed to write manifest")
+		}
+	}
+
+	return nil
+}
+
+// Move moves the output at src, or all outputs under src if it's a directory,
+// to dst.
+func (m *Manifest) Move(src, dst string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	srcRel, ok1 := m.rel(src)
+	dstRel, ok2 := m.rel(dst)
+	if !ok1 || !ok2 {
+		return nil
+	}
+
+	for rel := range m.outputs {
+		var moved string
+		switch {
+		case rel == srcRel:
+			moved = dstRel
+		case strings.HasPrefix(rel, srcRel+string(filepath.Separator)):
+			moved = dstRel + rel[len(srcRel):]
+		default:
+			continue
+		}
+
+		delete(m.outputs, rel)
+		m.outputs[moved] = struct{}{}
+
+		if err := m.write('-', rel); err != nil {
+			return errors.Wrap(err, "failed to write manifest")
+		}
+		if err := m.write('+', moved); err != nil {
+			return errors.Wrap(err, "failed to write manifest")
+		}
+	}
+
+	return nil
+}
+
+// Has returns true if the path is an output.
+func (m *Manifest) Has(path string) bool {
+	rel, ok := m.rel(path)
+	if !ok {
+		return false
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok = m.outputs[rel]
+	return ok
+}
+
+// Len returns the number of outputs.
+func (m *Manifest) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.outputs)
+}
+
+// Paths returns every output as an absolute path, sorted.
+func (m *Manifest) Paths() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var paths = make([]string, 0, len(m.outputs))
+	for rel := range m.outputs {
+		paths = append(paths, filepath.Join(m.root, rel))
+	}
+	sort.Strings(paths)
+
+	return paths
+}
@@ -0,0 +1,173 @@
+package outputs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffsync-outputs-")
+	if err != nil {
+		t.Fatal("Failed to create tmpdir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var root = filepath.Join(dir, "dst")
+	var state = filepath.Join(root, ".ffsync")
+	var abs = func(rel string) string { return filepath.Join(root, rel) }
+
+	m, existed, err := Open(root, state)
+	if err != nil {
+		t.Fatal("Failed to open:", err)
+	}
+	if existed {
+		t.Fatal("Expected a new manifest")
+	}
+
+	var weird = "a/line\nbreak \"quoted\".opus"
+
+	must(t, m.Add(abs("a/1.opus"), abs("a/2.opus"), abs("a/cover.jpg"), abs(weird), "/elsewhere/x.opus"))
+	must(t, m.Remove(abs("a/2.opus")))
+	must(t, m.Move(abs("a"), abs("b")))
+	must(t, m.Close())
+
+	var expect = strings.Join([]string{abs("b/1.opus"), abs("b/cover.jpg"), abs("b/line\nbreak \"quoted\".opus")}, "|")
+
+	// Replay the journal without compacting it.
+	paths, err := Read(root, state)
+	if err != nil {
+		t.Fatal("Failed to read:", err)
+	}
+	if got := strings.Join(paths, "|"); got != expect {
+		t.Fatalf("Unexpected replayed outputs:\n%q\nexpected\n%q", got, expect)
+	}
+
+	m, existed, err = Open(root, state)
+	if err != nil {
+		t.Fatal("Failed to reopen:", err)
+	}
+	if !existed {
+		t.Fatal("Expected the manifest to exist")
+	}
+	if got := strings.Join(m.Paths(), "|"); got != expect {
+		t.Fatalf("Unexpected outputs after reopening: %q", got)
+	}
+	if !m.Has(abs("b/1.opus")) || m.Has(abs("a/1.opus")) || m.Has("/elsewhere/x.opus") {
+		t.Error("Unexpected Has results")
+	}
+
+	// Compacting leaves one line per output.
+	b, err := ioutil.ReadFile(filepath.Join(state, "outputs"))
+	if err != nil {
+		t.Fatal("Failed to read the journal:", err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 3 {
+		t.Errorf("Expected 3 lines after compacting, got %d:\n%s", lines, b)
+	}
+
+	// Crash in the middle of appending a line.
+	must(t, m.Add(abs("c/1.opus")))
+	if _, err := m.journal.WriteString(`+"c/2.op`); err != nil {
+		t.Fatal("Failed to write:", err)
+	}
+	must(t, m.Close())
+
+	m, _, err = Open(root, state)
+	if err != nil {
+		t.Fatal("Failed to reopen after a crash:", err)
+	}
+	if !m.Has(abs("c/1.opus")) || m.Has(abs("c/2.op")) || m.Len() != 4 {
+		t.Fatalf("Unexpected outputs after a crash: %q", m.Paths())
+	}
+
+	// The journal is usable again.
+	must(t, m.Add(abs("c/3.opus")))
+	must(t, m.Close())
+
+	paths, err = Read(root, state)
+	if err != nil {
+		t.Fatal("Failed to read:", err)
+	}
+	if len(paths) != 5 {
+		t.Fatalf("Unexpected outputs: %q", paths)
+	}
+}
+
+func TestManifestShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffsync-outputs-")
+	if err != nil {
+		t.Fatal("Failed to create tmpdir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var abs = func(rel string) string { return filepath.Join("/dst", rel) }
+
+	// The daemon, which compacted the journal.
+	daemon, _, err := Open("/dst", dir)
+	if err != nil {
+		t.Fatal("Failed to open:", err)
+	}
+	must(t, daemon.Add(abs("1.opus")))
+
+	// Cut a line short, like a crash of a third process would.
+	if _, err := daemon.journal.WriteString(`+"2.op`); err != nil {
+		t.Fatal("Failed to write:", err)
+	}
+
+	// A command run meanwhile, which must not replace the daemon's journal.
+	cmd, existed, err := Open("/dst", dir)
+	if err != nil {
+		t.Fatal("Failed to open again:", err)
+	}
+	if !existed || !cmd.Has(abs("1.opus")) {
+		t.Fatal("Expected the daemon's outputs")
+	}
+
+	must(t, cmd.Add(abs("3.opus")))
+	must(t, daemon.Add(abs("4.opus")))
+	must(t, cmd.Close())
+	must(t, daemon.Add(abs("5.opus")))
+	must(t, daemon.Close())
+
+	paths, err := Read("/dst", dir)
+	if err != nil {
+		t.Fatal("Failed to read:", err)
+	}
+
+	var expect = strings.Join([]string{abs("1.opus"), abs("3.opus"), abs("4.opus"), abs("5.opus")}, "|")
+	if got := strings.Join(paths, "|"); got != expect {
+		t.Fatalf("Unexpected outputs:\n%q\nexpected\n%q", got, expect)
+	}
+}
+
+func TestManifestUnquoted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffsync-outputs-")
+	if err != nil {
+		t.Fatal("Failed to create tmpdir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Written before the paths were quoted.
+	journal := "+a/1.opus\n+a/2.opus\n-a/1.opus\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "outputs"), []byte(journal), 0644); err != nil {
+		t.Fatal("Failed to write:", err)
+	}
+
+	paths, err := Read("/dst", dir)
+	if err != nil {
+		t.Fatal("Failed to read:", err)
+	}
+	if len(paths) != 1 || paths[0] != "/dst/a/2.opus" {
+		t.Fatalf("Unexpected outputs: %q", paths)
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,245 @@
+package retry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Entry is a job in the dead-letter list.
+type Entry struct {
+	Src      string    `json:"src"`
+	Dst      string    `json:"dst"`
+	Action   string    `json:"action"`         // "copy" or "convert"
+	Kind     string    `json:"kind,omitempty"` // see ffmpeg.ErrorKind
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	Time     time.Time `json:"time"`
+}
+
+// DeadLetters is the dead-letter list of jobs that failed permanently. The list
+// is persisted as a JSON file, which may be edited externally; see Reload.
+// Changes are merged into what's in the file, which is locked meanwhile, so
+// other processes changing it at the same time are fine.
+type DeadLetters struct {
+	path string
+
+	mutex   sync.Mutex
+	entries map[string]Entry // keyed by src
+	modTime time.Time
+	// removed are the entries found removed from the file while changing it,
+	// which are returned by the next Reload.
+	removed []Entry
+}
+
+// DeadLettersPath returns the path to the dead-letter list inside the given
+// state directory.
+func DeadLettersPath(stateDir string) string {
+	return filepath.Join(stateDir, "deadletters.json")
+}
+
+// OpenDeadLetters opens the dead-letter list at the given path. The file does
+// not have to exist.
+func OpenDeadLetters(path string) (*DeadLetters, error) {
+	d := &DeadLetters{
+		path:    path,
+		entries: map[string]Entry{},
+	}
+
+	if err := d.read(true); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Get returns the entry of the given source path.
+func (d *DeadLetters) Get(src string) (Entry, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	e, ok := d.entries[src]
+	return e, ok
+}
+
+// Entries returns all entries sorted by time.
+func (d *DeadLetters) Entries() []Entry {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var entries = make([]Entry, 0, len(d.entries))
+	for _, e := range d.entries {
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+
+	return entries
+}
+
+// Add adds the entry into the list and saves it.
+func (d *DeadLetters) Add(e Entry) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.update(func() bool {
+		d.entries[e.Src] = e
+		return true
+	})
+}
+
+// Remove removes the entries of the given source paths, or all entries if none
+// is given, and saves the list. The removed entries are returned.
+func (d *DeadLetters) Remove(srcs ...string) ([]Entry, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var removed []Entry
+
+	err := d.update(func() bool {
+		if len(srcs) == 0 {
+			for src := range d.entries {
+				srcs = append(srcs, src)
+			}
+		}
+
+		for _, src := range srcs {
+			if e, ok := d.entries[src]; ok {
+				removed = append(removed, e)
+				delete(d.entries, src)
+			}
+		}
+
+		return len(removed) > 0
+	})
+
+	return removed, err
+}
+
+// Reload reloads the list if the file was changed externally since the last
+// time it was read or written. Entries that are no longer in the file are
+// returned, so they can be requeued.
+func (d *DeadLetters) Reload() ([]Entry, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.reload()
+}
+
+func (d *DeadLetters) reload() ([]Entry, error) {
+	if err := d.read(false); err != nil {
+		return nil, err
+	}
+
+	removed := d.removed
+	d.removed = nil
+
+	return removed, nil
+}
+
+// update locks the file, reads it again and saves it if change returns true.
+func (d *DeadLetters) update(change func() bool) error {
+	if err := os.MkdirAll(filepath.Dir(d.path), os.ModePerm); err != nil {
+		return errors.Wrap(err, "failed to mkdir -p state directory")
+	}
+
+	unlock, err := lockFile(d.path + ".lock")
+	if err != nil {
+		return errors.Wrap(err, "failed to lock dead-letter list")
+	}
+	defer unlock()
+
+	if err := d.read(true); err != nil {
+		return err
+	}
+
+	if !change() {
+		return nil
+	}
+
+	return d.save()
+}
+
+// read reads the file if it was changed since the last time it was read or
+// written, or always if force is true. Entries that aren't in the file anymore
+// are added to removed.
+func (d *DeadLetters) read(force bool) error {
+	s, err := os.Stat(d.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+
+	if !force && s.ModTime().Equal(d.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read dead-letter list")
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return errors.Wrap(err, "failed to decode dead-letter list")
+	}
+
+	var newEntries = make(map[string]Entry, len(entries))
+	for _, e := range entries {
+		newEntries[e.Src] = e
+	}
+
+	for src, e := range d.entries {
+		if _, ok := newEntries[src]; !ok {
+			d.removed = append(d.removed, e)
+		}
+	}
+
+	d.entries = newEntries
+	d.modTime = s.ModTime()
+
+	return nil
+}
+
+func (d *DeadLetters) save() error {
+	var entries = make([]Entry, 0, len(d.entries))
+	for _, e := range d.entries {
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Src < entries[j].Src
+	})
+
+	b, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode dead-letter list")
+	}
+
+	tmp := filepath.Join(filepath.Dir(d.path), "."+filepath.Base(d.path))
+
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return errors.Wrap(err, "failed to write dead-letter list")
+	}
+
+	if err := os.Rename(tmp, d.path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to rename dead-letter list")
+	}
+
+	if s, err := os.Stat(d.path); err == nil {
+		d.modTime = s.ModTime()
+	}
+
+	return nil
+}
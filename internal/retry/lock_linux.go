@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package retry
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the file at path, which is created if
+// needed, blocking until it's free.
+func lockFile(path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, &os.SyscallError{Syscall: "flock", Err: err}
+	}
+
+	// Closing the file releases the lock.
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,134 @@
+// Package retry implements retrying failed jobs with exponential backoff, as
+// well as the dead-letter list of jobs that failed permanently.
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/diamondburned/ffsync/ffmpeg"
+)
+
+// Policy describes how failed jobs are retried.
+type Policy struct {
+	MaxAttempts int           // including the first one
+	Backoff     time.Duration // delay before the first retry
+	MaxBackoff  time.Duration
+}
+
+// DefaultPolicy is the default retry policy.
+var DefaultPolicy = Policy{
+	MaxAttempts: 5,
+	Backoff:     30 * time.Second,
+	MaxBackoff:  30 * time.Minute,
+}
+
+// Delay returns the delay before retrying after the given number of failed
+// attempts. The delay doubles on every attempt.
+func (p Policy) Delay(attempts int) time.Duration {
+	var delay = p.Backoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return delay
+}
+
+// transientErrnos are errors from the operating system that are likely to go
+// away on their own. The partial outputs are always cleaned up on failure, so
+// ENOSPC may go away as well.
+var transientErrnos = []syscall.Errno{
+	syscall.EIO,
+	syscall.ENOSPC,
+	syscall.EAGAIN,
+	syscall.EBUSY,
+	syscall.ETIMEDOUT,
+	syscall.EMFILE,
+	syscall.ENFILE,
+}
+
+// IsTransient returns true if the error is likely to go away if the job is
+// retried later. Errors caused by the input itself, such as a corrupt file, and
+// other non-zero exits of ffmpeg are permanent.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// Bad outputs are quarantined, so they're written again on retry.
+	if errors.Is(err, ffmpeg.ErrVerify) {
+		return true
+	}
+
+	switch ffmpeg.ErrKind(err) {
+	case ffmpeg.StalledError, ffmpeg.TimedOutError, ffmpeg.SignalError,
+		ffmpeg.DiskFullError, ffmpeg.IOError:
+		return true
+	case ffmpeg.NoStreamError, ffmpeg.CorruptInputError, ffmpeg.UnsupportedCodecError,
+		ffmpeg.EncoderNotFoundError, ffmpeg.PermissionError:
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	if ffmpeg.ErrIsExit(err) {
+		return false
+	}
+
+	// Unknown errors are retried.
+	return true
+}
+
+// Retrier keeps track of the number of attempts of each job.
+type Retrier struct {
+	Policy Policy
+
+	mutex    sync.Mutex
+	attempts map[string]int
+}
+
+// NewRetrier creates a new retrier with the given policy.
+func NewRetrier(p Policy) *Retrier {
+	return &Retrier{
+		Policy:   p,
+		attempts: map[string]int{},
+	}
+}
+
+// Failed records a failed attempt of the job with the given key. It returns
+// the delay before the job should be retried and true, or false if the job
+// should not be retried anymore, in which case the job is forgotten.
+func (r *Retrier) Failed(key string, err error) (delay time.Duration, attempts int, retry bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	attempts = r.attempts[key] + 1
+
+	if !IsTransient(err) || attempts >= r.Policy.MaxAttempts {
+		delete(r.attempts, key)
+		return 0, attempts, false
+	}
+
+	r.attempts[key] = attempts
+	return r.Policy.Delay(attempts), attempts, true
+}
+
+// Succeeded forgets the job with the given key.
+func (r *Retrier) Succeeded(key string) {
+	r.mutex.Lock()
+	delete(r.attempts, key)
+	r.mutex.Unlock()
+}
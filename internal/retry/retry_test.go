@@ -0,0 +1,196 @@
+package retry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/ffsync/ffmpeg"
+	"github.com/pkg/errors"
+)
+
+func TestPolicyDelay(t *testing.T) {
+	var p = Policy{
+		Backoff:    time.Second,
+		MaxBackoff: 10 * time.Second,
+	}
+
+	var expects = []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second,
+	}
+
+	for i, expect := range expects {
+		if d := p.Delay(i + 1); d != expect {
+			t.Errorf("Attempt %d: expected %v, got %v", i+1, expect, d)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	var tests = []struct {
+		name   string
+		err    error
+		expect bool
+	}{
+		{"stalled", errors.Wrap(ffmpeg.ErrStalled, "test"), true},
+		{"EIO", &os.PathError{Op: "write", Path: "test", Err: syscall.EIO}, true},
+		{"ENOSPC", errors.Wrap(syscall.ENOSPC, "failed to copy"), true},
+	}
+
+	for _, test := range tests {
+		if transient := IsTransient(test.err); transient != test.expect {
+			t.Errorf("%s: expected transient=%v", test.name, test.expect)
+		}
+	}
+}
+
+func TestRetrier(t *testing.T) {
+	var r = NewRetrier(Policy{MaxAttempts: 3, Backoff: time.Second})
+	var err = syscall.EIO
+
+	if _, _, ok := r.Failed("a", err); !ok {
+		t.Fatal("Expected the first failure to be retried")
+	}
+	if _, _, ok := r.Failed("a", err); !ok {
+		t.Fatal("Expected the second failure to be retried")
+	}
+	if _, attempts, ok := r.Failed("a", err); ok || attempts != 3 {
+		t.Fatalf("Expected the third failure to give up, got attempts=%d", attempts)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "retry-test-")
+	if err != nil {
+		t.Fatal("Failed to mktemp:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	var path = DeadLettersPath(filepath.Join(dir, "state"))
+
+	d, err := OpenDeadLetters(path)
+	if err != nil {
+		t.Fatal("Failed to open dead-letter list:", err)
+	}
+
+	for _, src := range []string{"a.flac", "b.flac"} {
+		if err := d.Add(Entry{Src: src, Action: "convert", Time: time.Now()}); err != nil {
+			t.Fatal("Failed to add entry:", err)
+		}
+	}
+
+	// Remove an entry from another instance, as the requeue command would.
+	other, err := OpenDeadLetters(path)
+	if err != nil {
+		t.Fatal("Failed to reopen dead-letter list:", err)
+	}
+	if len(other.Entries()) != 2 {
+		t.Fatal("Unexpected entries:", other.Entries())
+	}
+
+	// Make sure the modification time changes.
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := other.Remove("a.flac"); err != nil {
+		t.Fatal("Failed to remove entry:", err)
+	}
+
+	removed, err := d.Reload()
+	if err != nil {
+		t.Fatal("Failed to reload:", err)
+	}
+
+	if len(removed) != 1 || removed[0].Src != "a.flac" {
+		t.Fatal("Unexpected removed entries:", removed)
+	}
+
+	if _, ok := d.Get("a.flac"); ok {
+		t.Fatal("Removed entry is still in the list")
+	}
+}
+
+func TestDeadLettersShared(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "retry-test-")
+	if err != nil {
+		t.Fatal("Failed to mktemp:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	var path = DeadLettersPath(filepath.Join(dir, "state"))
+
+	daemon, err := OpenDeadLetters(path)
+	if err != nil {
+		t.Fatal("Failed to open dead-letter list:", err)
+	}
+	for _, src := range []string{"a.flac", "b.flac"} {
+		if err := daemon.Add(Entry{Src: src, Action: "convert"}); err != nil {
+			t.Fatal("Failed to add entry:", err)
+		}
+	}
+
+	cli, err := OpenDeadLetters(path)
+	if err != nil {
+		t.Fatal("Failed to open dead-letter list:", err)
+	}
+	if _, err := cli.Remove("a.flac"); err != nil {
+		t.Fatal("Failed to remove entry:", err)
+	}
+
+	// The daemon adds an entry before noticing the removal.
+	if err := daemon.Add(Entry{Src: "c.flac", Action: "convert"}); err != nil {
+		t.Fatal("Failed to add entry:", err)
+	}
+
+	reopened, err := OpenDeadLetters(path)
+	if err != nil {
+		t.Fatal("Failed to reopen dead-letter list:", err)
+	}
+
+	var srcs []string
+	for _, e := range reopened.Entries() {
+		srcs = append(srcs, e.Src)
+	}
+	sort.Strings(srcs)
+
+	if strings.Join(srcs, " ") != "b.flac c.flac" {
+		t.Fatalf("Unexpected entries in the file: %q", srcs)
+	}
+
+	// The removal is still reported, so the entry is requeued.
+	removed, err := daemon.Reload()
+	if err != nil {
+		t.Fatal("Failed to reload:", err)
+	}
+	if len(removed) != 1 || removed[0].Src != "a.flac" {
+		t.Fatal("Unexpected removed entries:", removed)
+	}
+
+	// Adding from both at the same time loses nothing.
+	var wg sync.WaitGroup
+	for i, d := range []*DeadLetters{daemon, cli} {
+		wg.Add(1)
+		go func(i int, d *DeadLetters) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := d.Add(Entry{Src: fmt.Sprintf("%d-%d.flac", i, j)}); err != nil {
+					t.Error("Failed to add entry:", err)
+				}
+			}
+		}(i, d)
+	}
+	wg.Wait()
+
+	if err := reopened.update(func() bool { return false }); err != nil {
+		t.Fatal("Failed to read:", err)
+	}
+	if n := len(reopened.Entries()); n != 42 {
+		t.Errorf("Expected 42 entries, got %d", n)
+	}
+}
@@ -1,20 +1,104 @@
 package fallback
 
 import (
-	"log"
+	"fmt"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/diamondburned/ffsync/internal/logger"
 	"github.com/diamondburned/ffsync/internal/telemetry"
 )
 
-type client struct{}
+type client struct {
+	log    *logger.Logger
+	mutex  *sync.Mutex
+	gauges map[string]float64
+}
+
+// New creates a telemeter that logs everything using log.
+func New(log *logger.Logger) telemetry.Telemeter {
+	return client{
+		log:    log.Component("telemetry"),
+		mutex:  &sync.Mutex{},
+		gauges: map[string]float64{},
+	}
+}
+
+func (c client) WriteDuration(dura time.Duration, name string, attrs telemetry.Extras) {
+	kvs := []interface{}{"name", name, "duration", dura}
+	kvs = appendSorted(kvs, attrs)
+
+	c.log.Info("Finished", kvs...)
+}
+
+func (c client) AddCount(name string, delta int64, tags telemetry.Tags) {
+	kvs := []interface{}{"name", name, "delta", delta}
+	kvs = appendSorted(kvs, tagsMap(tags))
+
+	c.log.Info("Counted", kvs...)
+}
+
+// SetGauge logs the gauge only if its value changed, since gauges are set
+// periodically.
+func (c client) SetGauge(name string, value float64, tags telemetry.Tags) {
+	var key = fmt.Sprint(name, tags)
 
-func New() telemetry.Telemeter {
-	return client{}
+	c.mutex.Lock()
+	old, ok := c.gauges[key]
+	c.gauges[key] = value
+	c.mutex.Unlock()
+
+	if !ok || old != value {
+		kvs := []interface{}{"name", name, "value", value}
+		kvs = appendSorted(kvs, tagsMap(tags))
+
+		c.log.Info("Gauge changed", kvs...)
+	}
 }
 
-func (client) WriteDuration(dura time.Duration, name string, attrs telemetry.Extras) {
-	log.Printf("%s took %v to complete; attrs: %+v\n", name, dura, attrs)
+func (c client) WriteEvent(ev telemetry.Event) {
+	var level = logger.Info
+
+	switch ev.Type {
+	case telemetry.JobQueued, telemetry.JobStarted:
+		// Every file is queued on startup, which is too much to log.
+		level = logger.Debug
+	case telemetry.JobFailed:
+		level = logger.Warn
+	}
+
+	kvs := []interface{}{"action", ev.Action, "src", ev.Src, "dst", ev.Dst}
+	if ev.Reason != "" {
+		kvs = append(kvs, "kind", ev.Reason)
+	}
+	if ev.Error != "" {
+		kvs = append(kvs, "error", ev.Error)
+	}
+
+	c.log.Log(level, string(ev.Type), kvs...)
 }
 
 func (client) Close() {}
+
+func tagsMap(tags telemetry.Tags) map[string]interface{} {
+	m := make(map[string]interface{}, len(tags))
+	for k, v := range tags {
+		m[k] = v
+	}
+	return m
+}
+
+// appendSorted appends the key-value pairs of m sorted by key.
+func appendSorted(kvs []interface{}, m map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		kvs = append(kvs, k, m[k])
+	}
+	return kvs
+}
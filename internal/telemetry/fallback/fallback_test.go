@@ -0,0 +1,48 @@
+package fallback
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/diamondburned/ffsync/internal/logger"
+	"github.com/diamondburned/ffsync/internal/telemetry"
+)
+
+func TestFallback(t *testing.T) {
+	var buf bytes.Buffer
+	c := New(logger.New(&buf, logger.Config{Journal: true}))
+
+	failed := telemetry.NewEvent(telemetry.JobFailed, "convert", "a.flac", "a.opus")
+	failed.Reason = "timed out"
+	failed.Error = "ffmpeg stalled"
+
+	// Queued and started jobs are only logged when debugging.
+	c.WriteEvent(telemetry.NewEvent(telemetry.JobQueued, "convert", "a.flac", "a.opus"))
+	c.WriteEvent(telemetry.NewEvent(telemetry.JobStarted, "convert", "a.flac", "a.opus"))
+	c.WriteEvent(failed)
+	c.WriteEvent(telemetry.NewEvent(telemetry.FileRemoved, "", "", "b.opus"))
+
+	c.AddCount("retries", 1, telemetry.Tags{"action": "convert"})
+
+	// Gauges are only logged when they change.
+	c.SetGauge("queue_depth", 2, nil)
+	c.SetGauge("queue_depth", 2, nil)
+	c.SetGauge("queue_depth", 1, nil)
+	c.SetGauge("pool_saturation_ratio", 1, telemetry.Tags{"pool": "copy"})
+	c.SetGauge("pool_saturation_ratio", 1, telemetry.Tags{"pool": "ffmpeg"})
+
+	var expect = []string{
+		`<4>[telemetry] job_failed action=convert src=a.flac dst=a.opus kind="timed out" error="ffmpeg stalled"`,
+		`<6>[telemetry] file_removed action="" src="" dst=b.opus`,
+		`<6>[telemetry] Counted name=retries delta=1 action=convert`,
+		`<6>[telemetry] Gauge changed name=queue_depth value=2`,
+		`<6>[telemetry] Gauge changed name=queue_depth value=1`,
+		`<6>[telemetry] Gauge changed name=pool_saturation_ratio value=1 pool=copy`,
+		`<6>[telemetry] Gauge changed name=pool_saturation_ratio value=1 pool=ffmpeg`,
+	}
+
+	if got := strings.TrimSpace(buf.String()); got != strings.Join(expect, "\n") {
+		t.Fatalf("Unexpected log:\n%s", got)
+	}
+}
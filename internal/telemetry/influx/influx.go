@@ -1,10 +1,11 @@
 package influx
 
 import (
-	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/diamondburned/ffsync/internal/logger"
 	"github.com/diamondburned/ffsync/internal/telemetry"
 	"github.com/pkg/errors"
 
@@ -16,94 +17,261 @@ type Config struct {
 	Address  string `env:"FFSYNC_INFLUX_ADDRESS"`
 	Username string `env:"FFSYNC_INFLUX_USERNAME"`
 	Password string `env:"FFSYNC_INFLUX_PASSWORD"`
+
+	// InfluxDB 2.x is used if the token is given.
+	Token  string `env:"FFSYNC_INFLUX_TOKEN"`
+	Org    string `env:"FFSYNC_INFLUX_ORG"`
+	Bucket string `env:"FFSYNC_INFLUX_BUCKET"` // default Database
+
+	// BufferSize is the number of points that can be queued before new ones
+	// are dropped. The default is 1000.
+	BufferSize int `env:"FFSYNC_INFLUX_BUFFER"`
+	// Spool is the directory where batches that couldn't be written are kept
+	// until they can be, even across restarts. Batches are dropped instead if
+	// it's empty.
+	Spool string `env:"FFSYNC_INFLUX_SPOOL"`
 }
 
-func (c Config) batchPts() client.BatchPoints {
-	b, _ := client.NewBatchPoints(client.BatchPointsConfig{
-		Database: c.Database,
-	})
-	return b
+const (
+	flushFreq  = 5 * time.Second
+	maxBatch   = 5000 // points
+	maxPending = 64   // batches kept in memory
+	maxReplay  = 8    // spooled batches written per flush
+)
+
+const (
+	// maxAttempts is the number of times a batch is written before it's
+	// spooled or dropped.
+	maxAttempts = 5
+	maxBackoff  = 5 * time.Minute
+)
+
+// backoff returns the delay before writing again after the given number of
+// failed attempts. The delay doubles on every attempt.
+func backoff(attempts int) time.Duration {
+	var delay = flushFreq
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+	return delay
 }
 
 type Client struct {
-	cli client.Client
-	cfg Config
+	w   writer
 	pts chan *client.Point
 	cls chan struct{}
 	wg  *sync.WaitGroup
+	log *logger.Logger
+
+	dropped int64 // atomic
 }
 
 var _ telemetry.Telemeter = (*Client)(nil)
 
-func NewClient(cfg Config) (telemetry.Telemeter, error) {
-	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:     cfg.Address,
-		Username: cfg.Username,
-		Password: cfg.Password,
-	})
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to make a new Influx client")
-	}
-
+func NewClient(cfg Config, log *logger.Logger) (telemetry.Telemeter, error) {
 	if cfg.Database == "" {
 		cfg.Database = "ffsync"
 	}
+	if cfg.Bucket == "" {
+		cfg.Bucket = cfg.Database
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 1000
+	}
 
-	r, err := c.Query(client.NewQuery("CREATE DATABASE "+cfg.Database, "", ""))
+	var w writer
+	var err error
+
+	if cfg.Token != "" {
+		w, err = newV2Writer(cfg)
+	} else {
+		w, err = newV1Writer(cfg)
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to send query request")
-	}
-	if r.Err != "" {
-		return nil, errors.Wrap(r.Error(), "Failed to create database")
-	}
-
-	var pts = make(chan *client.Point, 25)
-	var cls = make(chan struct{})
-
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-
-	go func() {
-		var ticker = time.NewTicker(5 * time.Second)
-		defer ticker.Stop()
-		defer wg.Done()
-
-		var batch = cfg.batchPts()
-
-		for {
-			select {
-			case <-cls:
-				writeBatch(c, batch) // write before exiting
-				return
-			case <-ticker.C:
-				if len(batch.Points()) > 0 {
-					// Write the batch points in a goroutine.
-					writeBatch(c, batch)
-					// Make a new set of batch points.
-					batch = cfg.batchPts()
-				}
-			case p := <-pts:
-				// Add the point into the batch list.
-				batch.AddPoint(p)
+		return nil, err
+	}
+
+	var s *spool
+	if cfg.Spool != "" {
+		s, err = openSpool(cfg.Spool)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to open the spool")
+		}
+	}
+
+	c := &Client{
+		w:   w,
+		pts: make(chan *client.Point, cfg.BufferSize),
+		cls: make(chan struct{}),
+		wg:  &sync.WaitGroup{},
+		log: log.Component("influx"),
+	}
+
+	c.wg.Add(1)
+	go c.run(s)
+
+	return c, nil
+}
+
+// Dropped returns the number of points dropped so far, either because the
+// buffer was full or because their batch couldn't be written.
+func (c *Client) Dropped() int64 {
+	return atomic.LoadInt64(&c.dropped)
+}
+
+func (c *Client) drop(n int) {
+	atomic.AddInt64(&c.dropped, int64(n))
+}
+
+func (c *Client) run(s *spool) {
+	defer c.wg.Done()
+
+	var ticker = time.NewTicker(flushFreq)
+	defer ticker.Stop()
+
+	q := queue{c: c, spool: s}
+
+	for {
+		select {
+		case <-c.cls:
+			// Take whatever is left in the buffer.
+			for len(c.pts) > 0 {
+				q.batch = append(q.batch, <-c.pts)
+			}
+			q.add()
+			q.flush(time.Now(), true) // write before exiting
+			return
+		case now := <-ticker.C:
+			q.add()
+			q.flush(now, false)
+		case p := <-c.pts:
+			// Add the point into the batch list.
+			q.batch = append(q.batch, p)
+			if len(q.batch) >= maxBatch {
+				q.add()
 			}
 		}
-	}()
+	}
+}
 
-	return &Client{
-		cli: c,
-		cfg: cfg,
-		pts: pts,
-		cls: cls,
-		wg:  &wg,
-	}, nil
+// queue is the list of batches waiting to be written. It's only used by the
+// writing goroutine.
+type queue struct {
+	c     *Client
+	spool *spool // nil if disabled
+
+	batch   []*client.Point
+	pending [][]*client.Point
+
+	attempts int
+	next     time.Time // time of the next attempt
+	reported int64     // dropped points already reported
 }
 
-func writeBatch(c client.Client, b client.BatchPoints) {
-	if err := c.Write(b); err != nil {
-		log.Println("InfluxDB: Failed to write batch points:", err)
+// add moves the current batch into the pending list.
+func (q *queue) add() {
+	if dropped := q.c.Dropped(); dropped > q.reported {
+		q.c.log.Warn("Dropped points", "count", dropped-q.reported)
+		p, err := client.NewPoint(
+			"telemetry_dropped", nil,
+			map[string]interface{}{"count": dropped - q.reported}, time.Now(),
+		)
+		if err == nil {
+			q.batch = append(q.batch, p)
+		}
+		q.reported = dropped
+	}
+
+	if len(q.batch) == 0 {
+		return
+	}
+
+	if len(q.pending) == maxPending {
+		q.evict(1)
+	}
+
+	q.pending = append(q.pending, q.batch)
+	q.batch = nil
+}
+
+// flush writes the pending batches unless it's waiting to retry. If closing is
+// true, then the batches that fail are spooled right away.
+func (q *queue) flush(now time.Time, closing bool) {
+	if !closing && now.Before(q.next) {
+		return
+	}
+
+	for len(q.pending) > 0 {
+		if err := q.c.w.write(q.pending[0]); err != nil {
+			q.c.log.Warn("Failed to write batch points", "attempt", q.attempts+1, "error", err)
+			q.failed(now, closing)
+			return
+		}
+		q.pending = q.pending[1:]
+		q.attempts = 0
+	}
+
+	// Everything went through, so try the oldest spooled batches as well.
+	if q.spool != nil && !closing {
+		for i := 0; i < maxReplay && q.replay(); i++ {
+		}
 	}
 }
 
+func (q *queue) failed(now time.Time, closing bool) {
+	q.attempts++
+
+	if closing || q.attempts >= maxAttempts {
+		q.evict(len(q.pending))
+		q.attempts = 0
+		return
+	}
+
+	q.next = now.Add(backoff(q.attempts))
+}
+
+// evict removes the first n pending batches, spooling them if possible.
+func (q *queue) evict(n int) {
+	for _, batch := range q.pending[:n] {
+		if q.spool == nil {
+			q.c.drop(len(batch))
+			continue
+		}
+		if err := q.spool.put(batch); err != nil {
+			q.c.log.Error("Failed to spool batch points", "error", err)
+			q.c.drop(len(batch))
+		}
+	}
+
+	q.pending = q.pending[n:]
+}
+
+// replay writes the oldest spooled batch. It returns false if there's nothing
+// left to replay or the batch couldn't be written.
+func (q *queue) replay() bool {
+	name, batch, err := q.spool.oldest()
+	if err != nil {
+		q.c.log.Error("Failed to read spooled batch points", "file", name, "error", err)
+		// Don't get stuck on a bad file.
+		q.spool.remove(name)
+		return true
+	}
+	if name == "" {
+		return false
+	}
+
+	if err := q.c.w.write(batch); err != nil {
+		q.c.log.Warn("Failed to write spooled batch points", "error", err)
+		return false
+	}
+
+	q.spool.remove(name)
+	return true
+}
+
 func (c *Client) WriteDuration(dura time.Duration, name string, attrs telemetry.Extras) {
 	var now = time.Now()
 
@@ -113,18 +281,47 @@ func (c *Client) WriteDuration(dura time.Duration, name string, attrs telemetry.
 
 	attrs["duration"] = dura.Nanoseconds()
 
-	p, err := client.NewPoint(name, nil, attrs, now)
+	c.write(name, nil, attrs, now)
+}
+
+func (c *Client) AddCount(name string, delta int64, tags telemetry.Tags) {
+	c.write(name, tags, map[string]interface{}{"count": delta}, time.Now())
+}
+
+func (c *Client) SetGauge(name string, value float64, tags telemetry.Tags) {
+	c.write(name, tags, map[string]interface{}{"value": value}, time.Now())
+}
+
+func (c *Client) WriteEvent(ev telemetry.Event) {
+	var fields = map[string]interface{}{
+		"src": ev.Src,
+		"dst": ev.Dst,
+	}
+	if ev.Error != "" {
+		fields["error"] = ev.Error
+	}
+
+	c.write("events", ev.Tags(), fields, ev.Time)
+}
+
+// write queues the point without blocking. The point is dropped if the buffer
+// is full.
+func (c *Client) write(name string, tags map[string]string, fields map[string]interface{}, t time.Time) {
+	p, err := client.NewPoint(name, tags, fields, t)
 	if err != nil {
-		log.Println("BUG: NewPoint errored out:", err)
+		c.log.Error("BUG: NewPoint errored out", "error", err)
 		return
 	}
 
-	c.pts <- p
+	select {
+	case c.pts <- p:
+	default:
+		c.drop(1)
+	}
 }
 
 func (c *Client) Close() {
 	close(c.cls)
 	c.wg.Wait()
-	c.cli.Close()
-	close(c.pts)
+	c.w.close()
 }
@@ -0,0 +1,206 @@
+package influx
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/ffsync/internal/telemetry"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+type mockWriter struct {
+	fail    bool
+	written [][]*client.Point
+}
+
+func (w *mockWriter) write(points []*client.Point) error {
+	if w.fail {
+		return errors.New("unavailable")
+	}
+	w.written = append(w.written, points)
+	return nil
+}
+
+func (w *mockWriter) close() {}
+
+func TestQueueSpool(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "influx-test-")
+	if err != nil {
+		t.Fatal("Failed to mktemp:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s, err := openSpool(dir)
+	if err != nil {
+		t.Fatal("Failed to open spool:", err)
+	}
+
+	w := &mockWriter{fail: true}
+	c := &Client{w: w, pts: make(chan *client.Point, 1)}
+	q := queue{c: c, spool: s}
+
+	p, err := client.NewPoint("convert", map[string]string{"action": "convert"}, map[string]interface{}{"duration": 1}, time.Now())
+	if err != nil {
+		t.Fatal("Failed to make point:", err)
+	}
+
+	// The buffer only fits one point.
+	c.write("convert", nil, map[string]interface{}{"duration": 1}, time.Now())
+	c.write("convert", nil, map[string]interface{}{"duration": 1}, time.Now())
+	if c.Dropped() != 1 {
+		t.Fatalf("Expected 1 dropped point, got %d", c.Dropped())
+	}
+
+	var now = time.Now()
+
+	q.batch = append(q.batch, p)
+	q.add()
+
+	// Fail until the batch is spooled.
+	for i := 0; i < maxAttempts; i++ {
+		q.flush(now, false)
+		now = q.next
+	}
+
+	if len(q.pending) > 0 {
+		t.Fatal("Batch was not spooled")
+	}
+	if names, _ := s.names(); len(names) != 1 {
+		t.Fatalf("Expected 1 spooled batch, got %d", len(names))
+	}
+
+	// Recover, which should replay the spooled batch.
+	w.fail = false
+	q.flush(now, false)
+
+	if len(w.written) != 1 {
+		t.Fatalf("Expected 1 written batch, got %d", len(w.written))
+	}
+	// The dropped point is reported alongside the original one.
+	if len(w.written[0]) != 2 || w.written[0][0].Name() != "convert" {
+		t.Fatalf("Unexpected replayed batch %v", w.written[0])
+	}
+	if names, _ := s.names(); len(names) != 0 {
+		t.Fatal("Spooled batch was not removed")
+	}
+}
+
+func TestV2Writer(t *testing.T) {
+	var body, auth, query string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		auth = r.Header.Get("Authorization")
+		query = r.URL.Path + "?" + r.URL.RawQuery
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w, err := newV2Writer(Config{Address: srv.URL, Token: "t0ken", Org: "home", Bucket: "ffsync"})
+	if err != nil {
+		t.Fatal("Failed to make writer:", err)
+	}
+
+	p, _ := client.NewPoint("convert", nil, map[string]interface{}{"duration": 1}, time.Unix(1, 0))
+	if err := w.write([]*client.Point{p}); err != nil {
+		t.Fatal("Failed to write:", err)
+	}
+
+	if auth != "Token t0ken" {
+		t.Fatal("Unexpected authorization", auth)
+	}
+	if query != "/api/v2/write?bucket=ffsync&org=home&precision=ns" {
+		t.Fatal("Unexpected request", query)
+	}
+	if strings.TrimSpace(body) != "convert duration=1i 1000000000" {
+		t.Fatalf("Unexpected body %q", body)
+	}
+}
+
+func TestV1WriterCreate(t *testing.T) {
+	var up bool
+	var queries, writes []string
+
+	// Down until up is set, like an InfluxDB that isn't started yet.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/query":
+			queries = append(queries, r.FormValue("q"))
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"results":[{}]}`))
+		case "/write":
+			writes = append(writes, r.URL.Query().Get("db"))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	// Making the writer doesn't need InfluxDB.
+	w, err := newV1Writer(Config{Address: srv.URL, Database: `my "music"`})
+	if err != nil {
+		t.Fatal("Failed to make writer:", err)
+	}
+
+	p, _ := client.NewPoint("convert", nil, map[string]interface{}{"duration": 1}, time.Unix(1, 0))
+
+	if err := w.write([]*client.Point{p}); err == nil {
+		t.Fatal("Expected the write to fail while InfluxDB is down")
+	}
+
+	up = true
+
+	for i := 0; i < 2; i++ {
+		if err := w.write([]*client.Point{p}); err != nil {
+			t.Fatal("Failed to write:", err)
+		}
+	}
+
+	if len(queries) != 1 || queries[0] != `CREATE DATABASE "my \"music\""` {
+		t.Fatalf("Unexpected queries %q", queries)
+	}
+	if len(writes) != 2 || writes[0] != `my "music"` {
+		t.Fatalf("Unexpected writes %q", writes)
+	}
+}
+
+func TestPoints(t *testing.T) {
+	c := &Client{pts: make(chan *client.Point, 3)}
+
+	ev := telemetry.NewEvent(telemetry.JobFailed, "convert", "a.flac", "a.opus")
+	ev.Reason = "timed out"
+	ev.Error = "ffmpeg stalled"
+
+	c.AddCount("retries", 2, telemetry.Tags{"action": "convert"})
+	c.SetGauge("queue_depth", 3, nil)
+	c.WriteEvent(ev)
+
+	var expect = []string{
+		`retries,action=convert count=2i`,
+		`queue_depth value=3`,
+		`events,action=convert,reason=timed\ out,type=job_failed dst="a.opus",error="ffmpeg stalled",src="a.flac"`,
+	}
+
+	for _, line := range expect {
+		p := <-c.pts
+		// Strip the timestamp.
+		got := p.String()
+		got = got[:strings.LastIndexByte(got, ' ')]
+
+		if got != line {
+			t.Errorf("Expected point %s, got %s", line, got)
+		}
+	}
+}
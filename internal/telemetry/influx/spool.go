@@ -0,0 +1,106 @@
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/pkg/errors"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+// maxSpooled is the number of batches kept in the spool. The oldest ones are
+// removed past that.
+const maxSpooled = 1000
+
+// spool keeps batches of points in a directory as line protocol files, one
+// file per batch, named after the time they were spooled.
+type spool struct {
+	dir string
+}
+
+func openSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &spool{dir}, nil
+}
+
+func (s *spool) names() ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.lp"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// put writes the batch into the spool.
+func (s *spool) put(points []*client.Point) error {
+	var buf bytes.Buffer
+	for _, p := range points {
+		buf.WriteString(p.String())
+		buf.WriteByte('\n')
+	}
+
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d.lp", time.Now().UnixNano()))
+	tmp := filepath.Join(s.dir, "."+filepath.Base(name))
+
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	names, err := s.names()
+	if err != nil {
+		return err
+	}
+	for len(names) > maxSpooled {
+		s.remove(names[0])
+		names = names[1:]
+	}
+
+	return nil
+}
+
+// oldest returns the oldest batch in the spool and its file name. The name is
+// empty if the spool is empty.
+func (s *spool) oldest() (string, []*client.Point, error) {
+	names, err := s.names()
+	if err != nil || len(names) == 0 {
+		return "", nil, err
+	}
+
+	b, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		return names[0], nil, err
+	}
+
+	parsed, err := models.ParsePoints(b)
+	if err != nil {
+		return names[0], nil, errors.Wrap(err, "failed to parse "+names[0])
+	}
+
+	points := make([]*client.Point, len(parsed))
+	for i, p := range parsed {
+		points[i] = client.NewPointFrom(p)
+	}
+
+	return names[0], points, nil
+}
+
+func (s *spool) remove(name string) {
+	if name != "" {
+		os.Remove(name)
+	}
+}
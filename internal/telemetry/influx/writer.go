@@ -0,0 +1,145 @@
+package influx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+// writer writes batches of points into a database.
+type writer interface {
+	write(points []*client.Point) error
+	close()
+}
+
+// v1Writer writes into InfluxDB 1.x. The database is created before the first
+// write, so that InfluxDB doesn't need to be up when ffsync starts.
+type v1Writer struct {
+	cli     client.Client
+	cfg     Config
+	created bool
+}
+
+func newV1Writer(cfg Config) (writer, error) {
+	c, err := client.NewHTTPClient(client.HTTPConfig{
+		Addr:     cfg.Address,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		Timeout:  30 * time.Second,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to make a new Influx client")
+	}
+
+	return &v1Writer{cli: c, cfg: cfg}, nil
+}
+
+// quoteIdent quotes an identifier of InfluxQL.
+func quoteIdent(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+// create creates the database if it hasn't been yet.
+func (w *v1Writer) create() error {
+	if w.created {
+		return nil
+	}
+
+	r, err := w.cli.Query(client.NewQuery("CREATE DATABASE "+quoteIdent(w.cfg.Database), "", ""))
+	if err != nil {
+		return errors.Wrap(err, "failed to create database")
+	}
+	if r.Error() != nil {
+		return errors.Wrap(r.Error(), "failed to create database")
+	}
+
+	w.created = true
+	return nil
+}
+
+func (w *v1Writer) write(points []*client.Point) error {
+	if err := w.create(); err != nil {
+		return err
+	}
+
+	b, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database: w.cfg.Database,
+	})
+	if err != nil {
+		return err
+	}
+
+	b.AddPoints(points)
+	return w.cli.Write(b)
+}
+
+func (w *v1Writer) close() {
+	w.cli.Close()
+}
+
+// v2Writer writes into InfluxDB 2.x using its HTTP API, which the 1.x client
+// doesn't support.
+type v2Writer struct {
+	http  *http.Client
+	url   string
+	token string
+}
+
+func newV2Writer(cfg Config) (writer, error) {
+	u, err := url.Parse(cfg.Address)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the Influx address")
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	u.RawQuery = url.Values{
+		"org":       {cfg.Org},
+		"bucket":    {cfg.Bucket},
+		"precision": {"ns"},
+	}.Encode()
+
+	return v2Writer{
+		http:  &http.Client{Timeout: 30 * time.Second},
+		url:   u.String(),
+		token: cfg.Token,
+	}, nil
+}
+
+func (w v2Writer) write(points []*client.Point) error {
+	var body bytes.Buffer
+	for _, p := range points {
+		body.WriteString(p.String())
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest("POST", w.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+w.token)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	r, err := w.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(r.Body)
+		return errors.Errorf("unexpected status %s: %s", r.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+func (w v2Writer) close() {
+	w.http.CloseIdleConnections()
+}
@@ -0,0 +1,109 @@
+package prometheus
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/diamondburned/ffsync/internal/logger"
+	"github.com/diamondburned/ffsync/internal/telemetry"
+
+	client "github.com/prometheus/client_golang/prometheus"
+)
+
+// dynamic makes counters and gauges the first time they're written to. Their
+// labels are the tag keys given then; later writes with different tags are
+// dropped.
+type dynamic struct {
+	reg *client.Registry
+	log *logger.Logger
+
+	mutex    sync.Mutex
+	counters map[string]*client.CounterVec
+	gauges   map[string]*client.GaugeVec
+}
+
+func newDynamic(reg *client.Registry, log *logger.Logger) *dynamic {
+	return &dynamic{
+		reg:      reg,
+		log:      log,
+		counters: map[string]*client.CounterVec{},
+		gauges:   map[string]*client.GaugeVec{},
+	}
+}
+
+func (d *dynamic) counter(name string, tags telemetry.Tags) (client.Counter, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	vec, ok := d.counters[name]
+	if !ok {
+		vec = client.NewCounterVec(client.CounterOpts{
+			Name: "ffsync_" + name + "_total",
+			Help: "Counter " + name + ".",
+		}, labelNames(tags))
+
+		if !d.register(name, vec) {
+			vec = nil
+		}
+		d.counters[name] = vec
+	}
+
+	if vec == nil {
+		return nil, false
+	}
+
+	c, err := vec.GetMetricWith(client.Labels(tags))
+	if err != nil {
+		d.log.Warn("Dropping counter", "name", name, "error", err)
+		return nil, false
+	}
+
+	return c, true
+}
+
+func (d *dynamic) gauge(name string, tags telemetry.Tags) (client.Gauge, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	vec, ok := d.gauges[name]
+	if !ok {
+		vec = client.NewGaugeVec(client.GaugeOpts{
+			Name: "ffsync_" + name,
+			Help: "Gauge " + name + ".",
+		}, labelNames(tags))
+
+		if !d.register(name, vec) {
+			vec = nil
+		}
+		d.gauges[name] = vec
+	}
+
+	if vec == nil {
+		return nil, false
+	}
+
+	g, err := vec.GetMetricWith(client.Labels(tags))
+	if err != nil {
+		d.log.Warn("Dropping gauge", "name", name, "error", err)
+		return nil, false
+	}
+
+	return g, true
+}
+
+func (d *dynamic) register(name string, c client.Collector) bool {
+	if err := d.reg.Register(c); err != nil {
+		d.log.Warn("Failed to register", "name", name, "error", err)
+		return false
+	}
+	return true
+}
+
+func labelNames(tags telemetry.Tags) []string {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
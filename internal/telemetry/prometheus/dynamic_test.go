@@ -0,0 +1,47 @@
+package prometheus
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/diamondburned/ffsync/internal/logger"
+	"github.com/diamondburned/ffsync/internal/telemetry"
+
+	client "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDynamic(t *testing.T) {
+	reg := client.NewRegistry()
+	c := &Client{dyn: newDynamic(reg, logger.New(ioutil.Discard, logger.Config{}))}
+
+	c.AddCount("retries", 2, telemetry.Tags{"action": "convert"})
+	c.AddCount("retries", 1, telemetry.Tags{"action": "convert"})
+	c.AddCount("retries", 1, telemetry.Tags{"action": "copy"})
+	c.SetGauge("workers", 2, telemetry.Tags{"pool": "ffmpeg"})
+	c.SetGauge("workers", 4, telemetry.Tags{"pool": "ffmpeg"})
+
+	// Different labels than the first write, so these are dropped.
+	c.AddCount("retries", 1, telemetry.Tags{"pool": "copy"})
+	c.SetGauge("workers", 8, nil)
+
+	// Scraped from the state instead.
+	c.SetGauge("queue_depth", 100, nil)
+
+	const expect = `
+# HELP ffsync_retries_total Counter retries.
+# TYPE ffsync_retries_total counter
+ffsync_retries_total{action="convert"} 3
+ffsync_retries_total{action="copy"} 1
+# HELP ffsync_workers Gauge workers.
+# TYPE ffsync_workers gauge
+ffsync_workers{pool="ffmpeg"} 4
+`
+
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expect),
+		"ffsync_retries_total", "ffsync_workers", "ffsync_queue_depth")
+	if err != nil {
+		t.Fatal("Unexpected metrics:", err)
+	}
+}
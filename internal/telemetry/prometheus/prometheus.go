@@ -0,0 +1,173 @@
+package prometheus
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/diamondburned/ffsync/internal/logger"
+	"github.com/diamondburned/ffsync/internal/telemetry"
+	"github.com/pkg/errors"
+
+	client "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type Config struct {
+	Address string `env:"FFSYNC_PROMETHEUS_ADDRESS"` // for example ":9090"
+}
+
+// State is the current state of the application, which is read on every
+// scrape.
+type State struct {
+	Queued   int // jobs waiting for a worker or a retry
+	InFlight int // running ffmpeg processes
+	// Saturation is the ratio of busy workers in each pool.
+	Saturation map[string]float64
+}
+
+type Client struct {
+	srv *http.Server
+	dyn *dynamic
+
+	files      *client.CounterVec
+	events     *client.CounterVec
+	duration   *client.HistogramVec
+	speed      client.Histogram
+	outputSize *client.HistogramVec
+}
+
+var _ telemetry.Telemeter = (*Client)(nil)
+
+// NewClient starts serving the metrics on /metrics at the configured address.
+// The state function is called for the gauges on every scrape.
+func NewClient(cfg Config, state func() State, log *logger.Logger) (telemetry.Telemeter, error) {
+	log = log.Component("prometheus")
+
+	c := &Client{
+		files: client.NewCounterVec(client.CounterOpts{
+			Name: "ffsync_files_total",
+			Help: "Files synchronized by action and result, and the reason for failures.",
+		}, []string{"action", "result", "reason"}),
+		events: client.NewCounterVec(client.CounterOpts{
+			Name: "ffsync_events_total",
+			Help: "Job and file events by type and action.",
+		}, []string{"type", "action"}),
+		duration: client.NewHistogramVec(client.HistogramOpts{
+			Name:    "ffsync_job_duration_seconds",
+			Help:    "Time taken to convert or copy a file.",
+			Buckets: client.ExponentialBuckets(0.05, 2, 14), // 50ms to ~7m
+		}, []string{"action"}),
+		speed: client.NewHistogram(client.HistogramOpts{
+			Name:    "ffsync_convert_realtime_multiplier",
+			Help:    "How many times faster than realtime files were converted.",
+			Buckets: client.ExponentialBuckets(1, 2, 10), // 1x to 512x
+		}),
+		outputSize: client.NewHistogramVec(client.HistogramOpts{
+			Name:    "ffsync_output_size_bytes",
+			Help:    "Size of the written outputs.",
+			Buckets: client.ExponentialBuckets(64<<10, 2, 12), // 64KB to 128MB
+		}, []string{"action"}),
+	}
+
+	reg := client.NewRegistry()
+	reg.MustRegister(
+		c.files, c.events, c.duration, c.speed, c.outputSize,
+		stateCollector(state),
+		client.NewGoCollector(),
+		client.NewProcessCollector(client.ProcessCollectorOpts{}),
+	)
+
+	c.dyn = newDynamic(reg, log)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	c.srv = &http.Server{Addr: cfg.Address, Handler: mux}
+
+	// Listen first, so that a bad address is reported right away.
+	l, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to listen for Prometheus")
+	}
+
+	go func() {
+		if err := c.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("Failed to serve", "error", err)
+		}
+	}()
+
+	return c, nil
+}
+
+func (c *Client) WriteDuration(dura time.Duration, name string, attrs telemetry.Extras) {
+	switch name {
+	case "convert", "copy":
+		c.duration.WithLabelValues(name).Observe(dura.Seconds())
+
+		if size, ok := number(attrs["wrote_bytes"]); ok {
+			c.outputSize.WithLabelValues(name).Observe(size)
+		}
+		if speed, ok := number(attrs["realtime_mult"]); ok && speed > 0 {
+			c.speed.Observe(speed)
+		}
+	}
+}
+
+func (c *Client) AddCount(name string, delta int64, tags telemetry.Tags) {
+	if counter, ok := c.dyn.counter(name, tags); ok {
+		counter.Add(float64(delta))
+	}
+}
+
+// scrapedGauges are the gauges that are read from the state on every scrape
+// instead.
+var scrapedGauges = map[string]bool{
+	"queue_depth":           true,
+	"ffmpeg_in_flight":      true,
+	"pool_saturation_ratio": true,
+}
+
+func (c *Client) SetGauge(name string, value float64, tags telemetry.Tags) {
+	if scrapedGauges[name] {
+		return
+	}
+	if gauge, ok := c.dyn.gauge(name, tags); ok {
+		gauge.Set(value)
+	}
+}
+
+func (c *Client) WriteEvent(ev telemetry.Event) {
+	c.events.WithLabelValues(string(ev.Type), ev.Action).Inc()
+
+	switch ev.Type {
+	case telemetry.JobSucceeded:
+		c.files.WithLabelValues(ev.Action, "succeeded", "").Inc()
+	case telemetry.JobFailed:
+		c.files.WithLabelValues(ev.Action, "failed", ev.Reason).Inc()
+	}
+}
+
+func (c *Client) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c.srv.Shutdown(ctx)
+}
+
+// number converts the numeric extra into a float64.
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
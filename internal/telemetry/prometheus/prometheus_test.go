@@ -0,0 +1,37 @@
+package prometheus
+
+import (
+	"strings"
+	"testing"
+
+	client "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStateCollector(t *testing.T) {
+	reg := client.NewRegistry()
+	reg.MustRegister(stateCollector(func() State {
+		return State{
+			Queued:     3,
+			InFlight:   1,
+			Saturation: map[string]float64{"copy": 0.25, "ffmpeg": 1},
+		}
+	}))
+
+	const expect = `
+# HELP ffsync_ffmpeg_in_flight Running ffmpeg processes.
+# TYPE ffsync_ffmpeg_in_flight gauge
+ffsync_ffmpeg_in_flight 1
+# HELP ffsync_pool_saturation_ratio Ratio of busy workers in the pool.
+# TYPE ffsync_pool_saturation_ratio gauge
+ffsync_pool_saturation_ratio{pool="copy"} 0.25
+ffsync_pool_saturation_ratio{pool="ffmpeg"} 1
+# HELP ffsync_queue_depth Jobs waiting for a worker or a retry.
+# TYPE ffsync_queue_depth gauge
+ffsync_queue_depth 3
+`
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expect)); err != nil {
+		t.Fatal("Unexpected metrics:", err)
+	}
+}
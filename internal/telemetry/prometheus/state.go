@@ -0,0 +1,41 @@
+package prometheus
+
+import client "github.com/prometheus/client_golang/prometheus"
+
+var (
+	queuedDesc = client.NewDesc(
+		"ffsync_queue_depth",
+		"Jobs waiting for a worker or a retry.",
+		nil, nil,
+	)
+	inFlightDesc = client.NewDesc(
+		"ffsync_ffmpeg_in_flight",
+		"Running ffmpeg processes.",
+		nil, nil,
+	)
+	saturationDesc = client.NewDesc(
+		"ffsync_pool_saturation_ratio",
+		"Ratio of busy workers in the pool.",
+		[]string{"pool"}, nil,
+	)
+)
+
+// stateCollector collects the gauges from the state function on every scrape.
+type stateCollector func() State
+
+func (fn stateCollector) Describe(ch chan<- *client.Desc) {
+	ch <- queuedDesc
+	ch <- inFlightDesc
+	ch <- saturationDesc
+}
+
+func (fn stateCollector) Collect(ch chan<- client.Metric) {
+	state := fn()
+
+	ch <- client.MustNewConstMetric(queuedDesc, client.GaugeValue, float64(state.Queued))
+	ch <- client.MustNewConstMetric(inFlightDesc, client.GaugeValue, float64(state.InFlight))
+
+	for pool, ratio := range state.Saturation {
+		ch <- client.MustNewConstMetric(saturationDesc, client.GaugeValue, ratio, pool)
+	}
+}
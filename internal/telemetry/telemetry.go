@@ -4,9 +4,68 @@ import "time"
 
 type Extras = map[string]interface{}
 
+// Tags are indexed attributes, such as the action of a job. Unlike extras,
+// they should only have a few distinct values.
+type Tags = map[string]string
+
 type Telemeter interface {
 	Close()
 	WriteDuration(dura time.Duration, name string, attrs Extras)
+	// AddCount adds delta to the counter of the given name.
+	AddCount(name string, delta int64, tags Tags)
+	// SetGauge sets the current value of the gauge of the given name.
+	SetGauge(name string, value float64, tags Tags)
+	// WriteEvent records something that happened to a file.
+	WriteEvent(ev Event)
+}
+
+type EventType string
+
+const (
+	JobQueued    EventType = "job_queued"
+	JobStarted   EventType = "job_started"
+	JobFailed    EventType = "job_failed"
+	JobSucceeded EventType = "job_succeeded"
+	FileRemoved  EventType = "file_removed"
+	FileRenamed  EventType = "file_renamed"
+)
+
+// Event is something that happened to a file.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Action is the job's action, such as "copy" or "convert". It's empty for
+	// file events.
+	Action string
+	// Src is the source file of a job, or the old path of a renamed file.
+	Src string
+	Dst string
+	// Reason is the short reason a job failed, which failures are grouped by.
+	Reason string
+	Error  string
+}
+
+// NewEvent creates an event of the given type that happened now.
+func NewEvent(t EventType, action, src, dst string) Event {
+	return Event{
+		Type:   t,
+		Time:   time.Now(),
+		Action: action,
+		Src:    src,
+		Dst:    dst,
+	}
+}
+
+// Tags returns the tags of the event.
+func (ev Event) Tags() Tags {
+	tags := Tags{"type": string(ev.Type)}
+	if ev.Action != "" {
+		tags["action"] = ev.Action
+	}
+	if ev.Reason != "" {
+		tags["reason"] = ev.Reason
+	}
+	return tags
 }
 
 func Batch(ts ...Telemeter) Telemeter {
@@ -30,3 +89,21 @@ func (b batchTelemeter) WriteDuration(dura time.Duration, name string, attrs Ext
 		t.WriteDuration(dura, name, attrs)
 	}
 }
+
+func (b batchTelemeter) AddCount(name string, delta int64, tags Tags) {
+	for _, t := range b.telemeters {
+		t.AddCount(name, delta, tags)
+	}
+}
+
+func (b batchTelemeter) SetGauge(name string, value float64, tags Tags) {
+	for _, t := range b.telemeters {
+		t.SetGauge(name, value, tags)
+	}
+}
+
+func (b batchTelemeter) WriteEvent(ev Event) {
+	for _, t := range b.telemeters {
+		t.WriteEvent(ev)
+	}
+}
@@ -0,0 +1,83 @@
+package telemetry
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recorder records every call as a line.
+type recorder struct {
+	name  string
+	calls *[]string
+}
+
+func (r recorder) record(format string, v ...interface{}) {
+	*r.calls = append(*r.calls, r.name+": "+fmt.Sprintf(format, v...))
+}
+
+func (r recorder) Close() { r.record("close") }
+
+func (r recorder) WriteDuration(dura time.Duration, name string, attrs Extras) {
+	r.record("duration %s %v %v", name, dura, attrs)
+}
+
+func (r recorder) AddCount(name string, delta int64, tags Tags) {
+	r.record("count %s %d %v", name, delta, tags)
+}
+
+func (r recorder) SetGauge(name string, value float64, tags Tags) {
+	r.record("gauge %s %v %v", name, value, tags)
+}
+
+func (r recorder) WriteEvent(ev Event) {
+	r.record("event %s %s %s %v", ev.Type, ev.Action, ev.Src, ev.Tags())
+}
+
+func TestBatch(t *testing.T) {
+	var calls []string
+	b := Batch(recorder{"a", &calls}, recorder{"b", &calls})
+
+	ev := NewEvent(JobFailed, "convert", "a.flac", "a.opus")
+	ev.Reason = "timed out"
+
+	b.WriteDuration(time.Second, "convert", Extras{"wrote_bytes": 1})
+	b.AddCount("retries", 2, Tags{"action": "copy"})
+	b.SetGauge("queue_depth", 3, nil)
+	b.WriteEvent(ev)
+	b.Close()
+
+	var expect = []string{
+		"a: duration convert 1s map[wrote_bytes:1]",
+		"b: duration convert 1s map[wrote_bytes:1]",
+		"a: count retries 2 map[action:copy]",
+		"b: count retries 2 map[action:copy]",
+		"a: gauge queue_depth 3 map[]",
+		"b: gauge queue_depth 3 map[]",
+		"a: event job_failed convert a.flac map[action:convert reason:timed out type:job_failed]",
+		"b: event job_failed convert a.flac map[action:convert reason:timed out type:job_failed]",
+		"a: close",
+		"b: close",
+	}
+
+	if got := strings.Join(calls, "\n"); got != strings.Join(expect, "\n") {
+		t.Fatalf("Unexpected calls:\n%s", got)
+	}
+}
+
+func TestEventTags(t *testing.T) {
+	var tests = []struct {
+		ev     Event
+		expect string
+	}{
+		{NewEvent(FileRemoved, "", "", "a.opus"), "map[type:file_removed]"},
+		{NewEvent(JobQueued, "copy", "a.jpg", "a.jpg"), "map[action:copy type:job_queued]"},
+	}
+
+	for _, test := range tests {
+		if got := fmt.Sprint(test.ev.Tags()); got != test.expect {
+			t.Errorf("%s: expected %s, got %s", test.ev.Type, test.expect, got)
+		}
+	}
+}
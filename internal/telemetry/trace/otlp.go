@@ -0,0 +1,309 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/diamondburned/ffsync/internal/logger"
+	"github.com/pkg/errors"
+)
+
+type Config struct {
+	Endpoint string `env:"FFSYNC_OTLP_ENDPOINT"` // for example "http://localhost:4318"
+	Headers  string `env:"FFSYNC_OTLP_HEADERS"`  // "key=value,key=value"
+	Service  string `env:"FFSYNC_OTLP_SERVICE"`  // default "ffsync"
+}
+
+const (
+	exportFreq  = 5 * time.Second
+	exportBatch = 512  // spans
+	exportQueue = 4096 // spans
+)
+
+// Exporter sends ended spans to an OTLP collector over HTTP using the JSON
+// encoding. Spans are batched, and dropped if the collector can't keep up.
+type Exporter struct {
+	http    *http.Client
+	url     string
+	headers http.Header
+	service string
+	log     *logger.Logger
+
+	spans chan *Span
+	cls   chan struct{}
+	wg    sync.WaitGroup
+
+	dropped int64 // atomic
+}
+
+func NewExporter(cfg Config, log *logger.Logger) (*Exporter, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the OTLP endpoint")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/traces"
+
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/json")
+
+	for _, kv := range strings.Split(cfg.Headers, ",") {
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid OTLP header %q", kv)
+		}
+		headers.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	if cfg.Service == "" {
+		cfg.Service = "ffsync"
+	}
+
+	e := &Exporter{
+		http:    &http.Client{Timeout: 30 * time.Second},
+		url:     u.String(),
+		headers: headers,
+		service: cfg.Service,
+		log:     log.Component("otlp"),
+		spans:   make(chan *Span, exportQueue),
+		cls:     make(chan struct{}),
+	}
+
+	e.wg.Add(1)
+	go e.run()
+
+	return e, nil
+}
+
+// Dropped returns the number of spans dropped so far.
+func (e *Exporter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+// export queues the ended span without blocking.
+func (e *Exporter) export(s *Span) {
+	select {
+	case e.spans <- s:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+func (e *Exporter) run() {
+	defer e.wg.Done()
+
+	var ticker = time.NewTicker(exportFreq)
+	defer ticker.Stop()
+
+	var batch []*Span
+
+	for {
+		select {
+		case <-e.cls:
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+			}
+			e.send(batch)
+			return
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) >= exportBatch {
+				e.send(batch)
+				batch = nil
+			}
+		}
+	}
+}
+
+func (e *Exporter) send(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+
+	if err := e.post(spans); err != nil {
+		e.log.Warn("Failed to export spans", "spans", len(spans), "error", err)
+		atomic.AddInt64(&e.dropped, int64(len(spans)))
+	}
+}
+
+func (e *Exporter) post(spans []*Span) error {
+	b, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return errors.Wrap(err, "failed to encode")
+	}
+
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header = e.headers.Clone()
+
+	r, err := e.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(r.Body)
+		return errors.Errorf("unexpected status %s: %s", r.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+// Close exports the queued spans and stops the exporter.
+func (e *Exporter) Close() {
+	close(e.cls)
+	e.wg.Wait()
+	e.http.CloseIdleConnections()
+}
+
+// The OTLP JSON encoding, which only has what's used here. IDs are hex, and
+// 64-bit integers are strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+const (
+	spanKindInternal = 1
+	statusOK         = 1
+	statusError      = 2
+)
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (e *Exporter) encode(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, len(spans))
+
+	for i, s := range spans {
+		s.mutex.Lock()
+
+		encoded[i] = otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.ID.String(),
+			Name:              s.Name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        attributes(s.Attrs),
+			Status:            otlpStatus{Code: statusOK},
+		}
+		if s.ParentID != (SpanID{}) {
+			encoded[i].ParentSpanID = s.ParentID.String()
+		}
+		if s.Err != nil {
+			encoded[i].Status = otlpStatus{Code: statusError, Message: s.Err.Error()}
+		}
+
+		s.mutex.Unlock()
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: attributes(map[string]interface{}{"service.name": e.service}),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "ffsync"},
+				Spans: encoded,
+			}},
+		}},
+	}
+}
+
+// attributes encodes the attributes sorted by key.
+func attributes(attrs map[string]interface{}) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+
+	for k, v := range attrs {
+		var value otlpAnyValue
+
+		switch v := v.(type) {
+		case string:
+			value.StringValue = &v
+		case bool:
+			value.BoolValue = &v
+		case int:
+			i := strconv.Itoa(v)
+			value.IntValue = &i
+		case int64:
+			i := strconv.FormatInt(v, 10)
+			value.IntValue = &i
+		case float32:
+			f := float64(v)
+			value.DoubleValue = &f
+		case float64:
+			value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: value})
+	}
+
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs
+}
@@ -0,0 +1,182 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestExporter(t *testing.T) {
+	var requests []otlpRequest
+	var auth string
+
+	// A stand-in for the collector.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Error("Unexpected path", r.URL.Path)
+		}
+		auth = r.Header.Get("Authorization")
+
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error("Failed to decode request:", err)
+		}
+		requests = append(requests, req)
+	}))
+	defer srv.Close()
+
+	exp, err := NewExporter(Config{Endpoint: srv.URL, Headers: "Authorization=Bearer t0ken"}, nil)
+	if err != nil {
+		t.Fatal("Failed to make exporter:", err)
+	}
+
+	tracer := NewTracer(exp)
+
+	ctx, job := tracer.Start(context.Background(), "convert")
+	job.SetAttr("cover", true)
+
+	_, encode := tracer.Start(ctx, "encode")
+	encode.Fail(errors.New("corrupt input"))
+	encode.Finish()
+
+	job.Finish()
+	job.Finish() // only exported once
+
+	// Closing flushes the queued spans.
+	exp.Close()
+
+	if auth != "Bearer t0ken" {
+		t.Fatal("Unexpected authorization", auth)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(requests))
+	}
+
+	spans := requests[0].ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+
+	child, parent := spans[0], spans[1]
+
+	if child.TraceID != parent.TraceID {
+		t.Fatal("Spans are in different traces")
+	}
+	if child.ParentSpanID != parent.SpanID || parent.ParentSpanID != "" {
+		t.Fatal("Unexpected parents", child.ParentSpanID, parent.ParentSpanID)
+	}
+	if child.Status.Code != statusError || child.Status.Message != "corrupt input" {
+		t.Fatalf("Unexpected status %+v", child.Status)
+	}
+	if len(parent.Attributes) != 1 || *parent.Attributes[0].Value.BoolValue != true {
+		t.Fatalf("Unexpected attributes %+v", parent.Attributes)
+	}
+}
+
+// TestExporterJSON checks the emitted JSON against the OTLP encoding itself,
+// rather than the structs it's encoded from.
+func TestExporterJSON(t *testing.T) {
+	var bodies []map[string]interface{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error("Failed to decode request:", err)
+		}
+		bodies = append(bodies, body)
+	}))
+	defer srv.Close()
+
+	exp, err := NewExporter(Config{Endpoint: srv.URL + "/", Service: "test"}, nil)
+	if err != nil {
+		t.Fatal("Failed to make exporter:", err)
+	}
+
+	var start = time.Unix(1600000000, 0)
+
+	ctx, job := NewTracer(exp).StartAt(context.Background(), "convert", start)
+	job.SetAttr("wrote_bytes", int64(1<<20))
+	job.SetAttr("realtime_mult", 42.5)
+
+	_, stable := job.tracer.StartAt(ctx, "stable", start)
+	stable.FinishAt(start.Add(2 * time.Second))
+
+	job.Finish()
+	exp.Close()
+
+	if len(bodies) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(bodies))
+	}
+
+	var rs = bodies[0]["resourceSpans"].([]interface{})[0].(map[string]interface{})
+
+	var resource = rs["resource"].(map[string]interface{})["attributes"].([]interface{})
+	var service = resource[0].(map[string]interface{})
+	if service["key"] != "service.name" || service["value"].(map[string]interface{})["stringValue"] != "test" {
+		t.Errorf("Unexpected resource attributes %v", resource)
+	}
+
+	var spans = rs["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+
+	child, parent := spans[0].(map[string]interface{}), spans[1].(map[string]interface{})
+
+	// IDs are hex, and 64-bit integers are strings.
+	hex := regexp.MustCompile(`^[0-9a-f]+$`)
+	for _, span := range []map[string]interface{}{child, parent} {
+		traceID, _ := span["traceId"].(string)
+		spanID, _ := span["spanId"].(string)
+		if len(traceID) != 32 || !hex.MatchString(traceID) || len(spanID) != 16 || !hex.MatchString(spanID) {
+			t.Errorf("Unexpected IDs %q, %q", traceID, spanID)
+		}
+		if span["kind"] != float64(spanKindInternal) {
+			t.Errorf("Unexpected kind %v", span["kind"])
+		}
+		if span["status"].(map[string]interface{})["code"] != float64(statusOK) {
+			t.Errorf("Unexpected status %v", span["status"])
+		}
+	}
+
+	if child["name"] != "stable" || child["parentSpanId"] != parent["spanId"] {
+		t.Errorf("Unexpected child span %v", child)
+	}
+	if _, ok := parent["parentSpanId"]; ok {
+		t.Error("Root span has a parent")
+	}
+	if child["startTimeUnixNano"] != "1600000000000000000" || child["endTimeUnixNano"] != "1600000002000000000" {
+		t.Errorf("Unexpected times %v, %v", child["startTimeUnixNano"], child["endTimeUnixNano"])
+	}
+
+	var attrs = parent["attributes"].([]interface{})
+	if len(attrs) != 2 {
+		t.Fatalf("Unexpected attributes %v", attrs)
+	}
+	mult := attrs[0].(map[string]interface{})
+	wrote := attrs[1].(map[string]interface{})
+	if mult["key"] != "realtime_mult" || mult["value"].(map[string]interface{})["doubleValue"] != 42.5 {
+		t.Errorf("Unexpected attribute %v", mult)
+	}
+	if wrote["key"] != "wrote_bytes" || wrote["value"].(map[string]interface{})["intValue"] != "1048576" {
+		t.Errorf("Unexpected attribute %v", wrote)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+
+	ctx, span := tracer.Start(context.Background(), "convert")
+	span.SetAttr("cover", true)
+	span.Fail(errors.New("failed"))
+	span.Finish()
+
+	if FromContext(ctx) != nil {
+		t.Fatal("Nil tracer made a span")
+	}
+}
@@ -0,0 +1,132 @@
+// Package trace records the stages of synchronizing a file as spans of a trace
+// and exports them over OTLP.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// Tracer starts spans and exports them once they end. A nil Tracer starts nil
+// spans, which do nothing, so tracing can be disabled by not making one.
+type Tracer struct {
+	exp *Exporter
+}
+
+// NewTracer creates a tracer that exports spans using the given exporter.
+func NewTracer(exp *Exporter) *Tracer {
+	return &Tracer{exp: exp}
+}
+
+// Start starts a span now. See StartAt.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	return t.StartAt(ctx, name, time.Now())
+}
+
+// StartAt starts a span at the given time. The span is a child of the span in
+// the context if there's one; otherwise, it starts a new trace. The returned
+// context carries the new span.
+func (t *Tracer) StartAt(ctx context.Context, name string, start time.Time) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &Span{
+		tracer: t,
+		Name:   name,
+		Start:  start,
+		Attrs:  map[string]interface{}{},
+	}
+	rand.Read(s.ID[:])
+
+	if parent := FromContext(ctx); parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.ID
+	} else {
+		rand.Read(s.TraceID[:])
+	}
+
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// Span is a timed stage of a trace. Every method is safe to call on a nil
+// Span.
+type Span struct {
+	tracer *Tracer
+
+	TraceID  TraceID
+	ID       SpanID
+	ParentID SpanID // zero for the root span
+	Name     string
+	Start    time.Time
+
+	mutex sync.Mutex
+	End   time.Time
+	Attrs map[string]interface{}
+	Err   error
+	ended bool
+}
+
+// SetAttr sets an attribute of the span.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.Attrs[key] = value
+	s.mutex.Unlock()
+}
+
+// Fail marks the span as failed with the given error, if it's not nil.
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.Err = err
+	s.mutex.Unlock()
+}
+
+// Finish ends the span now and exports it. Only the first call does anything.
+func (s *Span) Finish() {
+	s.FinishAt(time.Now())
+}
+
+// FinishAt ends the span at the given time and exports it. See Finish.
+func (s *Span) FinishAt(end time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = end
+	s.mutex.Unlock()
+
+	s.tracer.exp.export(s)
+}
+
+type ctxKey uint8
+
+const spanKey ctxKey = iota
+
+// FromContext returns the span in the context, or nil if there's none.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
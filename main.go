@@ -2,163 +2,755 @@ package main
 
 import (
 	"context"
-	"log"
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	gosync "sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Netflix/go-env"
 	"github.com/diamondburned/ffsync/ffmpeg"
 	"github.com/diamondburned/ffsync/ffmpeg/cover"
 	"github.com/diamondburned/ffsync/ffmpeg/opus"
+	"github.com/diamondburned/ffsync/internal/api"
+	"github.com/diamondburned/ffsync/internal/history"
+	"github.com/diamondburned/ffsync/internal/jobs"
+	"github.com/diamondburned/ffsync/internal/logger"
 	"github.com/diamondburned/ffsync/internal/osutil"
+	"github.com/diamondburned/ffsync/internal/outputs"
+	"github.com/diamondburned/ffsync/internal/retry"
 	"github.com/diamondburned/ffsync/internal/telemetry"
 	"github.com/diamondburned/ffsync/internal/telemetry/fallback"
 	"github.com/diamondburned/ffsync/internal/telemetry/influx"
+	"github.com/diamondburned/ffsync/internal/telemetry/prometheus"
+	"github.com/diamondburned/ffsync/internal/telemetry/trace"
 	"github.com/diamondburned/ffsync/sync"
-	"golang.org/x/sync/semaphore"
+	"github.com/pkg/errors"
 )
 
-func main() {
-	var config struct {
-		Influx influx.Config
+// watchMain implements the watch command.
+func watchMain(cmd command, args []string) {
+	fs := cmd.flags()
+	configPath, sets := configFlags(fs)
+	fs.Parse(args)
 
-		Formats     string `env:"FFSYNC_FORMATS"`
-		CopyFormats string `env:"FFSYNC_COPY_FORMATS"`
-		Frequency   string `env:"FFSYNC_FREQUENCY"`
-		Bitrate     string `env:"FFSYNC_BITRATE"`
-		CoverSize   string `env:"FFSYNC_COVER_SIZE"`
-		CoverQ      string `env:"FFSYNC_COVER_Q"`
+	var set = commandSettings(fs, *configPath, *sets, true)
+
+	requireFFmpeg()
+
+	var l = logger.New(os.Stderr, set.Log)
+
+	var t = fallback.New(l)
+	if set.Influx.Address != "" {
+		client, err := influx.NewClient(set.Influx, l)
+		if err != nil {
+			l.Fatal("InfluxDB error", "error", err)
+		}
+		t = telemetry.Batch(t, client)
+	}
+
+	a := newApplication(set, set.Dst, l, t, retry.DefaultPolicy)
+	a.openOutputs()
+
+	if set.Prometheus.Address != "" {
+		client, err := prometheus.NewClient(set.Prometheus, a.State, l)
+		if err != nil {
+			l.Fatal("Prometheus error", "error", err)
+		}
+		a.Telemeter = telemetry.Batch(a.Telemeter, client)
+	}
+
+	defer a.Telemeter.Close()
+
+	if set.Trace.Endpoint != "" {
+		exp, err := trace.NewExporter(set.Trace, l)
+		if err != nil {
+			l.Fatal("OTLP error", "error", err)
+		}
+		defer exp.Close()
+
+		a.Tracer = trace.NewTracer(exp)
 	}
 
-	_, err := env.UnmarshalFromEnviron(&config)
+	if set.StatusFreq > 0 {
+		go a.logStatus(set.StatusFreq)
+	}
+
+	go a.watchDeadLetters(set.Frequency)
+	go a.reportGauges(set.Frequency)
+
+	s, err := sync.New(set.Src, set.Dst, a.syncOptions(set.Sync), a)
 	if err != nil {
-		log.Fatalln("Failed to load env:", err)
+		l.Fatal("Failed to make a new syncer", "error", err)
+	}
+
+	a.fillOutputs(s)
+
+	a.Syncer = s
+	a.Load = func() (settings, []error) { return parseSettings(*configPath, *sets) }
+	go a.watchReload()
+
+	if set.API.Address != "" {
+		src, err := filepath.Abs(set.Src)
+		if err != nil {
+			l.Fatal("Failed to get the absolute path for the source", "error", err)
+		}
+
+		srv, err := api.NewServer(set.API, &controller{a: a, src: src}, l)
+		if err != nil {
+			l.Fatal("API error", "error", err)
+		}
+		defer srv.Close()
 	}
 
-	var cfg = sync.Options{
-		FileFormats: []string{".mp3", ".flac", ".aac", ".ogg", ".opus"},
-		CopyFormats: []string{".jpg", ".jpeg", ".png"},
-		ErrorLog: func(err error) {
-			log.Println("[sync]", err)
+	go a.convertCopies(s)
+	go a.purgeTrash(time.Hour)
+
+	if err := s.Run(set.Frequency); err != nil {
+		l.Fatal("Failed to run syncer", "error", err)
+	}
+}
+
+// settings are the settings loaded from the config file, the environment and
+// the flags.
+type settings struct {
+	Src, Dst      string // may be given as arguments instead
+	Sync          sync.Options
+	Frequency     time.Duration
+	StatusFreq    time.Duration
+	Watchdog      ffmpeg.Watchdog
+	Verify        *ffmpeg.Verification // nil if disabled
+	Copier        osutil.Copier
+	Profile       Profile
+	Reencode      string // the re-encoding policy when the profile is reloaded
+	CopyWorkers   int
+	FFmpegWorkers int
+	TrashKeep     time.Duration
+	Log           logger.Config
+	Influx        influx.Config
+	Prometheus    prometheus.Config
+	Trace         trace.Config
+	API           api.Config
+}
+
+// loadSettings loads the settings from the config file at path, if it's not
+// empty, the environment and the key=value overrides. The program exits with
+// every error found if the settings are invalid.
+func loadSettings(path string, overrides []string) settings {
+	set, errs := parseSettings(path, overrides)
+	if len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, "Invalid settings:")
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "\t"+err.Error())
+		}
+		os.Exit(exitUsage)
+	}
+	return set
+}
+
+func parseSettings(path string, overrides []string) (settings, []error) {
+	config, layers, errs := readConfig(path, overrides)
+
+	invalid := func(name string, err error) {
+		errs = append(errs, errors.Wrapf(err, "invalid %s", layers.describe(name)))
+	}
+
+	var set = settings{
+		Src: config.Source,
+		Dst: config.Destination,
+		Sync: sync.Options{
+			FileFormats: []string{".mp3", ".flac", ".aac", ".ogg", ".opus"},
+			CopyFormats: []string{".jpg", ".jpeg", ".png"},
+			StableWait:  2 * time.Second,
+		},
+		Frequency:     time.Minute,
+		StatusFreq:    time.Minute,
+		CopyWorkers:   64,
+		FFmpegWorkers: runtime.GOMAXPROCS(-1),
+		TrashKeep:     7 * 24 * time.Hour,
+		Watchdog: ffmpeg.Watchdog{
+			StallTimeout: time.Minute,
+			MinSpeed:     1,
+			Grace:        time.Minute,
+			Timeout:      10 * time.Minute,
 		},
+		Influx:     config.Influx,
+		Prometheus: config.Prometheus,
+		Trace:      config.Trace,
+		API:        config.API,
+		Log: logger.Config{
+			Level: logger.Info,
+			// Set by systemd when stderr goes to the journal.
+			Journal: os.Getenv("JOURNAL_STREAM") != "",
+		},
+	}
+
+	if err := set.Log.ParseLevels(config.LogLevel); err != nil {
+		invalid("FFSYNC_LOG_LEVEL", err)
+	}
+	if f, err := logger.ParseFormat(config.LogFormat); err != nil {
+		invalid("FFSYNC_LOG_FORMAT", err)
+	} else {
+		set.Log.Format = f
 	}
 
 	if config.Formats != "" {
-		cfg.FileFormats = strings.Split(config.Formats, ",")
+		set.Sync.FileFormats = strings.Split(config.Formats, ",")
 	}
 	if config.CopyFormats != "" {
-		cfg.CopyFormats = strings.Split(config.CopyFormats, ",")
+		set.Sync.CopyFormats = strings.Split(config.CopyFormats, ",")
+	}
+	extensions := func(name string, exts []string) {
+		for _, ext := range exts {
+			if !strings.HasPrefix(ext, ".") {
+				invalid(name, errors.Errorf("extension %q doesn't start with a dot", ext))
+			}
+		}
 	}
+	extensions("FFSYNC_FORMATS", set.Sync.FileFormats)
+	extensions("FFSYNC_COPY_FORMATS", set.Sync.CopyFormats)
 
-	var wfreq = time.Minute
-	if config.Frequency != "" {
-		f, err := time.ParseDuration(config.Frequency)
+	workers := func(name, value string, n *int) {
+		if value == "" {
+			return
+		}
+		i, err := strconv.Atoi(value)
+		if err == nil && i < 1 {
+			err = errors.New("must be at least 1")
+		}
 		if err != nil {
-			log.Fatalln("Failed to parse frequency:", err)
+			invalid(name, err)
+			return
 		}
-		wfreq = f
+		*n = i
 	}
+	workers("FFSYNC_COPY_WORKERS", config.CopyWorkers, &set.CopyWorkers)
+	workers("FFSYNC_FFMPEG_WORKERS", config.FFmpegWorkers, &set.FFmpegWorkers)
 
-	if config.Bitrate != "" {
-		opus.Bitrate = config.Bitrate
+	duration := func(name, value string, d *time.Duration) {
+		if value == "" {
+			return
+		}
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			invalid(name, err)
+			return
+		}
+		*d = v
 	}
-	if config.CoverQ != "" {
-		cover.CoverArtQ = config.CoverQ
+	duration("FFSYNC_FREQUENCY", config.Frequency, &set.Frequency)
+	duration("FFSYNC_STATUS_FREQUENCY", config.StatusFreq, &set.StatusFreq)
+	duration("FFSYNC_STALL_TIMEOUT", config.StallTime, &set.Watchdog.StallTimeout)
+	duration("FFSYNC_TRASH_RETENTION", config.TrashKeep, &set.TrashKeep)
+	duration("FFSYNC_STABLE_WAIT", config.StableWait, &set.Sync.StableWait)
+
+	if set.Frequency <= 0 {
+		invalid("FFSYNC_FREQUENCY", errors.New("must be positive"))
 	}
-	if config.CoverSize != "" {
-		cover.CoverArtSz = config.CoverSize
+
+	if config.MinSpeed != "" {
+		f, err := strconv.ParseFloat(config.MinSpeed, 64)
+		if err != nil {
+			invalid("FFSYNC_MIN_SPEED", err)
+		}
+		set.Watchdog.MinSpeed = f
 	}
 
-	if len(os.Args) < 3 {
-		log.Fatalln("Invalid usage. Usage:", filepath.Base(os.Args[0]), "src dst")
+	if config.Verify != "" {
+		v, err := strconv.ParseBool(config.Verify)
+		if err != nil {
+			invalid("FFSYNC_VERIFY", err)
+		}
+		if v {
+			set.Verify = &ffmpeg.Verification{Tolerance: 2 * time.Second}
+		}
+	}
+	if set.Verify != nil {
+		duration("FFSYNC_VERIFY_TOLERANCE", config.VerifyTol, &set.Verify.Tolerance)
+	}
+
+	var err error
+
+	set.Copier.Strategy, err = osutil.ParseStrategy(config.CopyMode)
+	if err != nil {
+		invalid("FFSYNC_COPY_STRATEGY", err)
+	}
+
+	set.Sync.Symlinks, err = sync.ParseSymlinkMode(config.Symlinks)
+	if err != nil {
+		invalid("FFSYNC_SYMLINKS", err)
+	}
+
+	if config.Preserve != "" {
+		for _, attr := range strings.Split(config.Preserve, ",") {
+			switch attr {
+			case "atime":
+				set.Copier.Preserve.Atime = true
+			case "mode":
+				set.Copier.Preserve.Mode = true
+			default:
+				invalid("FFSYNC_PRESERVE", errors.Errorf("unknown attribute %q", attr))
+			}
+		}
+	}
+	if config.Xattrs != "" {
+		set.Copier.Preserve.Xattrs = strings.Split(config.Xattrs, ",")
 	}
 
-	var t = fallback.New()
-	if config.Influx.Address != "" {
-		client, err := influx.NewClient(config.Influx)
+	if config.Durable != "" {
+		v, err := strconv.ParseBool(config.Durable)
 		if err != nil {
-			log.Fatalln("InfluxDB error:", err)
+			invalid("FFSYNC_DURABLE", err)
 		}
-		t = telemetry.Batch(t, client)
+		set.Copier.Durable = v
 	}
 
-	defer t.Close()
+	set.Profile = Profile{
+		Opus:  opus.Profile{Bitrate: config.Bitrate, VBRMode: config.VBRMode},
+		Cover: cover.Profile{Size: config.CoverSize, Quality: config.CoverQ},
+	}
+	if err := validateVBR(config.VBRMode); err != nil {
+		invalid("FFSYNC_VBR", err)
+	}
+	if err := validateInt(config.CoverSize, 1, 1<<16); err != nil {
+		invalid("FFSYNC_COVER_SIZE", err)
+	}
+	if err := validateInt(config.CoverQ, 2, 31); err != nil {
+		invalid("FFSYNC_COVER_Q", err)
+	}
 
-	a := &Application{
-		Telemeter:       t,
-		CopySemaphore:   *semaphore.NewWeighted(64),
-		FFmpegSemaphore: *semaphore.NewWeighted(int64(runtime.GOMAXPROCS(-1))),
+	set.Reencode = config.Reencode
+	if err := validateReencode(config.Reencode); err != nil {
+		invalid("FFSYNC_REENCODE", err)
 	}
 
-	s, err := sync.New(os.Args[1], os.Args[2], cfg, a)
+	return set, errs
+}
+
+// newApplication creates a new application that writes into the destination
+// dst. The program exits if the state in the destination can't be opened. The
+// output manifest isn't opened; see openOutputs.
+func newApplication(set settings, dst string, l *logger.Logger, t telemetry.Telemeter, p retry.Policy) *Application {
+	deadLetters, err := retry.OpenDeadLetters(retry.DeadLettersPath(osutil.StateDir(dst)))
 	if err != nil {
-		log.Fatalln("Failed to make a new syncer:", err)
+		l.Fatal("Failed to open the dead-letter list", "error", err)
 	}
 
-	if err := s.Run(wfreq); err != nil {
-		log.Fatalln("Failed to run syncer:", err)
+	copier := set.Copier
+	copier.Log = l.Component("copy")
+
+	return &Application{
+		Dest:        dst,
+		History:     history.Open(history.Path(osutil.StateDir(dst))),
+		Trash:       osutil.Trash{Root: dst, Retention: set.TrashKeep, Log: l.Component("trash")},
+		Log:         l,
+		Telemeter:   t,
+		Watchdog:    set.Watchdog,
+		Verify:      set.Verify,
+		Copier:      copier,
+		Profile:     set.Profile,
+		Retrier:     retry.NewRetrier(p),
+		DeadLetters: deadLetters,
+		CopyPool:    newPool(set.CopyWorkers),
+		FFmpegPool:  newPool(set.FFmpegWorkers),
 	}
 }
 
 type Application struct {
-	Telemeter       telemetry.Telemeter
-	CopySemaphore   semaphore.Weighted
-	FFmpegSemaphore semaphore.Weighted
+	Dest        string
+	Outputs     *outputs.Manifest
+	History     *history.DB
+	Trash       osutil.Trash
+	Log         *logger.Logger
+	Albums      cover.Albums
+	Jobs        jobs.Tracker
+	Telemeter   telemetry.Telemeter
+	Watchdog    ffmpeg.Watchdog
+	Verify      *ffmpeg.Verification // nil to disable
+	Copier      osutil.Copier
+	Profile     Profile       // changed by reloads
+	Tracer      *trace.Tracer // nil to disable
+	Retrier     *retry.Retrier
+	DeadLetters *retry.DeadLetters
+	CopyPool    *pool
+	FFmpegPool  *pool
+
+	// Syncer is the running syncer, and Load loads the settings again. Both
+	// are needed by Reload.
+	Syncer *sync.Syncer
+	Load   func() (settings, []error)
+
+	mutex        gosync.RWMutex // guards Profile and stopReencode
+	stopReencode context.CancelFunc
+
+	running    gosync.WaitGroup
+	retrying   int64 // atomic, jobs scheduled to be retried
+	failures   int64 // atomic, failed attempts of jobs
+	newOutputs bool  // true if the manifest was just created
+	// oneShot is true for commands that exit once they're done, which report
+	// failures by their exit code instead of dead-lettering them, so that
+	// the daemon still tries them again.
+	oneShot bool
 }
 
 func (a *Application) ConvertExt(name string) string {
 	return ffmpeg.ConvertExt(name, "opus")
 }
 
-func (a *Application) QueueCopy(src, dst string) {
-	semaJob(time.Minute, &a.CopySemaphore, func(ctx context.Context) {
-		if err := osutil.Copy(ctx, src, dst); err != nil {
-			log.Println("[copy]", err)
+func (a *Application) QueueCopy(ctx context.Context, src, dst string) {
+	if a.deadLettered(src) {
+		return
+	}
+
+	a.event(telemetry.JobQueued, copyJob, src, dst)
+
+	ctx, span := a.startJob(ctx, copyJob, src, dst)
+
+	started := a.semaJob(ctx, copyJob, src, dst, time.Minute, a.CopyPool, func(ctx context.Context, _ uint64) {
+		defer span.Finish()
+
+		a.event(telemetry.JobStarted, copyJob, src, dst)
+
+		var now = time.Now()
+
+		if err := a.Copier.Copy(ctx, src, dst); err != nil {
+			span.Fail(err)
+			if a.canceled(ctx, copyJob, src, dst) {
+				return
+			}
+			a.fail(copyJob, src, dst, err)
+			return
 		}
+
+		a.Retrier.Succeeded(dst)
+		a.addOutputs(dst)
+		a.preserveDirs(src, dst)
+
+		var attrs = telemetry.Extras{"src": src, "dst": dst}
+		if s, err := os.Stat(dst); err == nil {
+			attrs["wrote_bytes"] = s.Size()
+		}
+
+		a.jobLog(copyJob, src, dst).Debug("Copied", "duration", time.Since(now))
+		a.record(history.Record{Action: copyJob, Src: src, Dst: dst, Duration: time.Since(now)})
+		a.Telemeter.WriteDuration(time.Now().Sub(now), "copy", attrs)
+		a.event(telemetry.JobSucceeded, copyJob, src, dst)
 	})
+	if !started {
+		span.Finish()
+	}
 }
 
-func (a *Application) QueueConvert(src, dst string) {
-	// Only derive the album art if the cover does not exist.
-	if _, exists := cover.ExistsAlbum(dst); !exists {
-		semaJob(time.Minute, &a.FFmpegSemaphore, func(ctx context.Context) {
-			coverSubmitter := a.submitter(src, "cover")
+func (a *Application) QueueConvert(ctx context.Context, src, dst string) {
+	if a.deadLettered(src) {
+		return
+	}
+
+	a.event(telemetry.JobQueued, convertJob, src, dst)
+
+	ctx, span := a.startJob(ctx, convertJob, src, dst)
+
+	// The timeout is derived from the input by the watchdog instead.
+	started := a.semaJob(ctx, convertJob, src, dst, 0, a.FFmpegPool, func(ctx context.Context, id uint64) {
+		defer span.Finish()
+
+		a.event(telemetry.JobStarted, convertJob, src, dst)
+
+		var now = time.Now()
+		convertSubmitter := a.submitter(ctx, src, "opus")
 
-			o, err := cover.ExtractAlbum(ctx, src, dst)
-			if err != nil {
-				if !cover.ErrIsNoStream(err) {
-					log.Println("[cover] failed to extract album art:", err)
+		ctx = ffmpeg.WithProgress(ctx, a.Jobs.Progress(id))
+		ctx = ffmpeg.WithWatchdog(ctx, a.Watchdog)
+		ctx = ffmpeg.WithStages(ctx, a.stages(ctx))
+		ctx = ffmpeg.WithLogger(ctx, a.Log)
+
+		var profile = a.profile()
+		var outputs = []ffmpeg.Output{opus.Output(profile.Opus, dst)}
+
+		// Probe once for both the album art and the progress. If it fails,
+		// then ffmpeg reports why.
+		ctx, probe, _ := ffmpeg.ProbeInputCtx(ctx, src)
+
+		// Only derive the album art if the track has one, the cover does not
+		// exist and no other track of the same album is already deriving it.
+		var coverPath string
+		var withCover bool
+		if probe != nil && probe.HasAttachedPic() {
+			coverPath, withCover = a.Albums.Claim(dst)
+		}
+		if withCover {
+			outputs = append(outputs, cover.Output(profile.Cover, coverPath))
+		}
+		span.SetAttr("cover", withCover)
+
+		o, err := ffmpeg.ExecuteOutputsCtx(ctx, src, outputs...)
+		if withCover {
+			a.Albums.Release(dst, err == nil)
+		}
+
+		if err != nil {
+			span.Fail(err)
+			if a.canceled(ctx, convertJob, src, dst) {
+				return
+			}
+			a.fail(convertJob, src, dst, err)
+			return
+		}
+
+		if a.Verify != nil {
+			if err := a.Verify.VerifyCtx(ctx, dst, o.InputDuration); err != nil {
+				span.Fail(err)
+				if a.canceled(ctx, convertJob, src, dst) {
+					return
 				}
+				a.quarantine(dst)
+				if withCover {
+					// Extracted from the same decode, so it's not trusted
+					// either. The next track of the album extracts it again.
+					os.Remove(coverPath)
+				}
+				a.fail(convertJob, src, dst, err)
 				return
 			}
+		}
 
-			coverSubmitter(o)
+		a.Retrier.Succeeded(dst)
+		a.addOutputs(dst)
+		a.preserve(src, dst)
+		if withCover {
+			a.addOutputs(coverPath)
+			a.preserve(src, coverPath)
+		}
+		a.preserveDirs(src, dst)
+
+		convertSubmitter(o)
+		a.record(history.Record{
+			Action:   convertJob,
+			Profile:  profile.String(),
+			Src:      src,
+			Dst:      dst,
+			Duration: time.Since(now),
+			Runtime:  o.Runtime,
+			Encoded:  o.OutDuration(),
+			Speed:    o.Speed,
+			Bitrate:  o.Bitrate,
 		})
+		a.event(telemetry.JobSucceeded, convertJob, src, dst)
+	})
+	if !started {
+		span.Finish()
 	}
+}
 
-	semaJob(10*time.Minute, &a.FFmpegSemaphore, func(ctx context.Context) {
-		opusSubmitter := a.submitter(src, "opus")
+// canceled returns true if the job was canceled, which is logged, in which case
+// it's neither retried nor dead-lettered.
+func (a *Application) canceled(ctx context.Context, action, src, dst string) bool {
+	if ctx.Err() != context.Canceled {
+		return false
+	}
+	a.jobLog(action, src, dst).Info("Canceled")
+	return true
+}
+
+// preserve applies the attributes of src onto the output dst.
+func (a *Application) preserve(src, dst string) {
+	if err := a.Copier.Preserve.Apply(src, dst); err != nil {
+		a.Log.Component("preserve").Warn("Failed to preserve attributes", "src", src, "dst", dst, "error", err)
+	}
+}
 
-		o, err := opus.ConvertCtx(ctx, src, dst)
+// preserveDirs restores the modification times of the directories containing
+// the output dst, which were changed by writing it.
+func (a *Application) preserveDirs(src, dst string) {
+	if err := a.Copier.Preserve.ApplyDirs(src, dst, a.Dest); err != nil {
+		a.Log.Component("preserve").Warn("Failed to preserve directory times", "src", src, "dst", dst, "error", err)
+	}
+}
+
+// quarantine moves the bad output at dst into the quarantine directory, so it's
+// not mistaken for a finished output but can still be inspected.
+func (a *Application) quarantine(dst string) {
+	rel, err := filepath.Rel(a.Dest, dst)
+	if err != nil {
+		rel = filepath.Base(dst)
+	}
+
+	qdst := filepath.Join(osutil.StateDir(a.Dest), "quarantine", rel)
+	log := a.Log.Component("verify").With("dst", dst)
+
+	if err := os.MkdirAll(filepath.Dir(qdst), os.ModePerm); err != nil {
+		log.Error("Failed to mkdir -p quarantine", "error", err)
+	}
+
+	if err := osutil.MoveTimeout(time.Minute, dst, qdst); err != nil {
+		log.Error("Failed to quarantine, removing instead", "error", err)
+		os.Remove(dst)
+		return
+	}
+
+	log.Warn("Quarantined", "quarantine", qdst)
+
+	a.removeOutputs(dst)
+}
+
+// syncOptions returns the syncer options that remove outputs using the
+// application's manifest and trash.
+func (a *Application) syncOptions(opts sync.Options) sync.Options {
+	opts.Log = a.Log
+	opts.Outputs = a.Outputs
+	opts.Trash = a.Trash
+	opts.OnRemove = func(dst string) {
+		a.event(telemetry.FileRemoved, "", "", dst)
+	}
+	opts.OnMove = func(src, dst string) {
+		a.event(telemetry.FileRenamed, "", src, dst)
+	}
+	return opts
+}
+
+// event writes an event that happened now.
+func (a *Application) event(t telemetry.EventType, action, src, dst string) {
+	a.Telemeter.WriteEvent(telemetry.NewEvent(t, action, src, dst))
+}
+
+// jobLog returns the logger of a job, which logs as the component of its action.
+func (a *Application) jobLog(action, src, dst string) *logger.Logger {
+	return a.Log.Component(action).With("action", action, "src", src, "dst", dst)
+}
+
+// openOutputs opens the output manifest, which commands that write or remove
+// outputs need before making the syncer. The program exits if it can't be
+// opened.
+func (a *Application) openOutputs() {
+	manifest, existed, err := outputs.Open(a.Dest, osutil.StateDir(a.Dest))
+	if err != nil {
+		a.Log.Fatal("Failed to open the output manifest", "error", err)
+	}
+
+	a.Outputs = manifest
+	a.newOutputs = !existed
+}
+
+// addOutputs adds the written outputs into the manifest.
+func (a *Application) addOutputs(paths ...string) {
+	if err := a.Outputs.Add(paths...); err != nil {
+		a.Log.Component("outputs").Error("Failed to add to the manifest", "dst", strings.Join(paths, ","), "error", err)
+	}
+}
+
+// removeOutputs removes the removed outputs from the manifest.
+func (a *Application) removeOutputs(paths ...string) {
+	if err := a.Outputs.Remove(paths...); err != nil {
+		a.Log.Component("outputs").Error("Failed to remove from the manifest", "dst", strings.Join(paths, ","), "error", err)
+	}
+}
+
+// fillOutputs fills a newly created manifest with the existing outputs of the
+// source tree, so that they can be removed once their sources are removed.
+func (a *Application) fillOutputs(s *sync.Syncer) {
+	if !a.newOutputs {
+		return
+	}
+
+	err := s.Walk(func(m sync.Mapping) error {
+		if _, err := os.Lstat(m.Dst); err == nil {
+			a.addOutputs(m.Dst)
+		}
+		if m.Convert {
+			if path, exists := cover.ExistsAlbum(m.Dst); exists {
+				a.addOutputs(path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		a.Log.Component("outputs").Error("Failed to walk the source", "error", err)
+	}
+
+	a.newOutputs = false
+}
+
+// purgeTrash periodically removes outputs that have been in the trash for
+// longer than its retention.
+func (a *Application) purgeTrash(freq time.Duration) {
+	var ticker = time.NewTicker(freq)
+	defer ticker.Stop()
+
+	for {
+		purged, err := a.Trash.Purge(time.Now())
 		if err != nil {
-			log.Println("[opus] failed to convert:", err)
+			a.Trash.Log.Error("Failed to purge", "error", err)
+		}
+		for _, path := range purged {
+			a.Trash.Log.Info("Purged", "path", path)
+		}
+
+		<-ticker.C
+	}
+}
+
+// convertCopies converts the existing copied outputs to the current copy
+// strategy if it's different from the one recorded in the destination. The new
+// strategy is recorded once everything is converted, so an interrupted
+// conversion is resumed on the next start.
+func (a *Application) convertCopies(s *sync.Syncer) {
+	var stateDir = osutil.StateDir(a.Dest)
+	var log = a.Copier.Log
+
+	old, err := osutil.ReadStrategy(stateDir)
+	if err != nil {
+		log.Error("Failed to read the recorded copy strategy", "error", err)
+		return
+	}
+
+	var strategy = a.Copier.Strategy
+	if strategy == "" {
+		strategy = osutil.Hardlink
+	}
+
+	var failed bool
+
+	if old != "" && old != strategy {
+		log.Info("Converting copies", "from", old, "to", strategy)
+
+		err = s.Walk(func(m sync.Mapping) error {
+			if m.Convert || m.Link != "" || strategy.Matches(m.Src, m.Dst) {
+				return nil
+			}
+			// Only convert outputs that already exist; missing ones are
+			// copied by the syncer.
+			if _, err := os.Lstat(m.Dst); err != nil {
+				return nil
+			}
+			if err := a.Copier.Copy(context.Background(), m.Src, m.Dst); err != nil {
+				log.Error("Failed to convert copy", "src", m.Src, "dst", m.Dst, "error", err)
+				failed = true
+			}
+			return nil
+		})
+		if err != nil {
+			log.Error("Failed to walk the source", "error", err)
 			return
 		}
+	}
 
-		opusSubmitter(o)
-	})
+	if old != strategy && !failed {
+		if err := osutil.WriteStrategy(stateDir, strategy); err != nil {
+			log.Error("Failed to record the copy strategy", "error", err)
+		}
+	}
 }
 
-func (a *Application) submitter(src, rType string) func(*ffmpeg.Result) {
+func (a *Application) submitter(ctx context.Context, src, rType string) func(*ffmpeg.Result) {
 	var now = time.Now()
 
 	return func(result *ffmpeg.Result) {
 		var dura = time.Now().Sub(now)
 
-		a.Telemeter.WriteDuration(dura, "convert", telemetry.Extras{
+		var attrs = telemetry.Extras{
 			"encoded":       result.OutDuration().Milliseconds(),
 			"runtime":       result.Runtime.Milliseconds(),
 			"realtime_mult": result.Speed,
@@ -166,25 +758,170 @@ func (a *Application) submitter(src, rType string) func(*ffmpeg.Result) {
 			"bitrate":       result.Bitrate,
 			"src":           src,
 			"dst":           result.OutputPath,
-		})
+		}
+
+		// Put the results on the job's span as well.
+		var span = trace.FromContext(ctx)
+		for k, v := range attrs {
+			span.SetAttr(k, v)
+		}
+
+		a.Telemeter.WriteDuration(dura, "convert", attrs)
+	}
+}
+
+// startJob starts the span of a job. If the job was triggered by the syncer,
+// then the span starts when the watcher event was received instead, and the
+// time spent handling the event is recorded as a span of its own, as is the
+// wait for the file to be written.
+func (a *Application) startJob(ctx context.Context, action, src, dst string) (context.Context, *trace.Span) {
+	var start = time.Now()
+
+	trigger, triggered := sync.TriggerFromContext(ctx)
+	if triggered {
+		start = trigger.Time
+	}
+
+	ctx, span := a.Tracer.StartAt(ctx, action, start)
+	span.SetAttr("src", src)
+	span.SetAttr("dst", dst)
+
+	if triggered {
+		_, ev := a.Tracer.StartAt(ctx, "event", trigger.Time)
+		ev.SetAttr("op", trigger.Op)
+		ev.SetAttr("path", trigger.Path)
+		ev.Finish()
+
+		if !trigger.Stable.IsZero() {
+			_, stable := a.Tracer.StartAt(ctx, "stable", trigger.Time)
+			stable.FinishAt(trigger.Stable)
+		}
+	}
+
+	return ctx, span
+}
+
+// stages returns a function that records the stages of an ffmpeg invocation as
+// spans under the span in ctx.
+func (a *Application) stages(ctx context.Context) ffmpeg.StageFunc {
+	return func(stage string) func(error) {
+		_, span := a.Tracer.Start(ctx, stage)
+		return func(err error) {
+			span.Fail(err)
+			span.Finish()
+		}
+	}
+}
+
+// logStatus logs the progress of jobs that have been running for longer than
+// freq every freq. Jobs that haven't made progress within freq are reported as
+// stalled.
+func (a *Application) logStatus(freq time.Duration) {
+	var ticker = time.NewTicker(freq)
+	defer ticker.Stop()
+
+	var log = a.Log.Component("status")
+
+	for now := range ticker.C {
+		for _, job := range a.Jobs.Snapshot() {
+			if job.Action != convertJob || !job.Running() || now.Sub(job.Started) < freq {
+				continue
+			}
+
+			if job.Stalled(now, freq) {
+				log.Warn("Stalled", "src", job.Src, "dst", job.Dst,
+					"stalled", now.Sub(job.Updated).Truncate(time.Second),
+					"percentage", job.Progress.Percentage,
+				)
+				continue
+			}
+
+			log.Info("Converting", "src", job.Src, "dst", job.Dst,
+				"percentage", job.Progress.Percentage,
+				"speed", job.Progress.Speed,
+				"wrote_bytes", job.Progress.TotalSize,
+			)
+		}
+	}
+}
+
+// State returns the current state of the workers for the metrics.
+func (a *Application) State() prometheus.State {
+	return prometheus.State{
+		Queued:   a.CopyPool.Waiting() + a.FFmpegPool.Waiting() + int(atomic.LoadInt64(&a.retrying)),
+		InFlight: a.FFmpegPool.Running(),
+		Saturation: map[string]float64{
+			"copy":   a.CopyPool.Saturation(),
+			"ffmpeg": a.FFmpegPool.Saturation(),
+		},
 	}
 }
 
-// semaJob blocks until a semaphore is acquired, then runs fn in a goroutine.
-func semaJob(t time.Duration, sema *semaphore.Weighted, fn func(context.Context)) {
-	// 1 minute timeout.
-	ctx, cancel := context.WithTimeout(context.TODO(), time.Minute)
+// reportGauges writes the state of the workers and the dead-letter list every
+// freq.
+func (a *Application) reportGauges(freq time.Duration) {
+	var ticker = time.NewTicker(freq)
+	defer ticker.Stop()
 
-	if err := sema.Acquire(ctx, 1); err != nil {
-		log.Println("[copy] failed to acquire sema")
+	for range ticker.C {
+		state := a.State()
+
+		a.Telemeter.SetGauge("queue_depth", float64(state.Queued), nil)
+		a.Telemeter.SetGauge("ffmpeg_in_flight", float64(state.InFlight), nil)
+		for pool, ratio := range state.Saturation {
+			a.Telemeter.SetGauge("pool_saturation_ratio", ratio, telemetry.Tags{"pool": pool})
+		}
+		a.Telemeter.SetGauge("dead_letters", float64(len(a.DeadLetters.Entries())), nil)
+	}
+}
+
+// Wait waits until all running jobs are done. Jobs scheduled to be retried
+// later are not waited for.
+func (a *Application) Wait() {
+	a.running.Wait()
+}
+
+// semaJob blocks until a worker of the pool is free, then runs fn in a goroutine.
+// The job is tracked from when it's queued, and canceling it cancels the
+// context given to fn, which is derived from ctx and times out after t, unless
+// t is 0. The wait is recorded as a span. False is returned if the job was
+// canceled before it started.
+func (a *Application) semaJob(
+	ctx context.Context, action, src, dst string, t time.Duration, p *pool,
+	fn func(ctx context.Context, id uint64)) bool {
+
+	ctx, cancel := context.WithCancel(ctx)
+	id := a.Jobs.Queue(action, src, dst, cancel)
+
+	_, span := a.Tracer.Start(ctx, "acquire")
+	err := p.acquire(ctx)
+	span.Fail(err)
+	span.Finish()
+
+	if err != nil {
+		a.Jobs.Done(id)
 		cancel()
-		return
+		a.jobLog(action, src, dst).Info("Canceled while queued")
+		return false
 	}
 
+	a.Jobs.Start(id)
+	a.running.Add(1)
+
 	go func() {
+		defer a.running.Done()
+		defer p.release()
+		defer a.Jobs.Done(id)
 		defer cancel()
-		defer sema.Release(1)
 
-		fn(ctx)
+		if t > 0 {
+			c, cancel := context.WithTimeout(ctx, t)
+			defer cancel()
+			ctx = c
+		}
+
+		fn(ctx, id)
 	}()
+
+	return true
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/diamondburned/ffsync/ffmpeg/cover"
+	"github.com/diamondburned/ffsync/internal/logger"
+	"github.com/diamondburned/ffsync/internal/osutil"
+	"github.com/diamondburned/ffsync/internal/outputs"
+	"github.com/diamondburned/ffsync/internal/retry"
+	"github.com/diamondburned/ffsync/internal/telemetry/fallback"
+	"github.com/diamondburned/ffsync/sync"
+)
+
+// syncMain implements the sync command. It exits with exitProblems if any job
+// failed.
+func syncMain(cmd command, args []string) {
+	fs := cmd.flags()
+	configPath, sets := configFlags(fs)
+	fs.Parse(args)
+
+	set := commandSettings(fs, *configPath, *sets, true)
+
+	requireFFmpeg()
+
+	// Don't retry anything, since we're not going to stay around for it, and
+	// leave failures to the daemon.
+	l := logger.New(os.Stderr, set.Log)
+	a := newApplication(set, set.Dst, l, fallback.New(l), retry.Policy{MaxAttempts: 1})
+	a.oneShot = true
+	a.openOutputs()
+
+	s, err := sync.New(set.Src, set.Dst, a.syncOptions(set.Sync), a)
+	if err != nil {
+		l.Fatal("Failed to make a new syncer", "error", err)
+	}
+
+	a.fillOutputs(s)
+	a.convertCopies(s)
+
+	if err := s.Sync(); err != nil {
+		l.Fatal("Failed to sync", "error", err)
+	}
+	a.Wait()
+
+	if n := atomic.LoadInt64(&a.failures); n > 0 {
+		l.Error("Some jobs failed", "failed", n)
+		os.Exit(exitProblems)
+	}
+}
+
+// plannedJob is something the sync or prune commands would do.
+type plannedJob struct {
+	Action string `json:"action"` // "convert", "copy", "link" or "remove"
+	Src    string `json:"src,omitempty"`
+	Dst    string `json:"dst"`
+}
+
+// planMain implements the plan command. Nothing in the destination is
+// written, including the state.
+func planMain(cmd command, args []string) {
+	fs := cmd.flags()
+	jsonOut := fs.Bool("json", false, "print the plan as JSON")
+	configPath, sets := configFlags(fs)
+	fs.Parse(args)
+
+	set := commandSettings(fs, *configPath, *sets, true)
+	l := logger.New(os.Stderr, set.Log)
+
+	opts := set.Sync
+	opts.Log = l
+
+	// The application is only used for the names of the outputs.
+	s, err := sync.New(set.Src, set.Dst, opts, &Application{})
+	if err != nil {
+		l.Fatal("Failed to make a new syncer", "error", err)
+	}
+
+	mappings, err := walkMappings(s)
+	if err != nil {
+		l.Fatal("Failed to walk the source", "error", err)
+	}
+
+	paths, err := outputs.Read(set.Dst, osutil.StateDir(set.Dst))
+	if err != nil {
+		l.Fatal("Failed to read the output manifest", "error", err)
+	}
+
+	var jobs []plannedJob
+
+	for _, m := range mappings {
+		if _, err := os.Lstat(m.Dst); err == nil {
+			continue
+		}
+
+		var action = copyJob
+		switch {
+		case m.Link != "":
+			action = "link"
+		case m.Convert:
+			action = convertJob
+		}
+
+		jobs = append(jobs, plannedJob{Action: action, Src: m.Src, Dst: m.Dst})
+	}
+
+	for _, path := range orphans(mappings, paths) {
+		jobs = append(jobs, plannedJob{Action: "remove", Dst: path})
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(jobs)
+		return
+	}
+
+	for _, job := range jobs {
+		if job.Src == "" {
+			fmt.Printf("%s\t%s\n", job.Action, job.Dst)
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\n", job.Action, job.Src, job.Dst)
+	}
+}
+
+// pruneMain implements the prune command. Outputs are put into the trash like
+// the ones removed by the syncer.
+func pruneMain(cmd command, args []string) {
+	fs := cmd.flags()
+	configPath, sets := configFlags(fs)
+	fs.Parse(args)
+
+	set := commandSettings(fs, *configPath, *sets, true)
+
+	l := logger.New(os.Stderr, set.Log)
+	a := newApplication(set, set.Dst, l, fallback.New(l), retry.DefaultPolicy)
+	a.openOutputs()
+	log := l.Component("prune")
+
+	s, err := sync.New(set.Src, set.Dst, a.syncOptions(set.Sync), a)
+	if err != nil {
+		l.Fatal("Failed to make a new syncer", "error", err)
+	}
+
+	mappings, err := walkMappings(s)
+	if err != nil {
+		l.Fatal("Failed to walk the source", "error", err)
+	}
+
+	paths := a.Outputs.Paths()
+
+	// Never remove everything this way, since the source might just be
+	// unmounted.
+	if len(mappings) == 0 && len(paths) > 0 {
+		l.Fatal("The source has no files to synchronize; is it mounted?", "src", set.Src)
+	}
+
+	var code = exitOK
+	var root = filepath.Clean(a.Dest) + string(filepath.Separator)
+
+	for _, path := range orphans(mappings, paths) {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			// Already gone, so only the manifest is out of date.
+			a.removeOutputs(path)
+			continue
+		}
+
+		err := osutil.RemoveOutputs(path, a.Outputs.Has, a.Trash, func(path string) {
+			log.Info("Removed", "dst", path)
+			a.removeOutputs(path)
+		})
+		if err != nil {
+			log.Error("Failed to remove", "dst", path, "error", err)
+			code = exitError
+			continue
+		}
+
+		// Clean up the directories left empty, but never the root.
+		for dir := filepath.Dir(path); strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+
+	os.Exit(code)
+}
+
+// walkMappings returns the mapping of every file in the source tree.
+func walkMappings(s *sync.Syncer) ([]sync.Mapping, error) {
+	var mappings []sync.Mapping
+	err := s.Walk(func(m sync.Mapping) error {
+		mappings = append(mappings, m)
+		return nil
+	})
+	return mappings, err
+}
+
+// orphans returns the outputs that no file in the source tree maps to anymore.
+// Album arts are kept as long as any track next to them is converted.
+func orphans(mappings []sync.Mapping, outputs []string) []string {
+	var expected = make(map[string]bool, len(mappings))
+	for _, m := range mappings {
+		expected[m.Dst] = true
+		if m.Convert {
+			path, _ := cover.ExistsAlbum(m.Dst)
+			expected[path] = true
+		}
+	}
+
+	var orphaned []string
+	for _, path := range outputs {
+		if !expected[path] {
+			orphaned = append(orphaned, path)
+		}
+	}
+	return orphaned
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/diamondburned/ffsync/sync"
+)
+
+func TestOrphans(t *testing.T) {
+	mappings := []sync.Mapping{
+		{Src: "/src/a/1.flac", Dst: "/dst/a/1.opus", Convert: true},
+		{Src: "/src/b/front.jpg", Dst: "/dst/b/front.jpg"},
+	}
+	outputs := []string{
+		"/dst/a/1.opus",
+		"/dst/a/2.opus",
+		"/dst/a/cover.jpg",
+		"/dst/b/cover.jpg",
+		"/dst/b/front.jpg",
+	}
+
+	got := strings.Join(orphans(mappings, outputs), " ")
+	if got != "/dst/a/2.opus /dst/b/cover.jpg" {
+		t.Fatalf("Unexpected orphans %q", got)
+	}
+}
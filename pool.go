@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	gosync "sync"
+)
+
+// pool is a semaphore of workers that counts the jobs waiting for it and the
+// jobs holding it. It can be resized and paused while jobs are waiting.
+type pool struct {
+	mutex   gosync.Mutex
+	size    int
+	waiting int
+	running int
+	paused  bool
+
+	// free is closed and replaced every time a worker may have become free.
+	free chan struct{}
+}
+
+func newPool(size int) *pool {
+	return &pool{
+		size: size,
+		free: make(chan struct{}),
+	}
+}
+
+// acquire blocks until a worker is free and the pool isn't paused.
+func (p *pool) acquire(ctx context.Context) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.waiting++
+	defer func() { p.waiting-- }()
+
+	for p.paused || p.running >= p.size {
+		free := p.free
+
+		p.mutex.Unlock()
+		select {
+		case <-free:
+		case <-ctx.Done():
+			p.mutex.Lock()
+			return ctx.Err()
+		}
+		p.mutex.Lock()
+	}
+
+	p.running++
+	return nil
+}
+
+// release frees the worker.
+func (p *pool) release() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.running--
+	p.wake()
+}
+
+// resize changes the number of workers. Jobs already holding a worker keep
+// running when the pool shrinks, but no new ones start until enough are done.
+func (p *pool) resize(size int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.size = size
+	p.wake()
+}
+
+// pause stops or resumes handing out workers. Jobs already holding a worker
+// keep running.
+func (p *pool) pause(paused bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.paused = paused
+	p.wake()
+}
+
+// wake wakes up every waiting job to check for a free worker. The mutex must
+// be held.
+func (p *pool) wake() {
+	close(p.free)
+	p.free = make(chan struct{})
+}
+
+// Size returns the number of workers.
+func (p *pool) Size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.size
+}
+
+// Paused returns true if the pool is paused.
+func (p *pool) Paused() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.paused
+}
+
+// Waiting returns the number of jobs waiting for a worker.
+func (p *pool) Waiting() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.waiting
+}
+
+// Running returns the number of busy workers.
+func (p *pool) Running() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.running
+}
+
+// Saturation returns the ratio of busy workers.
+func (p *pool) Saturation() float64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return float64(p.running) / float64(p.size)
+}
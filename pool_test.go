@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPoolResize(t *testing.T) {
+	p := newPool(1)
+
+	if err := p.acquire(context.Background()); err != nil {
+		t.Fatal("Failed to acquire:", err)
+	}
+
+	var acquired = make(chan error)
+	go func() { acquired <- p.acquire(context.Background()) }()
+
+	select {
+	case <-acquired:
+		t.Fatal("Acquired more workers than the pool has")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if p.Waiting() != 1 {
+		t.Fatalf("Expected 1 job waiting, got %d", p.Waiting())
+	}
+
+	// Growing the pool lets the waiting job run.
+	p.resize(2)
+
+	if err := <-acquired; err != nil {
+		t.Fatal("Failed to acquire after growing:", err)
+	}
+	if p.Running() != 2 || p.Waiting() != 0 {
+		t.Fatalf("Expected 2 running and 0 waiting, got %d and %d", p.Running(), p.Waiting())
+	}
+
+	// Shrinking the pool keeps the running jobs, but no new ones start until
+	// enough of them are done.
+	p.resize(1)
+	p.release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := p.acquire(ctx); err == nil {
+		t.Fatal("Acquired a worker of a shrunk pool")
+	}
+
+	p.release()
+
+	if err := p.acquire(context.Background()); err != nil {
+		t.Fatal("Failed to acquire after the pool was freed:", err)
+	}
+	if p.Saturation() != 1 {
+		t.Fatalf("Expected the pool to be saturated, got %v", p.Saturation())
+	}
+}
+
+func TestPoolPause(t *testing.T) {
+	p := newPool(2)
+	p.pause(true)
+
+	var acquired = make(chan error)
+	go func() { acquired <- p.acquire(context.Background()) }()
+
+	select {
+	case <-acquired:
+		t.Fatal("Acquired a worker of a paused pool")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.pause(false)
+
+	if err := <-acquired; err != nil {
+		t.Fatal("Failed to acquire after resuming:", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/diamondburned/ffsync/ffmpeg"
+)
+
+// probeReport is what the probe command reports on a file.
+type probeReport struct {
+	Path     string               `json:"path"`
+	Duration float64              `json:"duration,omitempty"` // seconds
+	Streams  []ffmpeg.ProbeStream `json:"streams,omitempty"`
+	Error    string               `json:"error,omitempty"`
+}
+
+// probeMain implements the probe command. It exits with exitError if any file
+// couldn't be probed.
+func probeMain(cmd command, args []string) {
+	fs := cmd.flags()
+	jsonOut := fs.Bool("json", false, "print the reports as JSON")
+	timeout := fs.Duration("timeout", time.Minute, "give up on each file after this long")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	requireFFmpeg()
+
+	var reports = make([]probeReport, fs.NArg())
+	var code = exitOK
+
+	for i, path := range fs.Args() {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		p, err := ffmpeg.ProbeCtx(ctx, path)
+		cancel()
+
+		reports[i].Path = path
+		if err != nil {
+			reports[i].Error = err.Error()
+			code = exitError
+			continue
+		}
+		reports[i].Duration = p.Duration.Seconds()
+		reports[i].Streams = p.Streams
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(reports)
+		os.Exit(code)
+	}
+
+	for _, r := range reports {
+		if r.Error != "" {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", r.Path, r.Error)
+			continue
+		}
+
+		fmt.Printf("%s\t%.1fs\n", r.Path, r.Duration)
+		for _, s := range r.Streams {
+			fmt.Printf("\tstream %d: %s %s", s.Index, s.CodecType, s.CodecName)
+			if s.AttachedPic {
+				fmt.Print(" (attached picture)")
+			}
+			fmt.Println()
+		}
+	}
+
+	os.Exit(code)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/diamondburned/ffsync/ffmpeg/cover"
+	"github.com/diamondburned/ffsync/ffmpeg/opus"
+	"github.com/pkg/errors"
+)
+
+// Profile is the encoder and album art settings of converted outputs. The
+// zero value is the default profile.
+type Profile struct {
+	Opus  opus.Profile
+	Cover cover.Profile
+}
+
+// String describes the profile for the history, for example "opus 64k".
+func (p Profile) String() string {
+	var bitrate = p.Opus.Bitrate
+	if bitrate == "" {
+		bitrate = opus.DefaultBitrate
+	}
+	return "opus " + bitrate
+}
+
+// validateVBR returns an error if the mode isn't one libopus knows.
+func validateVBR(mode string) error {
+	switch mode {
+	case "", "on", "off", "constrained":
+		return nil
+	default:
+		return errors.Errorf("unknown VBR mode %q", mode)
+	}
+}
+
+// validateInt returns an error if s isn't an integer within [min, max].
+func validateInt(s string, min, max int) error {
+	if s == "" {
+		return nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.Errorf("%q is not an integer", s)
+	}
+	if i < min || i > max {
+		return errors.Errorf("%d is not within %d and %d", i, min, max)
+	}
+	return nil
+}
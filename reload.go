@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/diamondburned/ffsync/ffmpeg/opus"
+	"github.com/diamondburned/ffsync/sync"
+	"github.com/pkg/errors"
+)
+
+// The re-encoding policies, which decide what happens to the existing outputs
+// when the profile is changed by a reload.
+const (
+	reencodeNever = "never" // only new outputs use the new profile
+	reencodeAll   = "all"   // every converted output is encoded again
+)
+
+// validateReencode returns an error if the policy is unknown.
+func validateReencode(policy string) error {
+	switch policy {
+	case "", reencodeNever, reencodeAll:
+		return nil
+	default:
+		return errors.Errorf("unknown policy %q", policy)
+	}
+}
+
+// sameAudio returns true if both profiles encode the audio the same way.
+func (p Profile) sameAudio(other Profile) bool {
+	return reflect.DeepEqual(opus.Output(p.Opus, ""), opus.Output(other.Opus, ""))
+}
+
+// profile returns the current profile.
+func (a *Application) profile() Profile {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.Profile
+}
+
+// watchReload reloads the settings every time the process receives SIGHUP.
+func (a *Application) watchReload() {
+	var sig = make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	for range sig {
+		if err := a.Reload(); err != nil {
+			a.Log.Component("reload").Error("Failed to reload", "error", err)
+		}
+	}
+}
+
+// Reload loads the settings again and applies the ones that can be changed
+// while running: the formats, the number of workers and the profile, which
+// existing outputs are re-encoded with according to FFSYNC_REENCODE. Queued
+// jobs are kept, and they use the new profile once they start. Nothing is
+// changed if the new settings are invalid.
+func (a *Application) Reload() error {
+	if a.Load == nil {
+		return errors.New("reloading is not supported")
+	}
+
+	set, errs := a.Load()
+	if len(errs) > 0 {
+		var msgs = make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		return errors.Errorf("invalid settings: %s", strings.Join(msgs, "; "))
+	}
+
+	if a.Syncer != nil {
+		a.Syncer.SetFormats(set.Sync.FileFormats, set.Sync.CopyFormats)
+	}
+
+	a.CopyPool.resize(set.CopyWorkers)
+	a.FFmpegPool.resize(set.FFmpegWorkers)
+
+	a.mutex.Lock()
+	old := a.Profile
+	a.Profile = set.Profile
+	a.mutex.Unlock()
+
+	a.Log.Component("reload").Info("Reloaded",
+		"formats", strings.Join(set.Sync.FileFormats, ","),
+		"copy_formats", strings.Join(set.Sync.CopyFormats, ","),
+		"copy_workers", set.CopyWorkers,
+		"ffmpeg_workers", set.FFmpegWorkers,
+		"profile", set.Profile.String(),
+	)
+
+	if !old.sameAudio(set.Profile) && set.Reencode == reencodeAll && a.Syncer != nil {
+		a.reencodeAll(a.Syncer)
+	}
+
+	return nil
+}
+
+// reencodeAll re-encodes every existing converted output with the current
+// profile in the background. A re-encoding that's still being queued from an
+// earlier reload is stopped first. Album art that already exists is kept.
+func (a *Application) reencodeAll(s *sync.Syncer) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	a.mutex.Lock()
+	if a.stopReencode != nil {
+		a.stopReencode()
+	}
+	a.stopReencode = cancel
+	a.mutex.Unlock()
+
+	a.Log.Component("reload").Info("Re-encoding the converted outputs", "profile", a.profile().String())
+
+	go a.reencode(ctx, s.Walk)
+}
+
+// reencode queues every existing converted output of the mappings given by
+// walk to be encoded again with the current profile, until ctx is canceled.
+// Jobs that were already queued aren't canceled.
+func (a *Application) reencode(ctx context.Context, walk func(func(sync.Mapping) error) error) {
+	err := walk(func(m sync.Mapping) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !m.Convert {
+			return nil
+		}
+		// Missing outputs are converted by the syncer.
+		if _, err := os.Stat(m.Dst); err != nil {
+			return nil
+		}
+		a.QueueConvert(context.Background(), m.Src, m.Dst)
+		return nil
+	})
+	if err != nil && err != context.Canceled {
+		a.Log.Component("reload").Error("Failed to walk the source", "error", err)
+	}
+}
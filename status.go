@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/diamondburned/ffsync/internal/history"
+	"github.com/diamondburned/ffsync/internal/osutil"
+	"github.com/diamondburned/ffsync/internal/outputs"
+	"github.com/diamondburned/ffsync/internal/retry"
+)
+
+// status is what the status command reports on a destination.
+type status struct {
+	Outputs     int             `json:"outputs"`
+	Recent      history.Summary `json:"recent"`
+	DeadLetters []retry.Entry   `json:"dead_letters"`
+}
+
+// statusMain implements the status command. It exits with exitProblems if
+// there are dead-lettered files.
+func statusMain(cmd command, args []string) {
+	fs := cmd.flags()
+	since := fs.Duration("since", 24*time.Hour, "summarize the jobs that ended within this long")
+	jsonOut := fs.Bool("json", false, "print the status as JSON")
+	configPath, sets := configFlags(fs)
+	fs.Parse(args)
+
+	set := commandSettings(fs, *configPath, *sets, false)
+	stateDir := osutil.StateDir(set.Dst)
+
+	fail := func(msg string, err error) {
+		fmt.Fprintln(os.Stderr, msg, err)
+		os.Exit(exitError)
+	}
+
+	paths, err := outputs.Read(set.Dst, stateDir)
+	if err != nil {
+		fail("Failed to read the output manifest:", err)
+	}
+
+	d, err := retry.OpenDeadLetters(retry.DeadLettersPath(stateDir))
+	if err != nil {
+		fail("Failed to open the dead-letter list:", err)
+	}
+
+	records, err := history.Open(history.Path(stateDir)).Query(history.Filter{
+		Since: time.Now().Add(-*since),
+	})
+	if err != nil {
+		fail("Failed to query the history:", err)
+	}
+
+	var st = status{
+		Outputs:     len(paths),
+		Recent:      history.Summarize(records),
+		DeadLetters: d.Entries(),
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(st)
+	} else {
+		fmt.Printf("%d output(s)\n", st.Outputs)
+		fmt.Printf("%d job(s) within %v, %d failed\n", st.Recent.Jobs, *since, st.Recent.Failed)
+		fmt.Printf("%d dead-lettered file(s)\n", len(st.DeadLetters))
+
+		for _, e := range st.DeadLetters {
+			var kind = e.Kind
+			if kind == "" {
+				kind = "error"
+			}
+			fmt.Printf("%s (%s, %d attempt(s) until %s): %s: %s\n",
+				e.Src, e.Action, e.Attempts, e.Time.Format(time.RFC3339), kind, e.Error)
+		}
+	}
+
+	if len(st.DeadLetters) > 0 {
+		os.Exit(exitProblems)
+	}
+}
@@ -1,5 +1,13 @@
 package sync
 
+import (
+	"time"
+
+	"github.com/diamondburned/ffsync/internal/logger"
+	"github.com/diamondburned/ffsync/internal/osutil"
+	"github.com/diamondburned/ffsync/internal/outputs"
+)
+
 type fileAction uint8
 
 const (
@@ -12,7 +20,27 @@ type Options struct {
 	FileFormats []string // to transcode
 	CopyFormats []string // to copy
 
-	ErrorLog func(err error)
+	// Log is the logger of the syncer, which logs as the "sync" component.
+	// Nil logs to logger.Default.
+	Log *logger.Logger
+
+	// Outputs is the manifest of the outputs written into the destination.
+	// Only outputs in it are ever removed. If it's nil, then every file in
+	// the destination is assumed to be an output.
+	Outputs *outputs.Manifest
+	// Trash is where removed outputs are put.
+	Trash osutil.Trash
+	// Symlinks is how symlinks in the source tree are handled.
+	Symlinks SymlinkMode
+	// StableWait is how long the size and modification time of a new file
+	// must stay the same before it's queued, so that files still being
+	// written aren't queued too early. Zero queues them right away.
+	StableWait time.Duration
+
+	// OnRemove is called with every output that is removed, and OnMove with
+	// every output that is moved. Both are optional.
+	OnRemove func(dst string)
+	OnMove   func(src, dst string)
 }
 
 func (o Options) IsExt(ext string) bool {
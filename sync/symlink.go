@@ -0,0 +1,247 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/diamondburned/ffsync/internal/osutil"
+	"github.com/pkg/errors"
+)
+
+// SymlinkMode is how symbolic links in the source tree are handled.
+type SymlinkMode string
+
+const (
+	// FollowSymlinks synchronizes symlinks as if they were the files and
+	// directories they point to. Links that would loop are skipped. This is
+	// the default.
+	FollowSymlinks SymlinkMode = "follow"
+	// MirrorSymlinks makes the same symlinks in the destination, pointing to
+	// the outputs of what they point to. Links that point outside the source
+	// tree are followed instead.
+	MirrorSymlinks SymlinkMode = "mirror"
+	// IgnoreSymlinks skips symlinks.
+	IgnoreSymlinks SymlinkMode = "ignore"
+)
+
+// SymlinkModes is the list of all symlink modes.
+var SymlinkModes = []SymlinkMode{FollowSymlinks, MirrorSymlinks, IgnoreSymlinks}
+
+// ParseSymlinkMode parses the symlink mode name. An empty name is
+// FollowSymlinks.
+func ParseSymlinkMode(name string) (SymlinkMode, error) {
+	if name == "" {
+		return FollowSymlinks, nil
+	}
+	for _, m := range SymlinkModes {
+		if string(m) == name {
+			return m, nil
+		}
+	}
+	return "", errors.Errorf("unknown symlink mode %q", name)
+}
+
+func (m SymlinkMode) orDefault() SymlinkMode {
+	if m == "" {
+		return FollowSymlinks
+	}
+	return m
+}
+
+func isSymlink(info os.FileInfo) bool {
+	return info.Mode()&os.ModeSymlink != 0
+}
+
+// walkFunc is called with the Lstat info of every path in the tree.
+type walkFunc func(path string, info os.FileInfo) error
+
+// walkTree walks the source tree at root like filepath.Walk, except symlinked
+// directories are walked into if they're followed. Hidden files and files that
+// aren't synchronized are skipped.
+func (s *Syncer) walkTree(root string, fn walkFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(root, info); err != nil {
+		return err
+	}
+
+	if info.IsDir() || s.followsDir(root, info) {
+		return s.walkDir(root, []string{real}, fn)
+	}
+	return nil
+}
+
+// walkDir walks the entries of dir. Chain contains the real paths of the root
+// and of every followed symlink above dir, which is used to detect loops.
+func (s *Syncer) walkDir(dir string, chain []string, fn walkFunc) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range entries {
+		path := filepath.Join(dir, info.Name())
+
+		if s.checkPath(info, path) != nil {
+			continue
+		}
+
+		if !info.IsDir() && !s.followsDir(path, info) {
+			if err := fn(path, info); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var next = chain
+		if isSymlink(info) {
+			real, ok := s.followable(path, chain)
+			if !ok {
+				continue
+			}
+			next = append(chain[:len(chain):len(chain)], real)
+		}
+
+		if err := fn(path, info); err != nil {
+			return err
+		}
+		if err := s.walkDir(path, next, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// followable returns the real path of the symlinked directory at path and true
+// if following it doesn't loop back into the chain or into the directory the
+// link is in.
+func (s *Syncer) followable(path string, chain []string) (string, bool) {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", false
+	}
+
+	realParent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", false
+	}
+
+	for _, dir := range append(chain, realParent) {
+		if dir == real || strings.HasPrefix(dir, real+string(filepath.Separator)) {
+			s.log.Warn("Skipping symlink that loops back", "src", path, "target", real)
+			return "", false
+		}
+	}
+
+	return real, true
+}
+
+// followsDir returns true if the path is a symlink to a directory that is
+// followed.
+func (s *Syncer) followsDir(path string, info os.FileInfo) bool {
+	if !isSymlink(info) {
+		return false
+	}
+
+	switch s.opts.Symlinks.orDefault() {
+	case IgnoreSymlinks:
+		return false
+	case MirrorSymlinks:
+		if _, ok := s.linkTarget(path); ok {
+			return false
+		}
+	}
+
+	target, err := os.Stat(path)
+	return err == nil && target.IsDir()
+}
+
+// linkTarget returns the path inside the source tree that the symlink at path
+// points to, and true if the symlink is mirrored.
+func (s *Syncer) linkTarget(path string) (string, bool) {
+	if s.opts.Symlinks.orDefault() != MirrorSymlinks {
+		return "", false
+	}
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+
+	rel, err := filepath.Rel(s.path, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	return target, true
+}
+
+// mirror makes the symlink at dst point to the output of target, relative to
+// dst.
+func (s *Syncer) mirror(m Mapping) error {
+	info, err := os.Stat(m.Link)
+	if err != nil {
+		return errors.Wrap(err, "failed to stat link target")
+	}
+
+	target := s.transpath(m.Link, info.IsDir())
+
+	rel, err := filepath.Rel(filepath.Dir(m.Dst), target)
+	if err != nil {
+		return err
+	}
+
+	if err := osutil.SymlinkAtomic(rel, m.Dst); err != nil {
+		return err
+	}
+
+	if s.opts.Outputs != nil {
+		return s.opts.Outputs.Add(m.Dst)
+	}
+	return nil
+}
+
+// watch adds every directory at and under the followed path to the watcher.
+// The watcher walks the source root by itself, but it never walks into
+// symlinks.
+func (s *Syncer) watch(root string) error {
+	return s.walkTree(root, func(path string, info os.FileInfo) error {
+		if !s.followsDir(path, info) && !(info.IsDir() && s.underLink(path)) {
+			return nil
+		}
+		if err := s.w.Add(path); err != nil {
+			return err
+		}
+		s.followed[path] = true
+		return nil
+	})
+}
+
+// unwatch removes the followed directories at and under root from the watcher.
+func (s *Syncer) unwatch(root string) {
+	for path := range s.followed {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			s.w.Remove(path)
+			delete(s.followed, path)
+		}
+	}
+}
+
+// underLink returns true if the path is inside a followed symlink.
+func (s *Syncer) underLink(path string) bool {
+	return s.followed[filepath.Dir(path)]
+}
@@ -1,24 +1,47 @@
 package sync
 
 import (
-	"log"
+	"context"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
+	gosync "sync"
 	"time"
 
+	"github.com/diamondburned/ffsync/internal/logger"
 	"github.com/diamondburned/ffsync/internal/osutil"
 	"github.com/pkg/errors"
 	"github.com/radovskyb/watcher"
 )
 
+// Converter queues the files to be copied or converted. The context carries
+// the Trigger that caused it.
 type Converter interface {
-	QueueCopy(src, dst string)
-	QueueConvert(src, dst string)
+	QueueCopy(ctx context.Context, src, dst string)
+	QueueConvert(ctx context.Context, src, dst string)
 	ConvertExt(name string) string
 }
 
+// Trigger is the watcher event that made the syncer queue a file.
+type Trigger struct {
+	Op   string    // the watcher's operation, such as "CREATE"
+	Path string    // the path of the event, which may be a parent directory
+	Time time.Time // when the event was received
+	// Stable is when the file was found to be no longer written to, or zero
+	// if it wasn't waited for.
+	Stable time.Time
+}
+
+type triggerKey struct{}
+
+// TriggerFromContext returns the trigger in the context given to the
+// Converter.
+func TriggerFromContext(ctx context.Context) (Trigger, bool) {
+	t, ok := ctx.Value(triggerKey{}).(Trigger)
+	return t, ok
+}
+
 type Syncer struct {
 	w *watcher.Watcher
 	c Converter
@@ -26,6 +49,20 @@ type Syncer struct {
 	path string
 	dest string
 	opts Options
+	log  *logger.Logger
+
+	// formats guards the formats in opts, which can be changed while the
+	// syncer is running.
+	formats gosync.RWMutex
+
+	// followed is the set of directories inside followed symlinks, which are
+	// added to the watcher one by one.
+	followed map[string]bool
+
+	// waiting are the timers of new files waiting to be written, keyed by
+	// source path.
+	waitMutex gosync.Mutex
+	waiting   map[string]*time.Timer
 }
 
 func New(src, dst string, opts Options, c Converter) (*Syncer, error) {
@@ -45,6 +82,10 @@ func New(src, dst string, opts Options, c Converter) (*Syncer, error) {
 		dest: dst,
 		path: a,
 		opts: opts,
+		log:  opts.Log.Component("sync"),
+
+		followed: map[string]bool{},
+		waiting:  map[string]*time.Timer{},
 	}
 
 	w.AddFilterHook(s.checkPath)
@@ -64,12 +105,12 @@ func (s *Syncer) Run(freq time.Duration) error {
 		return errors.Wrap(err, "Failed to add src recursively")
 	}
 
+	if err := s.watch(s.path); err != nil {
+		return errors.Wrap(err, "Failed to add followed symlinks")
+	}
+
 	// Catch up on non-encoded files.
-	go filepath.Walk(s.path, func(path string, info os.FileInfo, err error) error {
-		// Manually check if this is the right file.
-		if s.checkPath(info, path) != nil {
-			return nil
-		}
+	go s.walkTree(s.path, func(path string, info os.FileInfo) error {
 		// Send the event into the event channel.
 		s.w.Event <- watcher.Event{
 			Op:       watcher.Create,
@@ -82,7 +123,7 @@ func (s *Syncer) Run(freq time.Duration) error {
 	go s.w.Start(freq)
 
 	go func() {
-		sig := make(chan os.Signal)
+		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, os.Interrupt)
 		<-sig
 		s.w.Close()
@@ -93,79 +134,381 @@ func (s *Syncer) Run(freq time.Duration) error {
 		case ev := <-s.w.Event:
 			s.event(ev)
 		case err := <-s.w.Error:
-			s.opts.ErrorLog(err)
+			// Followed directories that are gone are removed from the
+			// watcher by the remove event.
+			if err != watcher.ErrWatchedFileDeleted {
+				s.log.Error("Watcher error", "error", err)
+			}
 		case <-s.w.Closed:
 			return nil
 		}
 	}
 }
 
+// Sync synchronizes every file in the source tree whose output doesn't exist
+// once, without watching the tree. The jobs may still be running when it
+// returns.
+func (s *Syncer) Sync() error {
+	if err := os.MkdirAll(s.dest, os.ModePerm); err != nil {
+		return errors.Wrap(err, "Failed to mkdir -p destination directory")
+	}
+
+	return errors.Wrap(s.syncTree(context.Background(), s.path), "Failed to walk src")
+}
+
+// Resync synchronizes every file under the given source path whose output
+// doesn't exist, like Sync does for the whole tree.
+func (s *Syncer) Resync(root string) error {
+	return errors.Wrap(s.syncTree(context.Background(), root), "Failed to walk src")
+}
+
+// SetFormats changes the formats to convert and copy. Files of added formats
+// are synchronized on the next poll of the watcher, while the outputs of
+// removed formats are kept.
+func (s *Syncer) SetFormats(fileFormats, copyFormats []string) {
+	s.formats.Lock()
+	defer s.formats.Unlock()
+
+	s.opts.FileFormats = fileFormats
+	s.opts.CopyFormats = copyFormats
+}
+
+// action returns what's done with files of the given extension.
+func (s *Syncer) action(ext string) fileAction {
+	s.formats.RLock()
+	defer s.formats.RUnlock()
+
+	return s.opts.action(ext)
+}
+
+// Close stops the watcher, which makes Run return.
+func (s *Syncer) Close() {
+	s.w.Close()
+
+	s.waitMutex.Lock()
+	defer s.waitMutex.Unlock()
+
+	for src, t := range s.waiting {
+		t.Stop()
+		delete(s.waiting, src)
+	}
+}
+
 func (s *Syncer) event(ev watcher.Event) {
+	ctx := context.WithValue(context.Background(), triggerKey{}, Trigger{
+		Op:   ev.Op.String(),
+		Path: ev.Path,
+		Time: time.Now(),
+	})
+
 	switch ev.Op {
 	case watcher.Create:
 		dst := s.replacePrefix(ev.Path)
-		log.Println("Creating", dst)
+		s.log.Debug("Creating", "src", ev.Path, "dst", dst)
 
 		// Since there might be a race condition between events being sent,
 		// we're best ensuring a directory is made before every single file.
 		s.catch(os.MkdirAll(filepath.Dir(dst), os.ModePerm), "mkdir -p from create")
-		// Well, we should only transcode a file.
-		if !ev.IsDir() {
-			// Free to interrupt.
-			s.onCreate(ev.Path, dst)
-		}
 
-	case watcher.Move:
-		src := s.transpath(ev.OldPath, ev.IsDir())
-		dst := s.transpath(ev.Path, ev.IsDir())
-		log.Println("Moved from", src, "to", dst)
-		s.catch(osutil.MoveTimeout(time.Minute, src, dst), "mv")
+		switch {
+		case s.followed[ev.Path]:
+			// Already watched and synchronized by the catch-up walk.
+		case s.followsDir(ev.Path, ev.FileInfo) || (ev.IsDir() && s.underLink(ev.Path)):
+			// The watcher doesn't walk into symlinks, so everything inside
+			// has to be added and synchronized here.
+			s.catch(s.watch(ev.Path), "watch followed symlink")
+			s.resync(ctx, ev.Path)
+		case !ev.IsDir():
+			// Well, we should only transcode a file.
+			s.onCreate(ctx, ev.Path)
+		}
 
-	case watcher.Rename:
-		src := s.transpath(ev.OldPath, ev.IsDir())
-		dst := s.transpath(ev.Path, ev.IsDir())
-		log.Println("Renamed from", src, "to", dst)
-		s.catch(os.Rename(src, dst), "rename from rename")
+	case watcher.Move, watcher.Rename:
+		s.unwatch(ev.OldPath)
+		s.move(ctx, ev)
 
 	case watcher.Remove:
-		dst := s.transpath(ev.Path, ev.IsDir())
-		log.Println("Removed", dst)
-		s.catch(osutil.RemoveAllIfEmpty(ev.Path, dst), "rm -r from remove")
+		// The watcher also reports files of removed formats as removed,
+		// since they're filtered out now.
+		if _, err := os.Lstat(ev.Path); err == nil {
+			return
+		}
+		s.unwatch(ev.Path)
+		s.remove(ev.Path, s.transpath(ev.Path, ev.IsDir()))
+	}
+}
+
+// remove removes the outputs of a removed source path. If there's nothing left
+// to synchronize in the source directory, then the leftover outputs in the
+// destination directory, such as the album art, are removed as well.
+func (s *Syncer) remove(src, dst string) {
+	s.catch(s.removeOutputs(dst), "rm -r from remove")
+
+	// Never clean up the destination root this way, since the source root
+	// might just be unmounted.
+	if srcDir := filepath.Dir(src); srcDir != s.path && !s.hasFiles(srcDir) {
+		s.catch(s.removeOutputs(filepath.Dir(dst)), "rm -r parent from remove")
 	}
 }
 
-func (s *Syncer) onCreate(src, dst string) {
-	var action = s.opts.action(filepath.Ext(src))
-	if action == convertAction {
-		dst = s.c.ConvertExt(dst)
+// removeOutputs removes the known outputs at or under dst.
+func (s *Syncer) removeOutputs(dst string) error {
+	return osutil.RemoveOutputs(dst, s.isOutput, s.opts.Trash, s.removed)
+}
+
+// removed is called for every output put into the trash.
+func (s *Syncer) removed(path string) {
+	s.log.Info("Removed", "dst", path)
+	if s.opts.Outputs != nil {
+		s.catch(s.opts.Outputs.Remove(path), "remove from manifest")
+	}
+	if s.opts.OnRemove != nil {
+		s.opts.OnRemove(path)
+	}
+}
+
+// isOutput returns true if the file at path was written by us.
+func (s *Syncer) isOutput(path string) bool {
+	return s.opts.Outputs == nil || s.opts.Outputs.Has(path)
+}
+
+var errFound = errors.New("found")
+
+// hasFiles returns true if the source directory has any file to synchronize.
+func (s *Syncer) hasFiles(dir string) bool {
+	err := s.walk(dir, func(Mapping) error { return errFound })
+	return err == errFound
+}
+
+// move moves the output of a moved or renamed source path, then synchronizes
+// the moved subtree to catch files that weren't synchronized yet. If the output
+// can't be moved, then the subtree is synchronized again from scratch.
+func (s *Syncer) move(ctx context.Context, ev watcher.Event) {
+	src := s.transpath(ev.OldPath, ev.IsDir())
+	dst := s.transpath(ev.Path, ev.IsDir())
+	s.log.Info("Moved", "src", src, "dst", dst)
+
+	// The output of a file is different if the action for its extension is
+	// different, so it can't be moved. Mirrored symlinks are relative, so
+	// they're made again as well.
+	_, mirrored := s.linkTarget(ev.Path)
+	if mirrored || (!ev.IsDir() && s.action(filepath.Ext(ev.OldPath)) != s.action(filepath.Ext(ev.Path))) {
+		s.catch(s.removeOutputs(src), "rm from move")
+		s.resync(ctx, ev.Path)
+		return
+	}
+
+	err := os.MkdirAll(filepath.Dir(dst), os.ModePerm)
+	if err == nil {
+		if ev.IsDir() {
+			// Events are not ordered, so the outputs of some files might have
+			// been moved into the new directory already.
+			err = osutil.MergeDir(src, dst, s.isOutput, s.opts.Trash, s.removed)
+		} else {
+			err = osutil.MoveTimeout(time.Minute, src, dst)
+		}
+	}
+
+	switch {
+	case err == nil:
+		if s.opts.Outputs != nil {
+			s.catch(s.opts.Outputs.Move(src, dst), "move in manifest")
+		}
+		if s.opts.OnMove != nil {
+			s.opts.OnMove(src, dst)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		s.catch(err, "mv, synchronizing again")
+		// Don't leave the old output behind, since it's not in the source
+		// anymore.
+		s.catch(s.removeOutputs(src), "rm -r from failed mv")
+	}
+
+	s.catch(s.watch(ev.Path), "watch followed symlink")
+	s.resync(ctx, ev.Path)
+}
+
+// resync synchronizes every file under the given source path whose output
+// doesn't exist.
+func (s *Syncer) resync(ctx context.Context, root string) {
+	s.catch(s.syncTree(ctx, root), "walk from resync")
+}
+
+func (s *Syncer) syncTree(ctx context.Context, root string) error {
+	return s.walk(root, func(m Mapping) error {
+		s.catch(os.MkdirAll(filepath.Dir(m.Dst), os.ModePerm), "mkdir -p from resync")
+		s.queue(ctx, m)
+		return nil
+	})
+}
+
+func (s *Syncer) onCreate(ctx context.Context, src string) {
+	m, ok := s.Map(src)
+	if !ok {
+		return
+	}
+
+	if m.Link == "" && s.opts.StableWait > 0 {
+		s.queueStable(ctx, m)
+		return
+	}
+
+	s.queue(ctx, m)
+}
+
+// queueStable queues the mapping once the size and modification time of its
+// source stay the same for StableWait, without blocking the event loop. It's
+// dropped if the source is gone meanwhile.
+func (s *Syncer) queueStable(ctx context.Context, m Mapping) {
+	last, err := os.Stat(m.Src)
+	if err != nil {
+		return
+	}
+
+	s.waitMutex.Lock()
+	defer s.waitMutex.Unlock()
+
+	if _, ok := s.waiting[m.Src]; ok {
+		return
+	}
+
+	var check func()
+	check = func() {
+		st, err := os.Stat(m.Src)
+		changed := err == nil && (st.Size() != last.Size() || !st.ModTime().Equal(last.ModTime()))
+
+		s.waitMutex.Lock()
+		if _, ok := s.waiting[m.Src]; !ok {
+			// Closed meanwhile.
+			s.waitMutex.Unlock()
+			return
+		}
+		if changed {
+			s.log.Debug("Waiting for the file to be written", "src", m.Src)
+			last = st
+			s.waiting[m.Src] = time.AfterFunc(s.opts.StableWait, check)
+			s.waitMutex.Unlock()
+			return
+		}
+		delete(s.waiting, m.Src)
+		s.waitMutex.Unlock()
+
+		if err != nil {
+			return
+		}
+
+		if trigger, ok := TriggerFromContext(ctx); ok {
+			trigger.Stable = time.Now()
+			ctx = context.WithValue(ctx, triggerKey{}, trigger)
+		}
+		s.queue(ctx, m)
+	}
+
+	s.waiting[m.Src] = time.AfterFunc(s.opts.StableWait, check)
+}
+
+// queue queues the mapping if its output doesn't exist.
+func (s *Syncer) queue(ctx context.Context, m Mapping) {
+	if m.Link != "" {
+		if _, err := os.Lstat(m.Dst); err != nil {
+			s.catch(s.mirror(m), "mirror symlink")
+		}
+		return
 	}
 
 	// See if the file already exists in the destination.
-	if _, err := os.Stat(dst); err == nil {
+	if _, err := os.Stat(m.Dst); err == nil {
 		return
 	}
 
-	switch action {
+	if m.Convert {
+		s.c.QueueConvert(ctx, m.Src, m.Dst)
+	} else {
+		s.c.QueueCopy(ctx, m.Src, m.Dst)
+	}
+}
+
+// Mapping is a file in the source tree mapped to its output in the destination.
+type Mapping struct {
+	Src     string
+	Dst     string
+	Convert bool // false if the file is copied
+	// Link is the path in the source tree that the symlink at Src points to
+	// if it's mirrored. Dst is then made a symlink to the output of Link.
+	Link string
+}
+
+// Map returns the mapping of the given source file. False is returned if the
+// file is not synchronized.
+func (s *Syncer) Map(src string) (Mapping, bool) {
+	if target, ok := s.linkTarget(src); ok {
+		info, err := os.Stat(target)
+		if err != nil {
+			return Mapping{}, false
+		}
+		return Mapping{Src: src, Dst: s.transpath(src, info.IsDir()), Link: target}, true
+	}
+
+	switch s.action(filepath.Ext(src)) {
 	case copyAction:
-		s.c.QueueCopy(src, dst)
+		return Mapping{Src: src, Dst: s.replacePrefix(src)}, true
 	case convertAction:
-		s.c.QueueConvert(src, dst)
+		return Mapping{Src: src, Dst: s.c.ConvertExt(s.replacePrefix(src)), Convert: true}, true
+	default:
+		return Mapping{}, false
 	}
 }
 
+// Walk walks the source tree and calls fn with the mapping of every file that
+// is synchronized. Hidden files and directories are skipped, and symlinks are
+// handled according to the options.
+func (s *Syncer) Walk(fn func(Mapping) error) error {
+	return s.walk(s.path, fn)
+}
+
+// WalkFrom is like Walk, but only walks the given path inside the source tree.
+func (s *Syncer) WalkFrom(root string, fn func(Mapping) error) error {
+	return s.walk(root, fn)
+}
+
+func (s *Syncer) walk(root string, fn func(Mapping) error) error {
+	return s.walkTree(root, func(path string, info os.FileInfo) error {
+		if info.IsDir() || s.followsDir(path, info) {
+			return nil
+		}
+
+		if m, ok := s.Map(path); ok {
+			return fn(m)
+		}
+		return nil
+	})
+}
+
 func (s *Syncer) checkPath(i os.FileInfo, abs string) error {
 	// Skip hidden files and directories.
 	if strings.HasPrefix(filepath.Base(abs), ".") {
 		return watcher.ErrSkip
 	}
 
+	if isSymlink(i) {
+		if s.opts.Symlinks.orDefault() == IgnoreSymlinks {
+			return watcher.ErrSkip
+		}
+		// Check what the symlink points to instead, skipping dangling ones.
+		target, err := os.Stat(abs)
+		if err != nil {
+			return watcher.ErrSkip
+		}
+		i = target
+	}
+
 	// Allow directories.
 	if i.IsDir() {
 		return nil
 	}
 
 	// Allow whitelisted file extensions prefixed with a dot (.)
-	if s.opts.IsExt(filepath.Ext(abs)) {
+	if s.action(filepath.Ext(abs)) > noAction {
 		return nil
 	}
 
@@ -180,7 +523,7 @@ func (s *Syncer) transpath(abs string, dir bool) string {
 
 	// If this is not a directory and the action is a conversion, then convert
 	// the extension.
-	if !dir && s.opts.action(filepath.Ext(abs)) == convertAction {
+	if !dir && s.action(filepath.Ext(abs)) == convertAction {
 		path = s.c.ConvertExt(path)
 	}
 
@@ -195,6 +538,6 @@ func (s *Syncer) replacePrefix(abs string) (path string) {
 
 func (s *Syncer) catch(err error, failedTo string) {
 	if err != nil {
-		s.opts.ErrorLog(errors.Wrap(err, "Failed to "+failedTo))
+		s.log.Error("Failed to "+failedTo, "error", err)
 	}
 }
@@ -11,6 +11,8 @@ import (
 	"time"
 
 	"github.com/diamondburned/ffsync/ffmpeg"
+	"github.com/diamondburned/ffsync/internal/logger"
+	"github.com/radovskyb/watcher"
 )
 
 const prepared = 25
@@ -25,18 +27,23 @@ func TestSyncer(t *testing.T) {
 
 	m := newMock(t, src)
 
-	s, err := New(src, dst, []string{".ff"}, m)
-	if err != nil {
-		t.Fatal("Failed to create syncer:", err)
+	opts := Options{
+		FileFormats: []string{".ff"},
+		Log: warnLogger(func(line string) {
+			t.Error("Syncer error:", line)
+		}),
 	}
 
-	s.Error = func(err error) {
-		t.Error("Syncer error:", err)
+	s, err := New(src, dst, opts, m)
+	if err != nil {
+		t.Fatal("Failed to create syncer:", err)
 	}
 
-	if err := s.Start(tick); err != nil {
-		t.Fatal("Failed to start:", err)
-	}
+	go func() {
+		if err := s.Run(tick); err != nil {
+			t.Error("Failed to run:", err)
+		}
+	}()
 	defer s.Close()
 
 	// Idle for a bit.
@@ -97,6 +104,29 @@ FileLoop:
 		break
 	}
 
+	// Add a format, expect the existing file of it to be picked up.
+	t.Log("touch new/other.ff2")
+	if err := os.Mkdir(filepath.Join(m.src, "new"), os.ModePerm); err != nil {
+		t.Fatal("Failed to make a test directory:", err)
+	}
+	if _, err := os.Create(filepath.Join(m.src, "new", "other.ff2")); err != nil {
+		t.Fatal("Failed to create a file of a new format:", err)
+	}
+
+	s.SetFormats([]string{".ff", ".ff2"}, nil)
+
+	if conv := <-m.converted; !strings.HasSuffix(conv, "/new/other.converted") {
+		t.Fatal("File of the new format is not in expected location:", conv)
+	}
+
+	// Remove the format again, expect the output to be kept.
+	s.SetFormats([]string{".ff"}, nil)
+	time.Sleep(tick * 5)
+
+	if _, err := os.Stat(filepath.Join(dst, "new", "other.converted")); err != nil {
+		t.Fatal("Output of the removed format is gone:", err)
+	}
+
 	// Try making a file in a folder.
 	t.Log("mkdir astolfo")
 	if err := os.Mkdir(filepath.Join(m.src, "astolfo"), os.ModePerm); err != nil {
@@ -114,14 +144,229 @@ FileLoop:
 		t.Fatal("New file is not in expected location:", conv)
 	}
 
+	// Rename the directory, expect the output to be moved along.
+	t.Log("mv astolfo felix")
+	if err := os.Rename(filepath.Join(m.src, "astolfo"), filepath.Join(m.src, "felix")); err != nil {
+		t.Fatal("Failed to rename astolfo/:", err)
+	}
+
+	var moved = filepath.Join(dst, "felix", "test.converted")
+
+	for deadline := time.Now().Add(tick * 20); ; {
+		if _, err := os.Stat(moved); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Output was not moved to", moved)
+		}
+		time.Sleep(tick)
+	}
+
 	// Remove the directory, expect no errors.
-	if err := os.RemoveAll(filepath.Join(m.src, "astolfo")); err != nil {
-		t.Fatal("Failed to remove astolfo/:", err)
+	if err := os.RemoveAll(filepath.Join(m.src, "felix")); err != nil {
+		t.Fatal("Failed to remove felix/:", err)
 	}
 
 	time.Sleep(2 * time.Second)
 }
 
+func TestSymlinks(t *testing.T) {
+	src := mktmpdir(t)
+
+	album := filepath.Join(src, "artist", "album")
+	if err := os.MkdirAll(album, os.ModePerm); err != nil {
+		t.Fatal("Failed to mkdir:", err)
+	}
+	if _, err := os.Create(filepath.Join(album, "song.ff")); err != nil {
+		t.Fatal("Failed to touch:", err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "other"), os.ModePerm); err != nil {
+		t.Fatal("Failed to mkdir:", err)
+	}
+
+	// A compilation shared with another artist, and a link that loops back.
+	links := map[string]string{
+		filepath.Join(src, "other", "compilation"): "../artist/album",
+		filepath.Join(album, "loop"):               "..",
+	}
+	for path, target := range links {
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal("Failed to symlink:", err)
+		}
+	}
+
+	tests := []struct {
+		mode  SymlinkMode
+		dsts  []string
+		loops int
+	}{{
+		mode:  FollowSymlinks,
+		dsts:  []string{"artist/album/song.converted", "other/compilation/song.converted"},
+		loops: 2,
+	}, {
+		mode: MirrorSymlinks,
+		dsts: []string{"artist/album/loop", "artist/album/song.converted", "other/compilation"},
+	}, {
+		mode: IgnoreSymlinks,
+		dsts: []string{"artist/album/song.converted"},
+	}}
+
+	for _, test := range tests {
+		t.Run(string(test.mode), func(t *testing.T) {
+			dst := mktmpdir(t)
+
+			var loops int
+			opts := Options{
+				FileFormats: []string{".ff"},
+				Log:         warnLogger(func(string) { loops++ }),
+				Symlinks:    test.mode,
+			}
+
+			s, err := New(src, dst, opts, &mock{})
+			if err != nil {
+				t.Fatal("Failed to create syncer:", err)
+			}
+
+			var mappings []Mapping
+			err = s.Walk(func(m Mapping) error {
+				mappings = append(mappings, m)
+				return nil
+			})
+			if err != nil {
+				t.Fatal("Failed to walk:", err)
+			}
+
+			var dsts []string
+			for _, m := range mappings {
+				rel, _ := filepath.Rel(dst, m.Dst)
+				dsts = append(dsts, rel)
+			}
+
+			if strings.Join(dsts, " ") != strings.Join(test.dsts, " ") {
+				t.Fatalf("Unexpected outputs %q", dsts)
+			}
+			if loops != test.loops {
+				t.Fatalf("Expected %d loops to be skipped, got %d", test.loops, loops)
+			}
+
+			if test.mode != MirrorSymlinks {
+				return
+			}
+
+			for _, m := range mappings {
+				if m.Link == "" {
+					continue
+				}
+				if err := os.MkdirAll(filepath.Dir(m.Dst), os.ModePerm); err != nil {
+					t.Fatal("Failed to mkdir:", err)
+				}
+				s.queue(context.Background(), m)
+			}
+
+			target, err := os.Readlink(filepath.Join(dst, "other", "compilation"))
+			if err != nil {
+				t.Fatal("Symlink was not mirrored:", err)
+			}
+			if target != "../artist/album" {
+				t.Fatal("Mirrored symlink points to", target)
+			}
+		})
+	}
+}
+
+func TestStableWait(t *testing.T) {
+	src := mktmpdir(t)
+	dst := mktmpdir(t)
+
+	const wait = 5 * tick
+
+	c := &triggerMock{triggers: make(chan Trigger, 2)}
+
+	s, err := New(src, dst, Options{FileFormats: []string{".ff"}, StableWait: wait}, c)
+	if err != nil {
+		t.Fatal("Failed to create syncer:", err)
+	}
+	defer s.Close()
+
+	old := filepath.Join(src, "old.ff")
+	written := filepath.Join(src, "written.ff")
+
+	for _, path := range []string{old, written} {
+		if err := ioutil.WriteFile(path, []byte("ff"), 0644); err != nil {
+			t.Fatal("Failed to write:", err)
+		}
+	}
+
+	// Like cp -p, which sets an old modification time.
+	var mtime = time.Now().Add(-time.Hour)
+	if err := os.Chtimes(old, mtime, mtime); err != nil {
+		t.Fatal("Failed to chtimes:", err)
+	}
+
+	var start = time.Now()
+
+	for _, path := range []string{written, old} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal("Failed to stat:", err)
+		}
+		s.event(watcher.Event{Op: watcher.Create, Path: path, FileInfo: info})
+	}
+
+	if elapsed := time.Since(start); elapsed > tick {
+		t.Fatal("Events blocked for", elapsed)
+	}
+
+	// Keep writing the old file with its time kept, which only changes its
+	// size, and the other one for a while.
+	time.Sleep(wait / 2)
+	if err := ioutil.WriteFile(old, []byte("more ff"), 0644); err != nil {
+		t.Fatal("Failed to write:", err)
+	}
+	if err := os.Chtimes(old, mtime, mtime); err != nil {
+		t.Fatal("Failed to chtimes:", err)
+	}
+
+	var expects = []struct {
+		src  string
+		wait time.Duration
+	}{
+		{written, wait},
+		{old, 2 * wait},
+	}
+
+	for _, expect := range expects {
+		select {
+		case trigger := <-c.triggers:
+			if trigger.Path != expect.src {
+				t.Fatalf("Expected %s to be queued, got %s", expect.src, trigger.Path)
+			}
+			waited := trigger.Stable.Sub(trigger.Time)
+			if waited < expect.wait || waited > expect.wait+2*tick {
+				t.Errorf("%s: expected to wait %v, waited %v", expect.src, expect.wait, waited)
+			}
+		case <-time.After(4 * wait):
+			t.Fatal("Timed out waiting for", expect.src)
+		}
+	}
+}
+
+// triggerMock sends the trigger of every queued file.
+type triggerMock struct {
+	triggers chan Trigger
+}
+
+func (m *triggerMock) QueueConvert(ctx context.Context, src, dst string) {
+	trigger, _ := TriggerFromContext(ctx)
+	m.triggers <- trigger
+}
+
+func (m *triggerMock) QueueCopy(ctx context.Context, src, dst string) {}
+
+func (m *triggerMock) ConvertExt(name string) string {
+	return ffmpeg.ConvertExt(name, "converted")
+}
+
 type mock struct {
 	converted chan string
 	src       string
@@ -140,27 +385,37 @@ func newMock(t *testing.T, src string) *mock {
 	return &mock{src: src, converted: make(chan string)}
 }
 
-func (m *mock) ConvertCtx(ctx context.Context, src, dst string) error {
-	_, err := os.Create(dst)
+func (m *mock) QueueConvert(ctx context.Context, src, dst string) {
+	f, err := os.Create(dst)
 	if err != nil {
-		return err
-	}
-
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-time.After(tick):
-		// noop
+		return
 	}
+	f.Close()
 
-	m.converted <- dst
-	return nil
+	go func() {
+		time.Sleep(tick)
+		m.converted <- dst
+	}()
 }
 
+func (m *mock) QueueCopy(ctx context.Context, src, dst string) {}
+
 func (m *mock) ConvertExt(name string) string {
 	return ffmpeg.ConvertExt(name, "converted")
 }
 
+// warnLogger returns a logger that calls fn with every warning and error.
+func warnLogger(fn func(line string)) *logger.Logger {
+	return logger.New(lineWriter(fn), logger.Config{Level: logger.Warn})
+}
+
+type lineWriter func(line string)
+
+func (w lineWriter) Write(b []byte) (int, error) {
+	w(strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
+
 func mktmpdir(t *testing.T) string {
 	p, err := ioutil.TempDir(os.TempDir(), "sync-test-")
 	if err != nil {
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/diamondburned/ffsync/ffmpeg"
+	"github.com/diamondburned/ffsync/ffmpeg/cover"
+	"github.com/diamondburned/ffsync/internal/logger"
+	"github.com/diamondburned/ffsync/internal/osutil"
+	"github.com/diamondburned/ffsync/internal/retry"
+	"github.com/diamondburned/ffsync/internal/telemetry/fallback"
+	"github.com/diamondburned/ffsync/sync"
+)
+
+// Kinds of issues found by the verify command.
+const (
+	issueCorrupt   = "corrupt"
+	issueTruncated = "truncated"
+	issueOrphaned  = "orphaned"
+	issueMissing   = "missing"
+)
+
+// issue is a problem with an output found by the verify command.
+type issue struct {
+	Kind    string `json:"kind"`
+	Src     string `json:"src,omitempty"`
+	Dst     string `json:"dst"`
+	Error   string `json:"error,omitempty"`
+	convert bool
+}
+
+// verifier checks every output in the destination against the source tree.
+type verifier struct {
+	app      *Application
+	verify   ffmpeg.Verification
+	expected map[string]sync.Mapping // keyed by dst
+	covers   map[string]bool         // album arts next to converted tracks
+	seen     map[string]bool
+
+	mutex  gosync.Mutex
+	issues []issue
+}
+
+// verifyMain implements the verify command.
+func verifyMain(cmd command, args []string) {
+	fs := cmd.flags()
+	jsonOut := fs.Bool("json", false, "print the report as JSON")
+	fix := fs.Bool("fix", false, "quarantine bad outputs and write them and missing outputs again")
+	configPath, sets := configFlags(fs)
+	fs.Parse(args)
+
+	set := commandSettings(fs, *configPath, *sets, true)
+
+	requireFFmpeg()
+
+	src, dst := set.Src, set.Dst
+
+	// Don't retry anything, since we're not going to stay around for it.
+	l := logger.New(os.Stderr, set.Log)
+	a := newApplication(set, dst, l, fallback.New(l), retry.Policy{MaxAttempts: 1})
+	a.oneShot = true
+
+	// Only fixing writes outputs.
+	if *fix {
+		a.openOutputs()
+	}
+
+	s, err := sync.New(src, dst, a.syncOptions(set.Sync), a)
+	if err != nil {
+		l.Fatal("Failed to make a new syncer", "error", err)
+	}
+
+	v := verifier{
+		app:      a,
+		verify:   ffmpeg.Verification{Tolerance: 2 * time.Second},
+		expected: map[string]sync.Mapping{},
+		covers:   map[string]bool{},
+		seen:     map[string]bool{},
+	}
+	if set.Verify != nil {
+		v.verify = *set.Verify
+	}
+
+	err = s.Walk(func(m sync.Mapping) error {
+		v.expect(m)
+		return nil
+	})
+	if err != nil {
+		l.Fatal("Failed to walk the source", "error", err)
+	}
+
+	if err := v.walk(dst); err != nil {
+		l.Fatal("Failed to walk the destination", "error", err)
+	}
+
+	issues := v.report()
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(issues)
+	} else {
+		for _, issue := range issues {
+			fmt.Printf("%s\t%s", issue.Kind, issue.Dst)
+			if issue.Error != "" {
+				fmt.Printf("\t%s", strings.ReplaceAll(issue.Error, "\n", " "))
+			}
+			fmt.Println()
+		}
+	}
+
+	if *fix {
+		v.fix(issues)
+	}
+
+	if len(issues) > 0 {
+		os.Exit(exitProblems)
+	}
+}
+
+// expect adds the output of the mapping, and the album art extracted next to
+// it if it's converted, like orphans does.
+func (v *verifier) expect(m sync.Mapping) {
+	v.expected[m.Dst] = m
+	if m.Convert {
+		path, _ := cover.ExistsAlbum(m.Dst)
+		v.covers[path] = true
+	}
+}
+
+// walk checks every output in the destination in parallel.
+func (v *verifier) walk(dst string) error {
+	var stateDir = osutil.StateDir(dst)
+
+	err := filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == stateDir {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+
+		m, ok := v.expected[path]
+		if ok {
+			v.seen[path] = true
+		}
+
+		switch {
+		case ok && m.Link != "":
+			// Mirrored symlinks are checked through what they point to.
+			return nil
+		case ok:
+			// Checked below.
+		case v.covers[path]:
+			// Extracted album arts aren't in the source tree, but are only
+			// expected next to a converted track.
+			m = sync.Mapping{Dst: path}
+		default:
+			v.add(issue{Kind: issueOrphaned, Dst: path})
+			return nil
+		}
+
+		v.app.semaJob(context.Background(), "verify", m.Src, m.Dst, 0, v.app.FFmpegPool, func(ctx context.Context, _ uint64) {
+			v.check(ctx, m)
+		})
+
+		return nil
+	})
+
+	v.app.Wait()
+
+	for dst, m := range v.expected {
+		if !v.seen[dst] {
+			v.add(issue{Kind: issueMissing, Src: m.Src, Dst: dst, convert: m.Convert})
+		}
+	}
+
+	return err
+}
+
+// check checks a single output.
+func (v *verifier) check(ctx context.Context, m sync.Mapping) {
+	var err error
+
+	switch {
+	case m.Convert:
+		var in time.Duration
+		if probe, perr := ffmpeg.ProbeCtx(ctx, m.Src); perr == nil {
+			in = probe.Duration
+		}
+		err = v.verify.VerifyCtx(ctx, m.Dst, in)
+
+	case m.Src != "":
+		// Follow the output in case it's a symlink.
+		d, derr := os.Stat(m.Dst)
+		if derr != nil {
+			err = derr
+			break
+		}
+		if s, serr := os.Stat(m.Src); serr == nil && s.Size() != d.Size() {
+			err = &ffmpeg.VerifyError{
+				Reason:    fmt.Sprintf("output is %d bytes, but the input is %d", d.Size(), s.Size()),
+				Truncated: d.Size() < s.Size(),
+			}
+			break
+		}
+		fallthrough
+
+	default:
+		if isImage(m.Dst) {
+			err = checkImage(m.Dst)
+		}
+	}
+
+	if err == nil {
+		return
+	}
+
+	var kind = issueCorrupt
+	var verr *ffmpeg.VerifyError
+	if errors.As(err, &verr) && verr.Truncated {
+		kind = issueTruncated
+	}
+
+	v.add(issue{Kind: kind, Src: m.Src, Dst: m.Dst, Error: err.Error(), convert: m.Convert})
+}
+
+func (v *verifier) add(i issue) {
+	v.mutex.Lock()
+	v.issues = append(v.issues, i)
+	v.mutex.Unlock()
+}
+
+// report returns all issues sorted by the destination path.
+func (v *verifier) report() []issue {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	sort.Slice(v.issues, func(i, j int) bool {
+		return v.issues[i].Dst < v.issues[j].Dst
+	})
+
+	return v.issues
+}
+
+// fix quarantines bad outputs and writes them and missing outputs again.
+// Orphaned outputs are left alone, since they might have been put there by
+// the user.
+func (v *verifier) fix(issues []issue) {
+	for _, i := range issues {
+		if i.Src == "" {
+			continue
+		}
+
+		switch i.Kind {
+		case issueCorrupt, issueTruncated:
+			v.app.quarantine(i.Dst)
+		case issueMissing:
+			// Make sure the directory exists, like the syncer would.
+			if err := os.MkdirAll(filepath.Dir(i.Dst), os.ModePerm); err != nil {
+				v.app.Log.Component("verify").Error("Failed to mkdir -p", "dst", i.Dst, "error", err)
+				continue
+			}
+		default:
+			continue
+		}
+
+		var action = copyJob
+		if i.convert {
+			action = convertJob
+		}
+
+		v.app.Log.Component("verify").Info("Requeueing", "kind", i.Kind, "src", i.Src, "dst", i.Dst)
+		v.app.queue(action, i.Src, i.Dst)
+	}
+
+	v.app.Wait()
+}
+
+func isImage(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	default:
+		return false
+	}
+}
+
+// checkImage checks that the file at path is a valid image.
+func checkImage(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, _, err := image.Decode(f); err != nil {
+		return &ffmpeg.VerifyError{Reason: "invalid image: " + err.Error()}
+	}
+
+	return nil
+}
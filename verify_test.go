@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diamondburned/ffsync/sync"
+)
+
+func TestVerifyOrphanedCover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffsync-verify-")
+	if err != nil {
+		t.Fatal("Failed to create tmpdir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// No track of this album is converted anymore.
+	cover := filepath.Join(dir, "b", "cover.jpg")
+	if err := os.MkdirAll(filepath.Dir(cover), os.ModePerm); err != nil {
+		t.Fatal("Failed to mkdir:", err)
+	}
+	if err := ioutil.WriteFile(cover, nil, 0644); err != nil {
+		t.Fatal("Failed to write:", err)
+	}
+
+	v := verifier{
+		app:      &Application{},
+		expected: map[string]sync.Mapping{},
+		covers:   map[string]bool{},
+		seen:     map[string]bool{},
+	}
+	v.expect(sync.Mapping{Src: "/src/a/1.flac", Dst: filepath.Join(dir, "a", "1.opus"), Convert: true})
+	v.expect(sync.Mapping{Src: "/src/b/front.jpg", Dst: filepath.Join(dir, "b", "front.jpg")})
+
+	if err := v.walk(dir); err != nil {
+		t.Fatal("Failed to walk:", err)
+	}
+
+	var expects = []issue{
+		{Kind: issueMissing, Src: "/src/a/1.flac", Dst: filepath.Join(dir, "a", "1.opus"), convert: true},
+		{Kind: issueOrphaned, Dst: cover},
+		{Kind: issueMissing, Src: "/src/b/front.jpg", Dst: filepath.Join(dir, "b", "front.jpg")},
+	}
+
+	issues := v.report()
+	if len(issues) != len(expects) {
+		t.Fatalf("Unexpected issues %+v", issues)
+	}
+	for i, expect := range expects {
+		if issues[i] != expect {
+			t.Errorf("Issue %d: expected %+v, got %+v", i, expect, issues[i])
+		}
+	}
+}